@@ -14,3 +14,8 @@ func detectArch() arch.KnownArch {
 	a, _ := arch.ParseArch(runtime.GOARCH)
 	return a
 }
+
+// detectMachineId returns GOARCH
+func detectMachineId() string {
+	return runtime.GOARCH
+}
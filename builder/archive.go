@@ -0,0 +1,375 @@
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveFormat is a kind of archive detected by magic bytes.
+type archiveFormat int
+
+const (
+	archiveTar archiveFormat = iota
+	archiveGzip
+	archiveXz
+	archiveZstd
+	archiveBzip2
+	archiveZip
+)
+
+// archiveMagic contains the magic bytes of the compressed formats.
+var archiveMagic = []struct {
+	format archiveFormat
+	magic  []byte
+}{
+	{archiveGzip, []byte{0x1f, 0x8b}},
+	{archiveXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{archiveZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{archiveBzip2, []byte{'B', 'Z', 'h'}},
+	{archiveZip, []byte{'P', 'K', 0x03, 0x04}},
+	{archiveZip, []byte{'P', 'K', 0x05, 0x06}},
+}
+
+// detectArchiveFormat detects the format from the header of the file.
+//
+// Defaults to an uncompressed tar.
+func detectArchiveFormat(header []byte) archiveFormat {
+	for _, m := range archiveMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.format
+		}
+	}
+	return archiveTar
+}
+
+// archiveExtractor extracts archives to a directory.
+type archiveExtractor struct {
+	// destination is the directory to extract to.
+	destination string
+	// stripComponents is the number of leading path components to remove.
+	stripComponents int
+	// chown indicates we should restore the owner of the entries.
+	chown bool
+
+	// dirs are the attributes to set on directories after extracting.
+	dirs map[string]dirAttrs
+}
+
+// dirAttrs are the attributes of a directory entry.
+type dirAttrs struct {
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// modeMask is the part of the mode restored on entries.
+const modeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// extractArchive extracts an archive file to a directory.
+//
+// The format is detected by the magic bytes of the file.
+func extractArchive(archivePath, destination string, stripComponents int) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ex := &archiveExtractor{
+		destination:     destination,
+		stripComponents: stripComponents,
+		chown:           os.Geteuid() == 0,
+		dirs:            make(map[string]dirAttrs),
+	}
+
+	format := detectArchiveFormat(header[:n])
+	if format == archiveZip {
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		err = ex.extractZip(f, st.Size())
+	} else {
+		var rd io.Reader = bufio.NewReader(f)
+		switch format {
+		case archiveGzip:
+			gzr, err := gzip.NewReader(rd)
+			if err != nil {
+				return err
+			}
+			defer gzr.Close()
+			rd = gzr
+		case archiveXz:
+			rd, err = xz.NewReader(rd)
+			if err != nil {
+				return err
+			}
+		case archiveZstd:
+			zr, err := zstd.NewReader(rd)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			rd = zr
+		case archiveBzip2:
+			rd = bzip2.NewReader(rd)
+		}
+		err = ex.extractTar(tar.NewReader(rd))
+	}
+	if err != nil {
+		return err
+	}
+
+	// set directory attributes last: the contents change the mtime and
+	// read-only directories cannot be written to.
+	for dirPath, attrs := range ex.dirs {
+		if err := os.Chmod(dirPath, attrs.mode); err != nil {
+			return err
+		}
+		_ = os.Chtimes(dirPath, attrs.mtime, attrs.mtime)
+	}
+	return nil
+}
+
+// entryName cleans the name of an entry and removes the leading components.
+//
+// Returns an empty name if the entry is removed by stripComponents.
+func (e *archiveExtractor) entryName(name string) (string, error) {
+	name = strings.TrimPrefix(filepath.ToSlash(name), "/")
+	parts := strings.Split(name, "/")
+	for _, part := range parts {
+		if part == ".." {
+			return "", errors.Errorf("archive entry cannot contain ..: %s", name)
+		}
+	}
+	if len(parts) <= e.stripComponents {
+		return "", nil
+	}
+	name = path.Clean(strings.Join(parts[e.stripComponents:], "/"))
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// entryPath resolves the path of an entry in the destination.
+//
+// The parent directory is resolved with symlinks scoped to the destination.
+// Returns an empty path if the entry is removed by stripComponents.
+func (e *archiveExtractor) entryPath(name string) (string, error) {
+	name, err := e.entryName(name)
+	if err != nil || name == "" {
+		return "", err
+	}
+	parent, err := securejoin.SecureJoin(e.destination, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, path.Base(name)), nil
+}
+
+// prepareEntry creates the parent dirs of an entry and removes any existing non-directory.
+func prepareEntry(entryPath string) error {
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0755); err != nil {
+		return err
+	}
+	if st, err := os.Lstat(entryPath); err == nil && !st.IsDir() {
+		return os.Remove(entryPath)
+	}
+	return nil
+}
+
+// writeEntryFile writes a regular file entry.
+func writeEntryFile(entryPath string, mode os.FileMode, rd io.Reader) error {
+	f, err := os.OpenFile(entryPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rd)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	// the umask applies to OpenFile.
+	return os.Chmod(entryPath, mode)
+}
+
+// extractTar extracts the entries of a tar archive.
+func (e *archiveExtractor) extractTar(tarr *tar.Reader) error {
+	for {
+		hdr, err := tarr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entryPath, err := e.entryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if entryPath == "" {
+			continue
+		}
+
+		mode := hdr.FileInfo().Mode() & modeMask
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if st, err := os.Lstat(entryPath); err == nil && !st.IsDir() {
+				if err := os.Remove(entryPath); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return err
+			}
+			e.dirs[entryPath] = dirAttrs{mode: mode, mtime: hdr.ModTime}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := prepareEntry(entryPath); err != nil {
+				return err
+			}
+			if err := writeEntryFile(entryPath, mode, tarr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := prepareEntry(entryPath); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, entryPath); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkName, err := e.entryName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if linkName == "" {
+				return errors.Errorf("hardlink target removed by stripComponents: %s", hdr.Linkname)
+			}
+			// resolve the target with symlinks scoped to the destination.
+			linkPath, err := securejoin.SecureJoin(e.destination, linkName)
+			if err != nil {
+				return err
+			}
+			if err := prepareEntry(entryPath); err != nil {
+				return err
+			}
+			if err := os.Link(linkPath, entryPath); err != nil {
+				return err
+			}
+		default:
+			log.
+				WithField("name", hdr.Name).
+				WithField("type", string(hdr.Typeflag)).
+				Debug("Skipping unsupported archive entry")
+			continue
+		}
+
+		if e.chown {
+			if err := os.Lchown(entryPath, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			if err := os.Chtimes(entryPath, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractZip extracts the entries of a zip archive.
+func (e *archiveExtractor) extractZip(rd io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(rd, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		entryPath, err := e.entryPath(zf.Name)
+		if err != nil {
+			return err
+		}
+		if entryPath == "" {
+			continue
+		}
+
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(entryPath, 0755); err != nil {
+				return err
+			}
+			e.dirs[entryPath] = dirAttrs{mode: mode & modeMask, mtime: zf.Modified}
+			continue
+		case mode&os.ModeSymlink != 0:
+			target, err := readZipFile(zf)
+			if err != nil {
+				return err
+			}
+			if err := prepareEntry(entryPath); err != nil {
+				return err
+			}
+			if err := os.Symlink(string(target), entryPath); err != nil {
+				return err
+			}
+			continue
+		case !mode.IsRegular():
+			log.WithField("name", zf.Name).Debug("Skipping unsupported archive entry")
+			continue
+		}
+
+		if err := prepareEntry(entryPath); err != nil {
+			return err
+		}
+		frd, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeEntryFile(entryPath, mode&modeMask, frd)
+		frd.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(entryPath, zf.Modified, zf.Modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readZipFile reads the contents of a small zip entry.
+func readZipFile(zf *zip.File) ([]byte, error) {
+	frd, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer frd.Close()
+	return io.ReadAll(io.LimitReader(frd, 4096))
+}
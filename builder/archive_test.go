@@ -0,0 +1,192 @@
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/ulikunitz/xz"
+)
+
+// testTarEntries are the entries of the test archives under a top-level dir.
+var testTarEntries = []*tar.Header{
+	{Typeflag: tar.TypeDir, Name: "src-1.0/", Mode: 0755},
+	{Typeflag: tar.TypeDir, Name: "src-1.0/bin/", Mode: 0755},
+	{Typeflag: tar.TypeReg, Name: "src-1.0/bin/run", Mode: 0750, Size: 4},
+	{Typeflag: tar.TypeSymlink, Name: "src-1.0/run", Linkname: "bin/run", Mode: 0777},
+	{Typeflag: tar.TypeLink, Name: "src-1.0/run-copy", Linkname: "src-1.0/bin/run", Mode: 0750},
+}
+
+func buildTestTar(t *testing.T, hdrs []*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err.Error())
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(strings.Repeat("x", int(hdr.Size)))); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func compressTestData(t *testing.T, format string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "tar":
+		return data
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func writeTestArchive(t *testing.T, data []byte) string {
+	p := filepath.Join(t.TempDir(), "source.bin")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return p
+}
+
+func checkExtractedTree(t *testing.T, dir string) {
+	st, err := os.Stat(filepath.Join(dir, "bin/run"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if st.Mode().Perm() != 0750 {
+		t.Errorf("expected mode 0750, got %v", st.Mode().Perm())
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "run")); err != nil || target != "bin/run" {
+		t.Errorf("expected symlink to bin/run, got %q %v", target, err)
+	}
+	st2, err := os.Stat(filepath.Join(dir, "run-copy"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !os.SameFile(st, st2) {
+		t.Error("expected hardlink to bin/run")
+	}
+}
+
+func TestExtractArchiveFormats(t *testing.T) {
+	tarData := buildTestTar(t, testTarEntries)
+	for _, format := range []string{"tar", "gzip", "xz", "zstd"} {
+		t.Run(format, func(t *testing.T) {
+			archivePath := writeTestArchive(t, compressTestData(t, format, tarData))
+			dest := t.TempDir()
+			if err := extractArchive(archivePath, dest, 1); err != nil {
+				t.Fatal(err.Error())
+			}
+			checkExtractedTree(t, dest)
+		})
+	}
+}
+
+func TestExtractArchiveZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fh := &zip.FileHeader{Name: "src-1.0/bin/run", Method: zip.Deflate}
+	fh.SetMode(0750)
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Write([]byte("xxxx"))
+	lh := &zip.FileHeader{Name: "src-1.0/run"}
+	lh.SetMode(os.ModeSymlink | 0777)
+	w, err = zw.CreateHeader(lh)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Write([]byte("bin/run"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dest := t.TempDir()
+	if err := extractArchive(writeTestArchive(t, buf.Bytes()), dest, 1); err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "run"))
+	if err != nil || string(data) != "xxxx" {
+		t.Fatalf("unexpected contents %q %v", string(data), err)
+	}
+}
+
+func TestExtractArchiveUnsafePaths(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+
+	// .. is rejected.
+	archivePath := writeTestArchive(t, buildTestTar(t, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0644, Size: 1},
+	}))
+	if err := extractArchive(archivePath, dest, 0); err == nil {
+		t.Fatal("expected .. to be rejected")
+	}
+
+	// writes through symlinks stay in the destination.
+	archivePath = writeTestArchive(t, buildTestTar(t, []*tar.Header{
+		{Typeflag: tar.TypeSymlink, Name: "link", Linkname: outside, Mode: 0777},
+		{Typeflag: tar.TypeReg, Name: "link/escape", Mode: 0644, Size: 1},
+	}))
+	if err := extractArchive(archivePath, dest, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escape")); !os.IsNotExist(err) {
+		t.Fatal("expected write through symlink to stay in the destination")
+	}
+}
+
+func TestFetchSourceArchiveSha256(t *testing.T) {
+	data := compressTestData(t, "gzip", buildTestTar(t, testTarEntries))
+	archivePath := writeTestArchive(t, data)
+	sum := sha256.Sum256(data)
+
+	b := &Builder{config: &config.ConfigImageBuild{
+		Sha256:          strings.Repeat("0", 64),
+		StripComponents: 1,
+	}}
+	if err := b.fetchSourceArchive(t.TempDir(), archivePath); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+
+	b.config.Sha256 = hex.EncodeToString(sum[:])
+	dest := t.TempDir()
+	if err := b.fetchSourceArchive(dest, archivePath); err != nil {
+		t.Fatal(err.Error())
+	}
+	checkExtractedTree(t, dest)
+}
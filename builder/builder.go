@@ -7,7 +7,6 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"strings"
 	"time"
 
@@ -15,27 +14,40 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
-	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/progress"
-	"github.com/docker/docker/pkg/streamformatter"
 	sbbuilder "github.com/paralin/scratchbuild/builder"
 	"github.com/paralin/scratchbuild/stack"
+	log "github.com/sirupsen/logrus"
 	"github.com/skiffos/skiff-core/config"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Builder manages building images.
 type Builder struct {
 	config       *config.ConfigImageBuild
 	outputStream io.Writer
+	progressMode ProgressMode
 	workDir      string
+	rebuild      bool
+	// sourceCacheSize is the max size of the source cache in the work dir.
+	sourceCacheSize int64
+	// libraryCacheOpts configures the library cache for ScratchBuild.
+	libraryCacheOpts LibraryCacheOptions
+
+	// gitCommit is the commit checked out by fetchSourceGit.
+	gitCommit string
+	// releaseSource releases the source fetched by fetchSource, if set.
+	releaseSource func()
 }
 
 // NewBuilder creates a Builder.
 //
 // workDir can be empty to use /tmp (not recommended)
+// Sources are cached in the workDir if set.
 func NewBuilder(config *config.ConfigImageBuild, workDir string) (*Builder, error) {
-	return &Builder{config: config}, nil
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Builder{config: config, workDir: workDir}, nil
 }
 
 // SetOutputStream sets the output stream.
@@ -43,6 +55,41 @@ func (b *Builder) SetOutputStream(s io.Writer) {
 	b.outputStream = s
 }
 
+// SetProgressMode sets how progress is rendered to the output stream.
+//
+// Defaults to ProgressAuto.
+func (b *Builder) SetProgressMode(mode ProgressMode) {
+	b.progressMode = mode
+}
+
+// SetRebuild forces building even if the image is up to date.
+func (b *Builder) SetRebuild(rebuild bool) {
+	b.rebuild = rebuild
+}
+
+// SetSourceCacheSize sets the max size of the source cache in bytes.
+//
+// Zero uses DefaultSourceCacheSize.
+func (b *Builder) SetSourceCacheSize(size int64) {
+	b.sourceCacheSize = size
+}
+
+// SetLibraryCacheOptions configures the library cache used by ScratchBuild.
+//
+// The library is cached in the work dir if set.
+func (b *Builder) SetLibraryCacheOptions(opts LibraryCacheOptions) {
+	b.libraryCacheOpts = opts
+}
+
+// sourceCache returns the source cache, nil if the work dir is not set.
+func (b *Builder) sourceCache() *sourceCache {
+	size := b.sourceCacheSize
+	if size <= 0 {
+		size = DefaultSourceCacheSize
+	}
+	return getSourceCache(b.workDir, size)
+}
+
 // Close the builder to release the resources it was using.
 func (b *Builder) Close() {}
 
@@ -57,6 +104,9 @@ func (b *Builder) Build() error {
 	}()
 
 	dir, err := b.fetchSource(tmpDir)
+	if b.releaseSource != nil {
+		defer b.releaseSource()
+	}
 	if err != nil {
 		return err
 	}
@@ -73,11 +123,14 @@ func (b *Builder) build(buildPath string) error {
 	defer dockerClient.Close()
 
 	if b.config.ScratchBuild {
-		lib, err := globalLibraryCache.GetLibrary()
+		libCache := getLibraryCache(b.workDir)
+		libProgress := b.progress().lineWriter("library")
+		lib, err := libCache.GetLibrary(b.libraryCacheOpts, libProgress)
+		libProgress.Close()
 		if err != nil {
 			return err
 		}
-		defer globalLibraryCache.Release()
+		defer libCache.Release()
 
 		arc := detectArch()
 		stk, err := stack.ImageStackFromPath(buildPath, b.config.Dockerfile, b.config.ImageName(), lib, arc)
@@ -101,7 +154,50 @@ func (b *Builder) build(buildPath string) error {
 		return <-res
 	}
 
-	if err := b.dockerBuild(dockerClient, buildPath, b.config.ImageName()); err != nil {
+	reference := b.config.ImageName()
+	dockerfileSrc, err := b.dockerfileSource(buildPath)
+	if err != nil {
+		return err
+	}
+	digestOpts := b.digestOptions()
+	if b.config.DockerfileInline != "" || b.config.Template {
+		digestOpts = append(digestOpts, "dockerfile="+dockerfileSrc)
+	}
+	digest, err := buildDigest(buildPath, b.relDockerfile(), b.config.BuildArgs, digestOpts...)
+	if err != nil {
+		return err
+	}
+	le := log.WithField("image", reference).WithField("digest", digest)
+	tags, err := b.renderTags(reference)
+	if err != nil {
+		return err
+	}
+	if !b.rebuild {
+		upToDate, err := b.checkUpToDate(dockerClient, reference, digest)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			le.Info("Image is up to date, skipping build")
+			for _, tag := range tags {
+				if err := dockerClient.ImageTag(context.Background(), reference, tag); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	le.Info("Building image")
+	labels := map[string]string{BuildDigestLabel: digest}
+	if b.gitCommit != "" {
+		labels[GitCommitLabel] = b.gitCommit
+	}
+	opts, err := b.buildOptions(append([]string{reference}, tags...), labels)
+	if err != nil {
+		return err
+	}
+
+	if err := b.buildImage(le, dockerClient, buildPath, dockerfileSrc, opts); err != nil {
 		return err
 	}
 
@@ -110,19 +206,53 @@ func (b *Builder) build(buildPath string) error {
 	return nil
 }
 
-// build builds the dockerfile in a directory.
-func (b *Builder) dockerBuild(dockerClient client.APIClient, buildPath string, reference string) error {
-	isTerminal := false
-	var outFd uintptr
-	if b.outputStream == os.Stdout {
-		outFd = os.Stdout.Fd()
-		isTerminal = terminal.IsTerminal(int(outFd))
+// buildImage builds the image with BuildKit if enabled and supported by the
+// daemon, otherwise with the classic builder.
+func (b *Builder) buildImage(
+	le *log.Entry,
+	dockerClient client.APIClient,
+	buildPath string,
+	dockerfileSrc string,
+	opts types.ImageBuildOptions,
+) error {
+	if b.config.BuildKit {
+		err := b.buildKitBuild(dockerClient, buildPath, dockerfileSrc, opts)
+		if err != errBuildKitUnsupported {
+			return err
+		}
+		le.Warn("Daemon does not support BuildKit, falling back to the classic builder")
 	}
+	return b.dockerBuild(dockerClient, buildPath, dockerfileSrc, opts)
+}
 
-	relDockerfile := b.config.Dockerfile
-	if relDockerfile == "" {
-		relDockerfile = "Dockerfile"
+// relDockerfile returns the path to the Dockerfile in the source.
+func (b *Builder) relDockerfile() string {
+	if b.config.Dockerfile == "" {
+		return "Dockerfile"
+	}
+	return b.config.Dockerfile
+}
+
+// checkUpToDate checks if the image was built from the same inputs.
+func (b *Builder) checkUpToDate(dockerClient client.APIClient, reference, digest string) (bool, error) {
+	ins, _, err := dockerClient.ImageInspectWithRaw(context.Background(), reference)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
 	}
+	return ins.Config != nil && ins.Config.Labels[BuildDigestLabel] == digest, nil
+}
+
+// build builds the dockerfile in a directory.
+func (b *Builder) dockerBuild(
+	dockerClient client.APIClient,
+	buildPath string,
+	dockerfileSrc string,
+	opts types.ImageBuildOptions,
+) error {
+	relDockerfile := b.relDockerfile()
 	excludes, err := build.ReadDockerignore(buildPath)
 	if err != nil {
 		return err
@@ -141,34 +271,22 @@ func (b *Builder) dockerBuild(dockerClient client.APIClient, buildPath string, r
 		return err
 	}
 
-	dockerfilePath := path.Join(buildPath, relDockerfile)
-	sourceBin, err := ioutil.ReadFile(dockerfilePath)
-	if err != nil {
-		return err
-	}
-	dockerfileSrc := string(sourceBin)
-
 	buildCtx, relDockerfile, err = build.AddDockerfileToBuildContext(&nopCloser{strings.NewReader(dockerfileSrc)}, buildCtx)
 	if err != nil {
 		return err
 	}
 
-	progressOutput := streamformatter.NewProgressOutput(os.Stdout)
-	var body io.Reader = progress.NewProgressReader(buildCtx, progressOutput, 0, "", "Sending build context to Docker daemon")
-	response, err := dockerClient.ImageBuild(context.Background(), body, types.ImageBuildOptions{
-		PullParent:  false,
-		ForceRemove: !b.config.PreserveIntermediate,
-		Dockerfile:  relDockerfile,
-		Tags:        []string{reference},
-		Squash:      b.config.Squash,
-		BuildArgs:   b.config.BuildArgs,
-	})
+	prog := b.progress()
+	var body io.Reader = progress.NewProgressReader(buildCtx, prog.progressOutput(), 0, "", "Sending build context to Docker daemon")
+	opts.Dockerfile = relDockerfile
+	opts.Squash = b.config.Squash
+	response, err := dockerClient.ImageBuild(context.Background(), body, opts)
 	if err != nil {
 		return err
 	}
 	defer response.Body.Close()
 
-	return jsonmessage.DisplayJSONMessagesStream(response.Body, b.outputStream, outFd, isTerminal, nil)
+	return prog.displayJSONMessages(response.Body, nil)
 }
 
 // fetchSource downloads the source to a destination path.
@@ -178,20 +296,47 @@ func (b *Builder) fetchSource(destination string) (outDir string, err error) {
 	source := b.config.Source
 
 	if source == "" {
+		// the inline Dockerfile is built with an empty context.
+		if b.config.DockerfileInline != "" {
+			return destination, nil
+		}
 		return "", errors.New("No source specified")
 	}
 
 	// determine which kind of URL it is.
-	if strings.HasPrefix(source, "git://") ||
-		(strings.HasSuffix(source, ".git") && strings.HasPrefix(source, "http")) {
-		return destination, b.fetchSourceGit(destination, source)
+	if gitURL, ok := parseGitSource(source); ok {
+		return destination, b.fetchSourceGit(destination, gitURL)
+	}
+	if b.config.Git != nil {
+		return "", fmt.Errorf("git is set but the source is not a git repository: %s", source)
 	}
 
-	if strings.HasSuffix(source, ".tar.gz") {
-		return destination, b.fetchSourceTarball(destination, source)
+	// local files are detected as archives by their contents.
+	isLocalFile := false
+	if strings.HasPrefix(source, "/") {
+		if st, ferr := os.Stat(source); ferr == nil && st.Mode().IsRegular() {
+			isLocalFile = true
+		}
+	}
+	if isLocalFile || isArchiveSource(source) || isURLSource(source) {
+		return destination, b.fetchSourceArchive(destination, source)
+	}
+	if b.config.Sha256 != "" || b.config.StripComponents != 0 {
+		return "", fmt.Errorf("sha256 and stripComponents require an archive source: %s", source)
 	}
 
 	if strings.HasPrefix(source, "/") {
+		// local dirs are copied to the source cache, if enabled.
+		if cache := b.sourceCache(); cache != nil {
+			copyPath, release, err := cache.localCopy(source, func(copyPath string) error {
+				return b.fetchSourceRsync(copyPath, source)
+			})
+			if err != nil {
+				return "", err
+			}
+			b.releaseSource = release
+			return copyPath, nil
+		}
 		if _, ferr := os.Stat(source); ferr == nil {
 			return source, nil
 		}
@@ -0,0 +1,199 @@
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/console"
+	"github.com/docker/cli/cli/command/image/build"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
+)
+
+// errBuildKitUnsupported is returned if the daemon cannot build with BuildKit.
+var errBuildKitUnsupported = errors.New("daemon does not support BuildKit")
+
+// buildKitMinAPIVersion is the first API version with BuildKit sessions.
+const buildKitMinAPIVersion = "1.39"
+
+// buildKitTraceID is the ID of the messages containing BuildKit progress.
+const buildKitTraceID = "moby.buildkit.trace"
+
+// displaySolveStatus renders the BuildKit status updates.
+var displaySolveStatus = progressui.DisplaySolveStatus
+
+// checkBuildKitSupport checks if the daemon can build with BuildKit.
+func checkBuildKitSupport(ctx context.Context, dockerClient client.APIClient) error {
+	ping, err := dockerClient.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if ping.OSType == "windows" || versions.LessThan(ping.APIVersion, buildKitMinAPIVersion) {
+		return errBuildKitUnsupported
+	}
+	return nil
+}
+
+// resetUIDAndGID sends the context files as owned by root, like the classic builder.
+func resetUIDAndGID(_ string, s *fstypes.Stat) fsutil.MapResult {
+	s.Uid = 0
+	s.Gid = 0
+	return fsutil.MapResultKeep
+}
+
+// buildKitSecretSources converts the secrets config for the session.
+func (b *Builder) buildKitSecretSources() []secretsprovider.Source {
+	sources := make([]secretsprovider.Source, 0, len(b.config.Secrets))
+	for _, secret := range b.config.Secrets {
+		sources = append(sources, secretsprovider.Source{
+			ID:       secret.ID,
+			FilePath: secret.Src,
+			Env:      secret.Env,
+		})
+	}
+	return sources
+}
+
+// buildKitBuild builds the dockerfile in a directory with BuildKit.
+//
+// The context, Dockerfile and secrets are sent with a BuildKit session.
+// Returns errBuildKitUnsupported if the daemon cannot build with BuildKit.
+func (b *Builder) buildKitBuild(
+	dockerClient client.APIClient,
+	buildPath string,
+	dockerfileSrc string,
+	opts types.ImageBuildOptions,
+) error {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	if err := checkBuildKitSupport(ctx, dockerClient); err != nil {
+		return err
+	}
+
+	relDockerfile := b.relDockerfile()
+	excludes, err := build.ReadDockerignore(buildPath)
+	if err != nil {
+		return err
+	}
+	excludes = build.TrimBuildFilesFromExcludes(excludes, relDockerfile, false)
+
+	// the Dockerfile is sent from a separate dir as it may be inline or rendered.
+	dockerfileDir, err := ioutil.TempDir(b.workDir, "skiff-core-dockerfile-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dockerfileDir)
+	if err := ioutil.WriteFile(path.Join(dockerfileDir, "Dockerfile"), []byte(dockerfileSrc), 0644); err != nil {
+		return err
+	}
+
+	sess, err := session.NewSession(ctx, "skiff-core", buildPath)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	sess.Allow(filesync.NewFSSyncProvider(filesync.StaticDirSource{
+		"context":    {Dir: buildPath, Excludes: excludes, Map: resetUIDAndGID},
+		"dockerfile": {Dir: dockerfileDir},
+	}))
+	if len(b.config.Secrets) != 0 {
+		store, err := secretsprovider.NewStore(b.buildKitSecretSources())
+		if err != nil {
+			return err
+		}
+		sess.Allow(secretsprovider.NewSecretProvider(store))
+	}
+
+	go func() {
+		_ = sess.Run(ctx, func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+			return dockerClient.DialHijack(ctx, "/session", proto, meta)
+		})
+	}()
+
+	opts.Version = types.BuilderBuildKit
+	opts.SessionID = sess.ID()
+	opts.RemoteContext = "client-session"
+	opts.Dockerfile = "Dockerfile"
+	response, err := dockerClient.ImageBuild(ctx, nil, opts)
+	if err != nil {
+		if strings.Contains(err.Error(), "buildkit not supported") {
+			return errBuildKitUnsupported
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	return b.displayBuildKitProgress(response.Body)
+}
+
+// displayBuildKitProgress renders the BuildKit progress to the output stream.
+//
+// Renders the interactive display in ProgressTTY mode and plain text in
+// ProgressPlain mode. In ProgressJSON mode the trace messages are written as-is.
+func (b *Builder) displayBuildKitProgress(body io.Reader) error {
+	prog := b.progress()
+	if prog.mode == ProgressJSON {
+		return prog.displayJSONMessages(body, nil)
+	}
+
+	var cons console.Console
+	if f, ok := prog.out.(*os.File); ok && prog.mode == ProgressTTY {
+		if c, err := console.ConsoleFromFile(f); err == nil {
+			cons = c
+		}
+	}
+
+	// the display may return early, for example if writing fails: the
+	// remaining status updates are then dropped instead of blocking.
+	statusCh := make(chan *bkclient.SolveStatus)
+	displayDone := make(chan struct{})
+	var displayErr error
+	go func() {
+		_, displayErr = displaySolveStatus(context.Background(), cons, prog.out, statusCh)
+		close(displayDone)
+	}()
+
+	auxCallback := func(msg jsonmessage.JSONMessage) {
+		if msg.ID != buildKitTraceID || msg.Aux == nil {
+			return
+		}
+		var data []byte
+		if err := json.Unmarshal(*msg.Aux, &data); err != nil {
+			return
+		}
+		var resp controlapi.StatusResponse
+		if err := resp.Unmarshal(data); err != nil {
+			return
+		}
+		select {
+		case statusCh <- bkclient.NewSolveStatus(&resp):
+		case <-displayDone:
+		}
+	}
+	err := jsonmessage.DisplayJSONMessagesStream(body, io.Discard, 0, false, auxCallback)
+	close(statusCh)
+	<-displayDone
+	if err == nil {
+		err = displayErr
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/console"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/progress/progressui"
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// fakeBuildClient implements the parts of the Docker API used to build images.
+//
+// Calling any other method panics via the nil embedded interface.
+type fakeBuildClient struct {
+	client.APIClient
+
+	mtx  sync.Mutex
+	ping types.Ping
+	// buildErrs are returned by the calls to ImageBuild in order.
+	buildErrs []error
+	// buildBody is the response body of ImageBuild.
+	buildBody string
+	// builds records the options passed to ImageBuild.
+	builds []types.ImageBuildOptions
+}
+
+func (f *fakeBuildClient) Ping(ctx context.Context) (types.Ping, error) {
+	return f.ping, nil
+}
+
+func (f *fakeBuildClient) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.builds = append(f.builds, options)
+	if len(f.buildErrs) != 0 {
+		err := f.buildErrs[0]
+		f.buildErrs = f.buildErrs[1:]
+		if err != nil {
+			return types.ImageBuildResponse{}, err
+		}
+	}
+	if buildContext != nil {
+		_, _ = io.Copy(io.Discard, buildContext)
+	}
+	return types.ImageBuildResponse{Body: io.NopCloser(strings.NewReader(f.buildBody))}, nil
+}
+
+func (f *fakeBuildClient) DialHijack(ctx context.Context, url, proto string, meta map[string][]string) (net.Conn, error) {
+	return nil, errors.New("sessions are not supported by the fake client")
+}
+
+// buildKitTraceMessages encodes BuildKit status updates as trace messages.
+func buildKitTraceMessages(t *testing.T, names ...string) string {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	now := time.Now()
+	for _, name := range names {
+		resp := &controlapi.StatusResponse{Vertexes: []*controlapi.Vertex{{
+			Digest:    digest.FromString(name),
+			Name:      name,
+			Started:   &now,
+			Completed: &now,
+		}}}
+		data, err := resp.Marshal()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		aux, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		rawAux := json.RawMessage(aux)
+		if err := enc.Encode(&jsonmessage.JSONMessage{ID: buildKitTraceID, Aux: &rawAux}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return out.String()
+}
+
+func TestBuildKitBuild(t *testing.T) {
+	var out bytes.Buffer
+	b := &Builder{
+		config:       &config.ConfigImageBuild{BuildKit: true},
+		workDir:      t.TempDir(),
+		outputStream: &out,
+	}
+	dc := &fakeBuildClient{
+		ping:      types.Ping{APIVersion: "1.41", OSType: "linux"},
+		buildBody: buildKitTraceMessages(t, "[1/2] FROM docker.io/library/alpine", "[2/2] RUN make"),
+	}
+
+	err := b.buildKitBuild(dc, t.TempDir(), "FROM alpine\nRUN make\n", types.ImageBuildOptions{Tags: []string{"skiff/core:latest"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(dc.builds) != 1 {
+		t.Fatalf("expected a single build, got %d", len(dc.builds))
+	}
+	opts := dc.builds[0]
+	if opts.Version != types.BuilderBuildKit || opts.SessionID == "" ||
+		opts.RemoteContext != "client-session" || opts.Dockerfile != "Dockerfile" {
+		t.Fatalf("unexpected build options: %+v", opts)
+	}
+	if !strings.Contains(out.String(), "RUN make") {
+		t.Fatalf("expected progress in the output, got %q", out.String())
+	}
+}
+
+func TestBuildKitBuildDisplayReturnsEarly(t *testing.T) {
+	displayErr := errors.New("display failed")
+	prevDisplay := displaySolveStatus
+	displaySolveStatus = func(ctx context.Context, c console.Console, w io.Writer, ch chan *bkclient.SolveStatus, opts ...progressui.DisplaySolveStatusOpt) ([]bkclient.VertexWarning, error) {
+		return nil, displayErr
+	}
+	defer func() { displaySolveStatus = prevDisplay }()
+
+	b := &Builder{config: &config.ConfigImageBuild{BuildKit: true}, workDir: t.TempDir()}
+	dc := &fakeBuildClient{
+		ping:      types.Ping{APIVersion: "1.41", OSType: "linux"},
+		buildBody: buildKitTraceMessages(t, "step 1", "step 2", "step 3"),
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.buildKitBuild(dc, t.TempDir(), "FROM alpine\n", types.ImageBuildOptions{})
+	}()
+	select {
+	case err := <-errCh:
+		if err != displayErr {
+			t.Fatalf("expected the display error, got %v", err)
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("build blocked after the display returned")
+	}
+}
+
+func TestBuildImageFallsBackToClassicBuilder(t *testing.T) {
+	cases := []struct {
+		name      string
+		ping      types.Ping
+		buildErrs []error
+	}{
+		{"windows daemon", types.Ping{APIVersion: "1.41", OSType: "windows"}, nil},
+		{"old daemon", types.Ping{APIVersion: "1.38", OSType: "linux"}, nil},
+		{"buildkit disabled", types.Ping{APIVersion: "1.41", OSType: "linux"}, []error{
+			errors.New("Error response from daemon: buildkit not supported by daemon"),
+		}},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		b := &Builder{
+			config:       &config.ConfigImageBuild{BuildKit: true},
+			workDir:      t.TempDir(),
+			outputStream: &out,
+		}
+		dc := &fakeBuildClient{
+			ping:      c.ping,
+			buildErrs: c.buildErrs,
+			buildBody: `{"stream":"Step 1/1 : FROM alpine\n"}` + "\n",
+		}
+		err := b.buildImage(log.WithField("test", c.name), dc, t.TempDir(), "FROM alpine\n", types.ImageBuildOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		last := dc.builds[len(dc.builds)-1]
+		if last.Version == types.BuilderBuildKit {
+			t.Fatalf("%s: expected the classic builder, got %+v", c.name, last)
+		}
+		if !strings.Contains(out.String(), "Step 1/1 : FROM alpine") {
+			t.Fatalf("%s: unexpected output: %q", c.name, out.String())
+		}
+	}
+}
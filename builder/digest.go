@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/docker/cli/cli/command/image/build"
+	"github.com/moby/patternmatcher"
+)
+
+// BuildDigestLabel is the image label containing the digest of the build inputs.
+const BuildDigestLabel = "org.skiffos.skiff-core.build-digest"
+
+// writeDigestField writes a length-prefixed field to the digest.
+func writeDigestField(h hash.Hash, field string) {
+	fmt.Fprintf(h, "%d:%s\n", len(field), field)
+}
+
+// buildDigest computes the digest of the build inputs.
+//
+// Covers the files in the build context after .dockerignore, including the
+// Dockerfile, the path to the Dockerfile, the build args and any options which
+// change the resulting image.
+func buildDigest(buildPath, relDockerfile string, buildArgs map[string]*string, options ...string) (string, error) {
+	excludes, err := build.ReadDockerignore(buildPath)
+	if err != nil {
+		return "", err
+	}
+	excludes = build.TrimBuildFilesFromExcludes(excludes, relDockerfile, false)
+	pm, err := patternmatcher.New(excludes)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	writeDigestField(h, "dockerfile")
+	writeDigestField(h, filepath.Clean(relDockerfile))
+
+	argKeys := make([]string, 0, len(buildArgs))
+	for key := range buildArgs {
+		argKeys = append(argKeys, key)
+	}
+	sort.Strings(argKeys)
+	for _, key := range argKeys {
+		writeDigestField(h, "arg")
+		writeDigestField(h, key)
+		if val := buildArgs[key]; val != nil {
+			writeDigestField(h, "="+*val)
+		} else {
+			writeDigestField(h, "")
+		}
+	}
+
+	for _, opt := range options {
+		writeDigestField(h, "option")
+		writeDigestField(h, opt)
+	}
+
+	// filepath.Walk visits files in lexical order.
+	err = filepath.Walk(buildPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(buildPath, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		excluded, err := pm.MatchesOrParentMatches(relPath)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			if info.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		writeDigestField(h, "file")
+		writeDigestField(h, relPath)
+		writeDigestField(h, info.Mode().String())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			writeDigestField(h, target)
+		case info.Mode().IsRegular():
+			fmt.Fprintf(h, "%d:", info.Size())
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,63 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, data string) {
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "Dockerfile", "FROM alpine\nCOPY . /src\n")
+	writeTestFile(t, dir, "src/main.go", "package main\n")
+	writeTestFile(t, dir, ".dockerignore", "build\n")
+
+	val := "1"
+	args := map[string]*string{"VERSION": &val}
+	digest := func() string {
+		d, err := buildDigest(dir, "Dockerfile", args)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return d
+	}
+
+	base := digest()
+	if base != digest() {
+		t.Fatal("expected digest to be stable")
+	}
+
+	// ignored files do not change the digest.
+	writeTestFile(t, dir, "build/output.bin", "binary")
+	if d := digest(); d != base {
+		t.Fatal("expected ignored file to not change the digest")
+	}
+
+	// context files change the digest.
+	writeTestFile(t, dir, "src/main.go", "package main\n\nfunc main() {}\n")
+	next := digest()
+	if next == base {
+		t.Fatal("expected changed file to change the digest")
+	}
+
+	// build args change the digest.
+	val2 := "2"
+	args["VERSION"] = &val2
+	if d := digest(); d == next {
+		t.Fatal("expected changed build arg to change the digest")
+	}
+	args["VERSION"] = nil
+	if d := digest(); d == next {
+		t.Fatal("expected unset build arg to change the digest")
+	}
+}
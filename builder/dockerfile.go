@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"runtime"
+	"text/template"
+
+	"github.com/paralin/scratchbuild/arch"
+	"github.com/pkg/errors"
+)
+
+// dockerfileArch describes a KnownArch with Docker names.
+type dockerfileArch struct {
+	// platform is the Docker platform architecture.
+	platform string
+	// variant is the Docker platform variant.
+	variant string
+	// prefix is the namespace of the official images for the arch.
+	prefix string
+}
+
+// dockerfileArches maps known arches to Docker names.
+var dockerfileArches = map[arch.KnownArch]dockerfileArch{
+	arch.AMD64: {platform: "amd64", prefix: "amd64"},
+	arch.ARMV6: {platform: "arm", variant: "v6", prefix: "arm32v6"},
+	arch.ARMV7: {platform: "arm", variant: "v7", prefix: "arm32v7"},
+	arch.ARMV8: {platform: "arm64", variant: "v8", prefix: "arm64v8"},
+}
+
+// dockerfileTemplateData is the data available to Dockerfile templates.
+type dockerfileTemplateData struct {
+	// Image is the name of the image being built.
+	Image string
+	// Arch is the Docker architecture of the host, e.g. amd64 or arm64.
+	Arch string
+	// ArchVariant is the Docker architecture variant of the host, e.g. v7.
+	ArchVariant string
+	// ArchPrefix is the namespace of the official images for the host arch, e.g. arm64v8.
+	ArchPrefix string
+	// MachineID is the machine hardware name of the host (uname -m).
+	MachineID string
+	// OS is the operating system of the host.
+	OS string
+	// Hostname is the hostname of the host.
+	Hostname string
+	// NumCPU is the number of CPUs on the host.
+	NumCPU int
+	// BuildArgs are the build args, arguments without a value are empty.
+	BuildArgs map[string]string
+}
+
+// newDockerfileTemplateData detects the template data for the host.
+func (b *Builder) newDockerfileTemplateData() *dockerfileTemplateData {
+	da := dockerfileArches[detectArch()]
+	data := &dockerfileTemplateData{
+		Image:       b.config.ImageName(),
+		Arch:        da.platform,
+		ArchVariant: da.variant,
+		ArchPrefix:  da.prefix,
+		MachineID:   detectMachineId(),
+		OS:          runtime.GOOS,
+		NumCPU:      runtime.NumCPU(),
+		BuildArgs:   make(map[string]string, len(b.config.BuildArgs)),
+	}
+	data.Hostname, _ = os.Hostname()
+	for key, val := range b.config.BuildArgs {
+		if val != nil {
+			data.BuildArgs[key] = *val
+		} else {
+			data.BuildArgs[key] = ""
+		}
+	}
+	return data
+}
+
+// dockerfileSource returns the contents of the Dockerfile to build.
+//
+// Reads the inline Dockerfile or the Dockerfile in the build path, and
+// renders it if the template mode is enabled.
+func (b *Builder) dockerfileSource(buildPath string) (string, error) {
+	src := b.config.DockerfileInline
+	if src == "" {
+		data, err := os.ReadFile(path.Join(buildPath, b.relDockerfile()))
+		if err != nil {
+			return "", err
+		}
+		src = string(data)
+	}
+	if !b.config.Template {
+		return src, nil
+	}
+
+	tmpl, err := template.New("Dockerfile").Option("missingkey=zero").Parse(src)
+	if err != nil {
+		return "", errors.Wrap(err, "parse Dockerfile template")
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, b.newDockerfileTemplateData()); err != nil {
+		return "", errors.Wrap(err, "render Dockerfile template")
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestDockerfileSource(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "Dockerfile", "FROM {{.ArchPrefix}}/alpine\n")
+
+	// without template mode the Dockerfile is used as-is.
+	b := &Builder{config: &config.ConfigImageBuild{}}
+	src, err := b.dockerfileSource(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if src != "FROM {{.ArchPrefix}}/alpine\n" {
+		t.Fatalf("unexpected Dockerfile: %q", src)
+	}
+
+	val := "3.19"
+	b.config = &config.ConfigImageBuild{
+		DockerfileInline: "FROM alpine:{{.BuildArgs.VERSION}}\nRUN echo {{.OS}} {{.BuildArgs.UNSET}}\n",
+		Template:         true,
+		BuildArgs:        map[string]*string{"VERSION": &val},
+	}
+	src, err = b.dockerfileSource(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "FROM alpine:3.19\nRUN echo " + runtime.GOOS + " \n"
+	if src != expected {
+		t.Fatalf("expected %q but got %q", expected, src)
+	}
+
+	b.config.DockerfileInline = "FROM {{.Unknown}}\n"
+	if _, err := b.dockerfileSource(dir); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+}
@@ -1,46 +1,116 @@
 package builder
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/go-git/go-git/v5"
 	"github.com/paralin/scratchbuild/library"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	rsync "github.com/skiffos/skiff-core/grsync"
 )
 
+// DefaultLibraryCacheTTL is the default time after which the library is refreshed.
+const DefaultLibraryCacheTTL = 24 * time.Hour
+
+// libraryCacheDir is the directory in the work dir containing the library cache.
+const libraryCacheDir = "library-cache"
+
+// libraryRepoDir is the directory in the library cache with the official-images repository.
+const libraryRepoDir = "official-images"
+
+// libraryRefreshedStamp is the file in the library cache with the time of the last refresh.
+const libraryRefreshedStamp = ".refreshed"
+
+// LibraryCacheOptions configures the library cache used by ScratchBuild.
+type LibraryCacheOptions struct {
+	// TTL is the time after which the library is refreshed.
+	// Zero uses DefaultLibraryCacheTTL.
+	TTL time.Duration
+	// Seed is a tarball or directory with the official-images repository.
+	// Used if the cache is empty.
+	Seed string
+	// Offline uses the cached library without refreshing it.
+	Offline bool
+}
+
 // libraryCache makes sure we clone the library just once.
+//
+// The library is stored in the work dir and refreshed when it is older than
+// the TTL. Without a work dir, it is cloned to a temporary dir which is
+// removed when the refCount drops to zero.
 type libraryCache struct {
 	mtx      sync.Mutex
 	refCount int
-	path     string
-	lib      *library.LibraryResolver
+	// path is the directory of the cache.
+	path string
+	// temporary indicates path is removed when the refCount drops.
+	temporary bool
+	lib       *library.LibraryResolver
 }
 
-var globalLibraryCache = &libraryCache{}
+// libraryCachesMtx guards libraryCaches.
+var libraryCachesMtx sync.Mutex
+
+// libraryCaches contains the library cache for each work dir.
+var libraryCaches = make(map[string]*libraryCache)
+
+// getLibraryCache returns the library cache for the work dir.
+//
+// workDir can be empty to use a temporary dir.
+func getLibraryCache(workDir string) *libraryCache {
+	libraryCachesMtx.Lock()
+	defer libraryCachesMtx.Unlock()
+	lc := libraryCaches[workDir]
+	if lc == nil {
+		lc = &libraryCache{temporary: workDir == ""}
+		if workDir != "" {
+			lc.path = filepath.Join(workDir, libraryCacheDir)
+		}
+		libraryCaches[workDir] = lc
+	}
+	return lc
+}
 
 // GetLibrary gets the library instance.
-func (lr *libraryCache) GetLibrary() (*library.LibraryResolver, error) {
+//
+// Progress of cloning the library is written to progress.
+func (lr *libraryCache) GetLibrary(opts LibraryCacheOptions, progress io.Writer) (*library.LibraryResolver, error) {
 	lr.mtx.Lock()
 	defer lr.mtx.Unlock()
 
-	if lr.refCount == 0 {
+	if lr.refCount != 0 {
+		lr.refCount++
+		return lr.lib, nil
+	}
+
+	if lr.temporary {
 		p, err := ioutil.TempDir("", "skiff-core-scratch-")
 		if err != nil {
 			return nil, err
 		}
 		lr.path = p
-	} else {
-		lr.refCount++
-		return lr.lib, nil
+	} else if err := os.MkdirAll(lr.path, 0755); err != nil {
+		return nil, err
 	}
 
-	lib, err := library.BuildLibraryResolver(lr.path)
+	repoDir, err := lr.prepare(opts, progress)
 	if err != nil {
+		if lr.temporary {
+			os.RemoveAll(lr.path)
+			lr.path = ""
+		}
 		return nil, err
 	}
-	lr.lib = lib
+
+	lr.lib = library.NewLibraryResolver(filepath.Join(repoDir, "library"), lr.path)
 	lr.refCount++
-	return lib, nil
+	return lr.lib, nil
 }
 
 // Release decrements the refCount
@@ -54,7 +124,158 @@ func (lr *libraryCache) Release() {
 
 	lr.refCount--
 	if lr.refCount == 0 {
-		os.RemoveAll(lr.path)
-		lr.path = ""
+		lr.lib = nil
+		if lr.temporary {
+			os.RemoveAll(lr.path)
+			lr.path = ""
+		}
+	}
+}
+
+// prepare makes sure the cache contains the library, seeding or refreshing it.
+//
+// Returns the path to the official-images repository.
+func (lr *libraryCache) prepare(opts LibraryCacheOptions, progress io.Writer) (string, error) {
+	repoDir := filepath.Join(lr.path, libraryRepoDir)
+	le := log.WithField("path", repoDir)
+
+	exists := isLibraryRoot(repoDir)
+	if !exists && opts.Seed != "" {
+		le.WithField("seed", opts.Seed).Debug("Seeding library cache")
+		if err := lr.seed(repoDir, opts.Seed); err != nil {
+			return "", errors.Wrap(err, "seed library cache")
+		}
+		lr.touchRefreshed()
+		exists = true
+	}
+
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = DefaultLibraryCacheTTL
+	}
+	if exists && (opts.Offline || !lr.expired(ttl)) {
+		return repoDir, nil
+	}
+	if !exists && opts.Offline {
+		return "", errors.New("library cache is empty in offline mode, seed it with a tarball or directory")
+	}
+
+	le.WithField("url", library.LibraryRepo).Debug("Refreshing library cache")
+	if err := lr.refresh(repoDir, progress); err != nil {
+		if exists {
+			le.WithError(err).Warn("Unable to refresh library, using the cached copy")
+			return repoDir, nil
+		}
+		return "", err
+	}
+	lr.touchRefreshed()
+	return repoDir, nil
+}
+
+// expired checks if the library was refreshed longer than ttl ago.
+func (lr *libraryCache) expired(ttl time.Duration) bool {
+	st, err := os.Stat(filepath.Join(lr.path, libraryRefreshedStamp))
+	if err != nil {
+		return true
+	}
+	return time.Since(st.ModTime()) > ttl
+}
+
+// touchRefreshed records the time of the last refresh.
+func (lr *libraryCache) touchRefreshed() {
+	stampPath := filepath.Join(lr.path, libraryRefreshedStamp)
+	if err := ioutil.WriteFile(stampPath, nil, 0644); err != nil {
+		log.WithError(err).Warn("Unable to write library cache stamp")
+		return
+	}
+	now := time.Now()
+	_ = os.Chtimes(stampPath, now, now)
+}
+
+// refresh clones the latest library and replaces the cached copy.
+//
+// The cached copy is kept if the clone fails.
+func (lr *libraryCache) refresh(repoDir string, progress io.Writer) error {
+	tmpDir, err := ioutil.TempDir(lr.path, ".official-images-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = git.PlainClone(tmpDir, false, &git.CloneOptions{
+		Depth:    1,
+		Progress: progress,
+		URL:      library.LibraryRepo,
+	})
+	if err != nil {
+		return err
+	}
+	return replaceDir(tmpDir, repoDir)
+}
+
+// seed fills the cache from a tarball or directory.
+//
+// The seed contains the official-images repository, optionally in a
+// single top-level directory like the archives of a git forge.
+func (lr *libraryCache) seed(repoDir, seed string) error {
+	st, err := os.Stat(seed)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(lr.path, ".official-images-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if st.IsDir() {
+		task := rsync.NewTask(filepath.Clean(seed)+"/", tmpDir+"/", rsync.RsyncOptions{
+			Archive:   true,
+			Recursive: true,
+			Links:     true,
+		})
+		err = task.Run()
+	} else {
+		err = extractArchive(seed, tmpDir, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	root := tmpDir
+	if !isLibraryRoot(root) {
+		infos, err := ioutil.ReadDir(tmpDir)
+		if err != nil {
+			return err
+		}
+		if len(infos) != 1 || !isLibraryRoot(filepath.Join(tmpDir, infos[0].Name())) {
+			return errors.Errorf("seed does not contain the library directory: %s", seed)
+		}
+		root = filepath.Join(tmpDir, infos[0].Name())
+	}
+	return replaceDir(root, repoDir)
+}
+
+// isLibraryRoot checks if a directory contains the library of the official-images repository.
+func isLibraryRoot(dir string) bool {
+	st, err := os.Stat(filepath.Join(dir, "library"))
+	return err == nil && st.IsDir()
+}
+
+// replaceDir replaces dest with src, removing the old dest.
+func replaceDir(src, dest string) error {
+	oldDir := dest + ".old"
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(dest, oldDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(src, dest); err != nil {
+		// restore the previous copy.
+		_ = os.Rename(oldDir, dest)
+		return err
 	}
+	return os.RemoveAll(oldDir)
 }
@@ -0,0 +1,62 @@
+package builder
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLibraryCacheSeed(t *testing.T) {
+	// seeding from a directory.
+	seedDir := t.TempDir()
+	writeTestFile(t, seedDir, "library/alpine", "Tags: latest\n")
+	workDir := t.TempDir()
+	lc := getLibraryCache(workDir)
+	if _, err := lc.GetLibrary(LibraryCacheOptions{Seed: seedDir, Offline: true}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	lc.Release()
+	repoDir := filepath.Join(workDir, libraryCacheDir, libraryRepoDir)
+	if _, err := os.Stat(filepath.Join(repoDir, "library/alpine")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the cached copy is used without the seed.
+	if _, err := lc.GetLibrary(LibraryCacheOptions{Offline: true}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	lc.Release()
+	if _, err := os.Stat(repoDir); err != nil {
+		t.Fatalf("expected the library to be kept: %v", err)
+	}
+
+	// seeding from a tarball with a top-level directory.
+	seedTar := writeTestArchive(t, compressTestData(t, "gzip", buildTestTar(t, []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "official-images-master/", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "official-images-master/library/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "official-images-master/library/debian", Mode: 0644, Size: 4},
+	})))
+	workDir = t.TempDir()
+	lc = getLibraryCache(workDir)
+	if _, err := lc.GetLibrary(LibraryCacheOptions{Seed: seedTar, Offline: true}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	lc.Release()
+	repoDir = filepath.Join(workDir, libraryCacheDir, libraryRepoDir)
+	if _, err := os.Stat(filepath.Join(repoDir, "library/debian")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a seed without the library is rejected.
+	lc = getLibraryCache(t.TempDir())
+	if _, err := lc.GetLibrary(LibraryCacheOptions{Seed: t.TempDir(), Offline: true}, nil); err == nil {
+		t.Fatal("expected error for seed without library")
+	}
+
+	// an empty cache cannot be used offline.
+	lc = getLibraryCache(t.TempDir())
+	if _, err := lc.GetLibrary(LibraryCacheOptions{Offline: true}, nil); err == nil {
+		t.Fatal("expected error for empty cache in offline mode")
+	}
+}
@@ -8,3 +8,10 @@ type nopCloser struct {
 }
 
 func (nopCloser) Close() error { return nil }
+
+// nopWriteCloser wraps writers without a Close()
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// tagData is the data for the tag templates.
+type tagData struct {
+	// Image is the name of the image.
+	Image string
+	// Repository is the name of the image without the tag.
+	Repository string
+	// Commit is the git commit of the source, if any.
+	Commit string
+	// ShortCommit is the first 12 characters of Commit.
+	ShortCommit string
+}
+
+// renderTags renders the additional tags of the image.
+func (b *Builder) renderTags(image string) ([]string, error) {
+	tmpls, err := b.config.ParseTags()
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpls) == 0 {
+		return nil, nil
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, err
+	}
+	data := &tagData{
+		Image:       image,
+		Repository:  reference.FamiliarName(named),
+		Commit:      b.gitCommit,
+		ShortCommit: b.gitCommit,
+	}
+	if len(data.ShortCommit) > 12 {
+		data.ShortCommit = data.ShortCommit[:12]
+	}
+
+	tags := make([]string, 0, len(tmpls))
+	for i, tmpl := range tmpls {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("tags[%d]: %v", i, err)
+		}
+		tag := strings.TrimSpace(buf.String())
+		if strings.HasPrefix(tag, ":") {
+			tag = data.Repository + tag
+		}
+		if _, err := reference.ParseNormalizedNamed(tag); err != nil {
+			return nil, fmt.Errorf("tags[%d]: invalid tag %q: %v", i, tag, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// digestOptions returns the options which change the built image.
+//
+// Included in the build digest so changing them rebuilds the image.
+func (b *Builder) digestOptions() []string {
+	opts := []string{
+		"target=" + b.config.Target,
+		"platform=" + b.config.Platform,
+	}
+	labels := make([]string, 0, len(b.config.Labels))
+	for key, val := range b.config.Labels {
+		labels = append(labels, "label="+key+"="+val)
+	}
+	sort.Strings(labels)
+	return append(opts, labels...)
+}
+
+// buildOptions builds the options common to the classic builder and BuildKit.
+func (b *Builder) buildOptions(tags []string, labels map[string]string) (types.ImageBuildOptions, error) {
+	shmSize, err := b.config.ShmSizeBytes()
+	if err != nil {
+		return types.ImageBuildOptions{}, err
+	}
+
+	allLabels := make(map[string]string, len(b.config.Labels)+len(labels))
+	for key, val := range b.config.Labels {
+		allLabels[key] = val
+	}
+	for key, val := range labels {
+		allLabels[key] = val
+	}
+
+	return types.ImageBuildOptions{
+		PullParent:  b.config.PullParent,
+		NoCache:     b.config.NoCache,
+		ForceRemove: !b.config.PreserveIntermediate,
+		Tags:        tags,
+		BuildArgs:   b.config.BuildArgs,
+		Labels:      allLabels,
+		Target:      b.config.Target,
+		Platform:    b.config.Platform,
+		NetworkMode: b.config.NetworkMode,
+		ExtraHosts:  b.config.ExtraHosts,
+		CacheFrom:   b.config.CacheFrom,
+		ShmSize:     shmSize,
+	}, nil
+}
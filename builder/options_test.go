@@ -0,0 +1,46 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestRenderTags(t *testing.T) {
+	b := &Builder{
+		config: &config.ConfigImageBuild{
+			Tags: []string{
+				":{{.ShortCommit}}",
+				"registry.example.com/{{.Repository}}:latest",
+				"{{.Image}}-dev",
+			},
+		},
+		gitCommit: "0123456789abcdef0123456789abcdef01234567",
+	}
+	tags, err := b.renderTags("skiff/core:v1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{
+		"skiff/core:0123456789ab",
+		"registry.example.com/skiff/core:latest",
+		"skiff/core:v1-dev",
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("expected %v but got %v", expected, tags)
+	}
+
+	// an empty commit renders an invalid tag.
+	b.gitCommit = ""
+	b.config.Tags = []string{":{{.ShortCommit}}"}
+	if _, err := b.renderTags("skiff/core:v1"); err == nil {
+		t.Fatal("expected error for empty tag")
+	}
+
+	// unknown fields are rejected.
+	b.config.Tags = []string{":{{.Unknown}}"}
+	if _, err := b.renderTags("skiff/core:v1"); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+}
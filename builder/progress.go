@@ -0,0 +1,220 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/streamformatter"
+	units "github.com/docker/go-units"
+	"github.com/moby/term"
+)
+
+// ProgressMode controls how the build progress is rendered.
+type ProgressMode string
+
+const (
+	// ProgressAuto uses ProgressTTY if the output is a terminal and ProgressPlain otherwise.
+	ProgressAuto ProgressMode = "auto"
+	// ProgressTTY renders progress bars updated in place.
+	ProgressTTY ProgressMode = "tty"
+	// ProgressPlain writes line-oriented output without progress bars, for logs.
+	ProgressPlain ProgressMode = "plain"
+	// ProgressJSON writes one JSON message per line in the Docker API format.
+	ProgressJSON ProgressMode = "json"
+)
+
+// ParseProgressMode parses a progress mode, empty is ProgressAuto.
+func ParseProgressMode(mode string) (ProgressMode, error) {
+	switch m := ProgressMode(mode); m {
+	case "":
+		return ProgressAuto, nil
+	case ProgressAuto, ProgressTTY, ProgressPlain, ProgressJSON:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown progress mode %q: expected auto, tty, plain or json", mode)
+	}
+}
+
+// buildProgress renders the output of the builder to the output stream.
+type buildProgress struct {
+	out  io.Writer
+	mode ProgressMode
+	// fd is the terminal file descriptor for ProgressTTY.
+	fd uintptr
+}
+
+// progress returns the renderer for the output stream and progress mode.
+func (b *Builder) progress() *buildProgress {
+	p := &buildProgress{out: b.outputStream, mode: b.progressMode}
+	if p.out == nil {
+		p.out = io.Discard
+	}
+	isTerminal := false
+	if f, ok := p.out.(*os.File); ok {
+		p.fd = f.Fd()
+		isTerminal = term.IsTerminal(p.fd)
+	}
+	if p.mode == "" || p.mode == ProgressAuto {
+		if isTerminal {
+			p.mode = ProgressTTY
+		} else {
+			p.mode = ProgressPlain
+		}
+	}
+	return p
+}
+
+// progressOutput returns the output for progress of local operations.
+func (p *buildProgress) progressOutput() progress.Output {
+	switch p.mode {
+	case ProgressTTY:
+		return streamformatter.NewProgressOutput(p.out)
+	case ProgressJSON:
+		return streamformatter.NewJSONProgressOutput(p.out, false)
+	default:
+		return &plainProgressOutput{out: p.out}
+	}
+}
+
+// plainProgressOutput writes messages and completed actions only.
+type plainProgressOutput struct {
+	out io.Writer
+}
+
+// WriteProgress writes the progress if it is a message or the last update.
+func (o *plainProgressOutput) WriteProgress(prog progress.Progress) error {
+	var line string
+	switch {
+	case prog.Message != "":
+		line = prog.Message
+	case !prog.LastUpdate:
+		return nil
+	case prog.HideCounts:
+		line = prog.Action
+	case prog.Units != "":
+		line = fmt.Sprintf("%s %d %s", prog.Action, prog.Current, prog.Units)
+	default:
+		line = fmt.Sprintf("%s %s", prog.Action, units.HumanSize(float64(prog.Current)))
+	}
+	if prog.ID != "" {
+		line = prog.ID + ": " + line
+	}
+	_, err := fmt.Fprintln(o.out, line)
+	return err
+}
+
+// displayJSONMessages renders a stream of JSON messages from the daemon.
+//
+// auxCallback is not called in ProgressJSON mode: the aux messages are
+// written to the output like the others.
+func (p *buildProgress) displayJSONMessages(rd io.Reader, auxCallback func(jsonmessage.JSONMessage)) error {
+	switch p.mode {
+	case ProgressTTY:
+		return jsonmessage.DisplayJSONMessagesStream(rd, p.out, p.fd, true, auxCallback)
+	case ProgressJSON:
+		dec := json.NewDecoder(rd)
+		enc := json.NewEncoder(p.out)
+		for {
+			var msg jsonmessage.JSONMessage
+			if err := dec.Decode(&msg); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			if err := enc.Encode(&msg); err != nil {
+				return err
+			}
+			if msg.Error != nil {
+				return msg.Error
+			}
+		}
+	default:
+		return jsonmessage.DisplayJSONMessagesStream(rd, p.out, 0, false, auxCallback)
+	}
+}
+
+// lineWriter returns a writer for the output of a local operation, like git.
+//
+// In ProgressTTY mode the output is written as-is. Otherwise updates ending
+// with a carriage return are dropped and each line is written as a message.
+// Close writes the last line if it has no line ending.
+func (p *buildProgress) lineWriter(id string) io.WriteCloser {
+	switch p.mode {
+	case ProgressTTY:
+		return nopWriteCloser{p.out}
+	case ProgressJSON:
+		enc := json.NewEncoder(p.out)
+		return &progressLineWriter{writeLine: func(line string) error {
+			return enc.Encode(&jsonmessage.JSONMessage{ID: id, Status: line})
+		}}
+	default:
+		return &progressLineWriter{writeLine: func(line string) error {
+			_, err := fmt.Fprintf(p.out, "%s: %s\n", id, line)
+			return err
+		}}
+	}
+}
+
+// progressLineWriter splits output into lines, dropping in-place updates.
+type progressLineWriter struct {
+	mtx sync.Mutex
+	buf []byte
+	// updated is the last update ending with a carriage return.
+	updated   string
+	writeLine func(line string) error
+}
+
+// Write writes the completed lines in data.
+func (w *progressLineWriter) Write(data []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	n := len(data)
+	for len(data) != 0 {
+		i := bytes.IndexAny(data, "\r\n")
+		if i == -1 {
+			w.buf = append(w.buf, data...)
+			break
+		}
+		line := string(append(w.buf, data[:i]...))
+		w.buf = w.buf[:0]
+		if data[i] == '\n' {
+			// lines may also end with \r\n.
+			if line == "" {
+				line = w.updated
+			}
+			w.updated = ""
+			if line != "" {
+				if err := w.writeLine(line); err != nil {
+					return 0, err
+				}
+			}
+		} else {
+			// the line is replaced by the next update.
+			w.updated = line
+		}
+		data = data[i+1:]
+	}
+	return n, nil
+}
+
+// Close writes the last line or update if it was not ended with a newline.
+func (w *progressLineWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	line := string(w.buf)
+	if line == "" {
+		line = w.updated
+	}
+	w.buf, w.updated = nil, ""
+	if line == "" {
+		return nil
+	}
+	return w.writeLine(line)
+}
@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/progress"
+)
+
+func TestProgressLineWriter(t *testing.T) {
+	var out bytes.Buffer
+	b := &Builder{outputStream: &out}
+	w := b.progress().lineWriter("git")
+
+	// updates are dropped, split writes and \r\n are handled.
+	for _, chunk := range []string{
+		"Counting objects:  50% (1/2)\r",
+		"Counting objects: 100% (2/2), done.\n",
+		"Receiving objects: 100% (2/2)\r",
+		"\nTotal 2 (del",
+		"ta 0)\n",
+		"Checking out files: 100% (2/2)\r",
+		"Done",
+	} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// the last line has no newline: written on close.
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "git: Counting objects: 100% (2/2), done.\n" +
+		"git: Receiving objects: 100% (2/2)\n" +
+		"git: Total 2 (delta 0)\n" +
+		"git: Done\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q but got %q", expected, out.String())
+	}
+}
+
+func TestProgressOutput(t *testing.T) {
+	var out bytes.Buffer
+	b := &Builder{outputStream: &out}
+	prog := b.progress()
+	if prog.mode != ProgressPlain {
+		t.Fatalf("expected plain mode for a non-terminal but got %s", prog.mode)
+	}
+
+	// the plain output writes only the last update.
+	po := prog.progressOutput()
+	for _, cur := range []int64{1024, 2048} {
+		_ = po.WriteProgress(progress.Progress{Action: "Sending build context", Current: cur, LastUpdate: cur == 2048})
+	}
+	if out.String() != "Sending build context 2.048kB\n" {
+		t.Fatalf("unexpected plain output: %q", out.String())
+	}
+
+	// the json output writes a message per line.
+	out.Reset()
+	b.SetProgressMode(ProgressJSON)
+	w := b.progress().lineWriter("git")
+	_, _ = w.Write([]byte("Cloning"))
+	_ = w.Close()
+	var msg jsonmessage.JSONMessage
+	if err := json.Unmarshal(out.Bytes(), &msg); err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.ID != "git" || msg.Status != "Cloning" {
+		t.Fatalf("unexpected json message: %s", strings.TrimSpace(out.String()))
+	}
+
+	if _, err := ParseProgressMode("fancy"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
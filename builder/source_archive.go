@@ -0,0 +1,114 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveSuffixes are the file name suffixes of archive sources.
+//
+// The format is detected from the contents, not the suffix.
+var archiveSuffixes = []string{
+	".tar.gz", ".tgz",
+	".tar",
+	".tar.xz", ".txz",
+	".tar.zst", ".tzst",
+	".tar.bz2", ".tbz2",
+	".zip",
+}
+
+// isArchiveSource checks if a source has the suffix of an archive.
+func isArchiveSource(source string) bool {
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(source, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isURLSource checks if a source is a http URL.
+func isURLSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// downloadFile downloads a URL to a file.
+func downloadFile(url string, f *os.File) error {
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("download %s: %s", url, response.Status)
+	}
+	_, err = io.Copy(f, response.Body)
+	return err
+}
+
+// verifySha256 checks the sha256 checksum of a file.
+func verifySha256(filePath, expected string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		return errors.Errorf("sha256 mismatch: expected %s, got %s", strings.ToLower(expected), actual)
+	}
+	return nil
+}
+
+// fetchSourceArchive tries to download (if a URL), verify and extract an archive.
+func (b *Builder) fetchSourceArchive(destination, source string) error {
+	le := log.WithField("source", "archive")
+
+	archivePath := source
+	if cache := b.sourceCache(); cache != nil && isURLSource(source) {
+		cachedPath, release, err := cache.archive(source, b.config.Sha256)
+		if err != nil {
+			return errors.Wrap(err, source)
+		}
+		defer release()
+		archivePath = cachedPath
+	} else if isURLSource(source) {
+		f, err := ioutil.TempFile(b.workDir, "skiff-core-download-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+
+		le.WithField("url", source).Debug("Downloading")
+		err = downloadFile(source, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		archivePath = f.Name()
+	}
+
+	if b.config.Sha256 != "" {
+		if err := verifySha256(archivePath, b.config.Sha256); err != nil {
+			return errors.Wrap(err, source)
+		}
+	}
+
+	le.WithField("path", archivePath).Debug("Extracting")
+	return extractArchive(archivePath, destination, b.config.StripComponents)
+}
@@ -0,0 +1,333 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSourceCacheSize is the default max size of the source cache in bytes.
+const DefaultSourceCacheSize int64 = 2 << 30
+
+// sourceCacheDir is the directory in the work dir containing the source cache.
+const sourceCacheDir = "source-cache"
+
+// Kinds of entries in the source cache, used as sub-directories.
+const (
+	sourceCacheGit     = "git"
+	sourceCacheArchive = "archives"
+	sourceCacheLocal   = "local"
+)
+
+// sourceCacheEntry is the state of an entry in this process.
+type sourceCacheEntry struct {
+	mtx sync.Mutex
+	// fetched indicates the entry was fetched or updated by this process.
+	fetched bool
+	// refCount is the number of builds using the entry.
+	refCount int
+}
+
+// sourceCache is a persistent cache of sources in the work dir.
+//
+// Git sources are stored as mirrors which are updated with fetch, and
+// downloaded archives are stored by URL and checksum. Each entry is fetched at
+// most once per process. The least recently used entries are removed when the
+// cache is larger than maxSize.
+type sourceCache struct {
+	dir     string
+	maxSize int64
+
+	mtx     sync.Mutex
+	entries map[string]*sourceCacheEntry
+}
+
+// sourceCachesMtx guards sourceCaches.
+var sourceCachesMtx sync.Mutex
+
+// sourceCaches contains the source cache for each work dir.
+var sourceCaches = make(map[string]*sourceCache)
+
+// getSourceCache returns the source cache for the work dir.
+//
+// Returns nil if workDir is empty.
+func getSourceCache(workDir string, maxSize int64) *sourceCache {
+	if workDir == "" {
+		return nil
+	}
+	dir := filepath.Join(workDir, sourceCacheDir)
+
+	sourceCachesMtx.Lock()
+	defer sourceCachesMtx.Unlock()
+	cache := sourceCaches[dir]
+	if cache == nil {
+		cache = &sourceCache{dir: dir, entries: make(map[string]*sourceCacheEntry)}
+		sourceCaches[dir] = cache
+	}
+	if maxSize > 0 {
+		cache.mtx.Lock()
+		cache.maxSize = maxSize
+		cache.mtx.Unlock()
+	}
+	return cache
+}
+
+// sourceCacheKey builds the file name of an entry from its identifying fields.
+func sourceCacheKey(fields ...string) string {
+	h := sha256.New()
+	for _, field := range fields {
+		writeDigestField(h, field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// acquire locks the entry at the path and marks it in use.
+//
+// Returns a function to release the entry.
+func (c *sourceCache) acquire(entryPath string) (*sourceCacheEntry, func()) {
+	c.mtx.Lock()
+	entry := c.entries[entryPath]
+	if entry == nil {
+		entry = &sourceCacheEntry{}
+		c.entries[entryPath] = entry
+	}
+	entry.refCount++
+	c.mtx.Unlock()
+
+	entry.mtx.Lock()
+	return entry, func() {
+		c.mtx.Lock()
+		entry.refCount--
+		c.mtx.Unlock()
+	}
+}
+
+// touch marks the entry as recently used.
+func touchSourceCacheEntry(entryPath string) {
+	now := time.Now()
+	_ = os.Chtimes(entryPath, now, now)
+}
+
+// gitMirror returns the path to an up to date mirror of the git repository.
+//
+// The mirror is fetched once per process. Call release when done using it.
+func (c *sourceCache) gitMirror(url string, auth transport.AuthMethod) (mirrorPath string, release func(), err error) {
+	mirrorPath = filepath.Join(c.dir, sourceCacheGit, sourceCacheKey(url))
+	entry, release := c.acquire(mirrorPath)
+	defer entry.mtx.Unlock()
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	le := log.WithField("url", url).WithField("path", mirrorPath)
+	// local repositories are read in-process.
+	fetchURL, _ := gitLocalURL(url)
+	if !entry.fetched {
+		if repo, oerr := git.PlainOpen(mirrorPath); oerr == nil {
+			le.Debug("Updating git mirror")
+			err = repo.Fetch(&git.FetchOptions{
+				RemoteName: git.DefaultRemoteName,
+				RemoteURL:  fetchURL,
+				Auth:       auth,
+				Force:      true,
+				Prune:      true,
+			})
+			if err == git.NoErrAlreadyUpToDate {
+				err = nil
+			}
+			if err != nil {
+				return "", nil, errors.Wrap(err, "update git mirror")
+			}
+		} else {
+			le.Debug("Creating git mirror")
+			_ = os.RemoveAll(mirrorPath)
+			if err := os.MkdirAll(filepath.Dir(mirrorPath), 0755); err != nil {
+				return "", nil, err
+			}
+			_, err = git.PlainClone(mirrorPath, true, &git.CloneOptions{
+				URL:    fetchURL,
+				Auth:   auth,
+				Mirror: true,
+			})
+			if err != nil {
+				_ = os.RemoveAll(mirrorPath)
+				return "", nil, errors.Wrap(err, "create git mirror")
+			}
+		}
+		entry.fetched = true
+		c.evict()
+	}
+	touchSourceCacheEntry(mirrorPath)
+	return mirrorPath, release, nil
+}
+
+// archive returns the path to the downloaded archive.
+//
+// If sha256Sum is set, a cached archive with the checksum is used without
+// downloading. Otherwise the archive is downloaded once per process. Call
+// release when done using it.
+func (c *sourceCache) archive(url, sha256Sum string) (archivePath string, release func(), err error) {
+	archivePath = filepath.Join(c.dir, sourceCacheArchive, sourceCacheKey(url, sha256Sum))
+	entry, release := c.acquire(archivePath)
+	defer entry.mtx.Unlock()
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	le := log.WithField("url", url).WithField("path", archivePath)
+	if !entry.fetched && sha256Sum != "" {
+		if _, serr := os.Stat(archivePath); serr == nil {
+			if verr := verifySha256(archivePath, sha256Sum); verr == nil {
+				le.Debug("Using cached archive")
+				entry.fetched = true
+			}
+		}
+	}
+	if !entry.fetched {
+		le.Debug("Downloading archive")
+		if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+			return "", nil, err
+		}
+		f, err := ioutil.TempFile(filepath.Dir(archivePath), ".download-")
+		if err != nil {
+			return "", nil, err
+		}
+		defer os.Remove(f.Name())
+		err = downloadFile(url, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && sha256Sum != "" {
+			err = verifySha256(f.Name(), sha256Sum)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if err := os.Rename(f.Name(), archivePath); err != nil {
+			return "", nil, err
+		}
+		entry.fetched = true
+		c.evict()
+	}
+	touchSourceCacheEntry(archivePath)
+	return archivePath, release, nil
+}
+
+// localCopy returns the path to an incrementally synced copy of a local directory.
+//
+// The copy is locked until release is called, so builds of the same source
+// do not change the copy while it is in use.
+func (c *sourceCache) localCopy(source string, sync func(copyPath string) error) (copyPath string, release func(), err error) {
+	copyPath = filepath.Join(c.dir, sourceCacheLocal, sourceCacheKey(filepath.Clean(source)))
+	entry, releaseRef := c.acquire(copyPath)
+	release = func() {
+		entry.mtx.Unlock()
+		releaseRef()
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	if err := os.MkdirAll(copyPath, 0755); err != nil {
+		return "", nil, err
+	}
+	if err := sync(copyPath); err != nil {
+		return "", nil, err
+	}
+	touchSourceCacheEntry(copyPath)
+	if !entry.fetched {
+		entry.fetched = true
+		c.evict()
+	}
+	return copyPath, release, nil
+}
+
+// sourceCacheFile is an entry on disk considered for eviction.
+type sourceCacheFile struct {
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+// pathSize computes the total size of the files at a path.
+func pathSize(p string) int64 {
+	var size int64
+	_ = filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// evict removes the least recently used entries until the cache fits in maxSize.
+//
+// Entries in use by this process are not removed.
+func (c *sourceCache) evict() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.maxSize <= 0 {
+		return
+	}
+
+	var files []*sourceCacheFile
+	var total int64
+	for _, kind := range []string{sourceCacheGit, sourceCacheArchive, sourceCacheLocal} {
+		kindDir := filepath.Join(c.dir, kind)
+		infos, err := ioutil.ReadDir(kindDir)
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			// skip in-progress downloads.
+			if info.Name()[0] == '.' {
+				continue
+			}
+			p := filepath.Join(kindDir, info.Name())
+			size := pathSize(p)
+			total += size
+			files = append(files, &sourceCacheFile{path: p, size: size, lastUse: info.ModTime()})
+		}
+	}
+	if total <= c.maxSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].lastUse.Before(files[j].lastUse)
+	})
+	for _, f := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if entry := c.entries[f.path]; entry != nil && entry.refCount > 0 {
+			continue
+		}
+		log.
+			WithField("path", f.path).
+			WithField("size", f.size).
+			Debug("Evicting source cache entry")
+		if err := os.RemoveAll(f.path); err != nil {
+			continue
+		}
+		delete(c.entries, f.path)
+		total -= f.size
+	}
+}
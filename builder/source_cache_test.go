@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestSourceCacheArchive(t *testing.T) {
+	data := compressTestData(t, "gzip", buildTestTar(t, testTarEntries))
+	sum := sha256.Sum256(data)
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		rw.Write(data)
+	}))
+	defer srv.Close()
+
+	workDir := t.TempDir()
+	fetch := func(sha string) {
+		b, err := NewBuilder(&config.ConfigImageBuild{
+			Source:          srv.URL + "/src.tar.gz",
+			Sha256:          sha,
+			StripComponents: 1,
+		}, workDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		dest := t.TempDir()
+		if err := b.fetchSourceArchive(dest, b.config.Source); err != nil {
+			t.Fatal(err.Error())
+		}
+		checkExtractedTree(t, dest)
+	}
+
+	// fetched once per process.
+	fetch("")
+	fetch("")
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Fatalf("expected 1 download, got %d", n)
+	}
+
+	// with a checksum the cached archive is used by later processes.
+	fetch(hex.EncodeToString(sum[:]))
+	delete(sourceCaches, filepath.Join(workDir, sourceCacheDir))
+	fetch(hex.EncodeToString(sum[:]))
+	if n := atomic.LoadInt32(&downloads); n != 2 {
+		t.Fatalf("expected 2 downloads, got %d", n)
+	}
+}
+
+func TestSourceCacheEvict(t *testing.T) {
+	cache := getSourceCache(t.TempDir(), 12)
+	archiveDir := filepath.Join(cache.dir, sourceCacheArchive)
+	if err := os.MkdirAll(archiveDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	now := time.Now()
+	for i, name := range []string{"old", "inuse", "new"} {
+		p := filepath.Join(archiveDir, name)
+		if err := os.WriteFile(p, []byte("123456"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	entry, release := cache.acquire(filepath.Join(archiveDir, "inuse"))
+	entry.mtx.Unlock()
+	defer release()
+
+	cache.evict()
+	for name, exists := range map[string]bool{"old": false, "inuse": true, "new": true} {
+		_, err := os.Stat(filepath.Join(archiveDir, name))
+		if (err == nil) != exists {
+			t.Errorf("%s: expected exists=%v, got %v", name, exists, err)
+		}
+	}
+}
@@ -2,21 +2,350 @@ package builder
 
 import (
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
 )
 
+// GitCommitLabel is the image label containing the commit the image was built from.
+const GitCommitLabel = "org.skiffos.skiff-core.git-commit"
+
+// gitSourcePrefix forces a source to be cloned with git.
+const gitSourcePrefix = "git+"
+
+// parseGitSource checks if a source is a git repository.
+//
+// Returns the URL to clone.
+func parseGitSource(source string) (string, bool) {
+	if strings.HasPrefix(source, gitSourcePrefix) {
+		return source[len(gitSourcePrefix):], true
+	}
+	for _, prefix := range []string{"git://", "ssh://", "file://"} {
+		if strings.HasPrefix(source, prefix) {
+			return source, true
+		}
+	}
+	if strings.HasPrefix(source, "http") && strings.HasSuffix(strings.TrimSuffix(source, "/"), ".git") {
+		return source, true
+	}
+	return "", false
+}
+
+// gitLocalProtocol is the protocol used to read local repositories with the
+// in-process git server, so the git binary is not required.
+const gitLocalProtocol = "skiff-local"
+
+// installGitLocalProtocol installs the in-process server for gitLocalProtocol.
+var installGitLocalProtocol sync.Once
+
+// gitLocalURL converts the URL of a local repository to gitLocalProtocol.
+//
+// Returns the URL unchanged and false if the repository is not local.
+func gitLocalURL(url string) (string, bool) {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil || ep.Protocol != "file" {
+		return url, false
+	}
+	repoPath, err := filepath.Abs(ep.Path)
+	if err != nil {
+		return url, false
+	}
+	installGitLocalProtocol.Do(func() {
+		client.InstallProtocol(gitLocalProtocol, server.NewClient(gitLocalLoader{}))
+	})
+	return gitLocalProtocol + "://" + filepath.ToSlash(repoPath), true
+}
+
+// gitLocalLoader loads bare and non-bare local repositories.
+type gitLocalLoader struct{}
+
+// Load loads the repository at the endpoint path.
+func (gitLocalLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	sto, err := server.DefaultLoader.Load(ep)
+	if err != transport.ErrRepositoryNotFound {
+		return sto, err
+	}
+	dotGit := *ep
+	dotGit.Path = path.Join(ep.Path, git.GitDirName)
+	return server.DefaultLoader.Load(&dotGit)
+}
+
+// gitAuth builds the auth method for the git config.
+func gitAuth(gitConf *config.ConfigImageBuildGit, url string) (transport.AuthMethod, error) {
+	if gitConf == nil {
+		return nil, nil
+	}
+
+	if gitConf.SSHKey != "" {
+		user := gitssh.DefaultUsername
+		if ep, err := transport.NewEndpoint(url); err == nil && ep.User != "" {
+			user = ep.User
+		}
+		keys, err := gitssh.NewPublicKeysFromFile(user, gitConf.SSHKey, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "load ssh key")
+		}
+		if gitConf.KnownHosts != "" {
+			keys.HostKeyCallback, err = gitssh.NewKnownHostsCallback(gitConf.KnownHosts)
+			if err != nil {
+				return nil, errors.Wrap(err, "load known hosts")
+			}
+		}
+		return keys, nil
+	}
+
+	if gitConf.TokenFile != "" {
+		data, err := os.ReadFile(gitConf.TokenFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read token file")
+		}
+		username := gitConf.Username
+		if username == "" {
+			username = "git"
+		}
+		return &githttp.BasicAuth{Username: username, Password: strings.TrimSpace(string(data))}, nil
+	}
+
+	return nil, nil
+}
+
+// resolveGitRef finds the branch or tag with the name on the remote.
+//
+// Returns an empty name if ref is not a branch or tag, for example a commit.
+func resolveGitRef(url string, auth transport.AuthMethod, ref string) (plumbing.ReferenceName, error) {
+	if strings.HasPrefix(ref, "refs/") {
+		return plumbing.ReferenceName(ref), nil
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+	})
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+	} {
+		for _, remoteRef := range refs {
+			if remoteRef.Name() == name {
+				return name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
 // fetchSourceGit attempts to fetch source by git cloning.
+//
+// Sets gitCommit to the commit which was checked out.
 func (b *Builder) fetchSourceGit(destination, source string) error {
 	le := log.WithField("source", "git")
 
-	le.WithField("url", source).Debug("Cloning")
-	_, err := git.PlainClone(destination, false, &git.CloneOptions{
-		Progress:          os.Stdout,
-		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		URL:               source,
-	})
+	gitConf := b.config.Git
+	if gitConf == nil {
+		gitConf = &config.ConfigImageBuildGit{}
+	}
+	auth, err := gitAuth(gitConf, source)
+	if err != nil {
+		return err
+	}
+
+	// clone from the mirror in the source cache, if enabled.
+	cloneURL, cloneAuth := source, auth
+	if cache := b.sourceCache(); cache != nil {
+		mirrorPath, release, err := cache.gitMirror(source, auth)
+		if err != nil {
+			return err
+		}
+		defer release()
+		cloneURL, cloneAuth = mirrorPath, nil
+	}
+	cloneURL, cloneLocal := gitLocalURL(cloneURL)
+
+	gitProgress := b.progress().lineWriter("git")
+	opts := &git.CloneOptions{
+		Progress: gitProgress,
+		URL:      cloneURL,
+		Auth:     cloneAuth,
+		Depth:    gitConf.Depth,
+	}
+	// the in-process server does not support shallow clones, which are not
+	// useful for local repositories anyway.
+	if cloneLocal {
+		opts.Depth = 0
+	}
+
+	// checkoutCommit is set if the ref is not a branch or tag.
+	var checkoutCommit bool
+	if gitConf.Ref != "" {
+		refName, err := resolveGitRef(cloneURL, cloneAuth, gitConf.Ref)
+		if err != nil {
+			return errors.Wrap(err, "list remote refs")
+		}
+		if refName != "" {
+			opts.ReferenceName = refName
+			opts.SingleBranch = true
+		} else {
+			// fetch the full history to find the commit.
+			checkoutCommit = true
+			opts.Depth = 0
+			opts.NoCheckout = true
+		}
+	}
+
+	le.
+		WithField("url", source).
+		WithField("ref", gitConf.Ref).
+		Debug("Cloning")
+	repo, err := git.PlainClone(destination, false, opts)
+	gitProgress.Close()
+	if err != nil {
+		return err
+	}
+
+	if checkoutCommit {
+		hash, err := repo.ResolveRevision(plumbing.Revision(gitConf.Ref))
+		if err != nil {
+			return errors.Wrapf(err, "resolve ref %s", gitConf.Ref)
+		}
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		if err := wt.Checkout(&git.CheckoutOptions{Hash: *hash, Force: true}); err != nil {
+			return err
+		}
+	}
+
+	// relative submodule URLs are resolved against the origin.
+	if cloneURL != source {
+		conf, err := repo.Config()
+		if err != nil {
+			return err
+		}
+		if origin := conf.Remotes[git.DefaultRemoteName]; origin != nil {
+			origin.URLs = []string{source}
+		}
+		if err := repo.SetConfig(conf); err != nil {
+			return err
+		}
+	}
+
+	if !gitConf.DisableSubmodules {
+		wt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		sourceOrigin := gitURLOrigin(source)
+		err = updateSubmodules(wt, sourceOrigin, sourceOrigin, auth, int(git.DefaultSubmoduleRecursionDepth))
+		if err != nil {
+			return errors.Wrap(err, "update submodules")
+		}
+	}
+
+	// peels annotated tags to the commit.
+	head, err := repo.ResolveRevision(plumbing.Revision(plumbing.HEAD))
+	if err != nil {
+		return err
+	}
+	b.gitCommit = head.String()
+	le.WithField("commit", b.gitCommit).Debug("Checked out")
+	return nil
+}
+
+// gitDefaultPorts are the default ports of the git transports.
+var gitDefaultPorts = map[string]int{
+	"git":   9418,
+	"http":  80,
+	"https": 443,
+	"ssh":   22,
+}
+
+// gitURLOrigin returns the scheme, host and port of a git URL, empty for
+// local repositories.
+func gitURLOrigin(url string) string {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil || ep.Protocol == "file" {
+		return ""
+	}
+	origin := ep.Protocol + "://" + ep.Host
+	if ep.Port != 0 && ep.Port != gitDefaultPorts[ep.Protocol] {
+		origin += ":" + strconv.Itoa(ep.Port)
+	}
+	return origin
+}
+
+// submoduleAuth returns the auth method to use for a submodule and its origin.
+//
+// The credentials of the source are only sent to submodules with the same
+// scheme, host and port. Relative URLs are on the origin of the parent
+// repository.
+func submoduleAuth(
+	url, sourceOrigin, parentOrigin string,
+	auth transport.AuthMethod,
+) (transport.AuthMethod, string) {
+	origin := parentOrigin
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		origin = gitURLOrigin(url)
+	}
+	if origin == "" || origin != sourceOrigin {
+		return nil, origin
+	}
+	return auth, origin
+}
 
-	return err
+// updateSubmodules initializes and updates the submodules of a worktree.
+//
+// Recurses into nested submodules up to depth levels.
+func updateSubmodules(
+	wt *git.Worktree,
+	sourceOrigin, parentOrigin string,
+	auth transport.AuthMethod,
+	depth int,
+) error {
+	subs, err := wt.Submodules()
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		subConf := sub.Config()
+		subAuth, subOrigin := submoduleAuth(subConf.URL, sourceOrigin, parentOrigin, auth)
+		if err := sub.Update(&git.SubmoduleUpdateOptions{Init: true, Auth: subAuth}); err != nil {
+			return errors.Wrapf(err, "submodule %s", subConf.Name)
+		}
+		if depth <= 1 {
+			continue
+		}
+		subRepo, err := sub.Repository()
+		if err != nil {
+			return err
+		}
+		subWt, err := subRepo.Worktree()
+		if err != nil {
+			return err
+		}
+		if err := updateSubmodules(subWt, sourceOrigin, subOrigin, auth, depth-1); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,147 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestParseGitSource(t *testing.T) {
+	cases := []struct {
+		source, url string
+		ok          bool
+	}{
+		{"git://example.com/repo", "git://example.com/repo", true},
+		{"ssh://git@example.com/repo", "ssh://git@example.com/repo", true},
+		{"file:///srv/repo", "file:///srv/repo", true},
+		{"https://example.com/repo.git", "https://example.com/repo.git", true},
+		{"git+https://example.com/repo", "https://example.com/repo", true},
+		{"https://example.com/repo.tar.gz", "", false},
+		{"/srv/repo", "", false},
+	}
+	for _, c := range cases {
+		url, ok := parseGitSource(c.source)
+		if url != c.url || ok != c.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", c.source, c.url, c.ok, url, ok)
+		}
+	}
+}
+
+// commitTestFile writes a file and commits it.
+func commitTestFile(t *testing.T, repo *git.Repository, dir, data string) plumbing.Hash {
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writeTestFile(t, dir, "version", data)
+	if _, err := wt.Add("version"); err != nil {
+		t.Fatal(err.Error())
+	}
+	hash, err := wt.Commit(data, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return hash
+}
+
+func TestFetchSourceGit(t *testing.T) {
+	// sources are fetched in-process, without the git binary.
+	t.Setenv("PATH", "")
+
+	repoDir := t.TempDir()
+	repo, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	first := commitTestFile(t, repo, repoDir, "v1")
+	if _, err := repo.CreateTag("v1", first, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = repo.CreateTag("v1-annotated", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		Message: "v1",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second := commitTestFile(t, repo, repoDir, "v2")
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		ref     string
+		depth   int
+		version string
+		commit  plumbing.Hash
+	}{
+		{"", 0, "v2", second},
+		{head.Name().Short(), 1, "v2", second},
+		{"v1", 1, "v1", first},
+		{"v1-annotated", 0, "v1", first},
+		{first.String(), 1, "v1", first},
+	}
+	// without and with the source cache.
+	workDirs := []string{"", t.TempDir()}
+	for i, c := range append(cases, cases...) {
+		b := &Builder{
+			config: &config.ConfigImageBuild{
+				Git: &config.ConfigImageBuildGit{Ref: c.ref, Depth: c.depth, DisableSubmodules: true},
+			},
+			workDir: workDirs[i/len(cases)],
+		}
+		dest := t.TempDir()
+		if err := b.fetchSourceGit(dest, "file://"+repoDir); err != nil {
+			t.Fatalf("ref %q: %v", c.ref, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, "version"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != c.version {
+			t.Errorf("ref %q: expected %s, got %s", c.ref, c.version, string(data))
+		}
+		if b.gitCommit != c.commit.String() {
+			t.Errorf("ref %q: expected commit %s, got %s", c.ref, c.commit, b.gitCommit)
+		}
+	}
+}
+
+func TestSubmoduleAuth(t *testing.T) {
+	auth := &githttp.BasicAuth{Username: "git", Password: "secret"}
+	sourceOrigin := gitURLOrigin("https://git.example.com/org/repo.git")
+	cases := []struct {
+		url, parentOrigin, origin string
+		auth                      bool
+	}{
+		{"https://git.example.com/org/lib.git", sourceOrigin, "https://git.example.com", true},
+		{"../lib.git", sourceOrigin, "https://git.example.com", true},
+		{"https://github.com/org/lib.git", sourceOrigin, "https://github.com", false},
+		{"git@github.com:org/lib.git", sourceOrigin, "ssh://github.com", false},
+		{"https://git.example.com.evil.net/lib.git", sourceOrigin, "https://git.example.com.evil.net", false},
+		// same host with another scheme or port.
+		{"http://git.example.com/org/lib.git", sourceOrigin, "http://git.example.com", false},
+		{"git://git.example.com/org/lib.git", sourceOrigin, "git://git.example.com", false},
+		{"https://git.example.com:443/org/lib.git", sourceOrigin, "https://git.example.com", true},
+		{"https://git.example.com:8443/org/lib.git", sourceOrigin, "https://git.example.com:8443", false},
+		// relative to a submodule on another host.
+		{"./nested.git", "https://github.com", "https://github.com", false},
+		{"/srv/lib", sourceOrigin, "", false},
+	}
+	for _, c := range cases {
+		subAuth, origin := submoduleAuth(c.url, sourceOrigin, c.parentOrigin, auth)
+		if origin != c.origin || (subAuth != nil) != c.auth {
+			t.Errorf("%s: expected origin %q auth %v, got %q %v", c.url, c.origin, c.auth, origin, subAuth != nil)
+		}
+	}
+}
@@ -10,6 +10,11 @@ import (
 )
 
 // fetchSourceRsync copies from a local path to the destination.
+//
+// Only changed files are copied if the destination already exists, and files
+// which were removed from the source are removed. Paths matched by the
+// .dockerignore of the source are not copied. Uses a native copy if rsync is
+// not installed.
 func (b *Builder) fetchSourceRsync(destination, source string) error {
 	st, err := os.Stat(source)
 	if err != nil {
@@ -34,6 +39,12 @@ func (b *Builder) fetchSourceRsync(destination, source string) error {
 		Recursive: true,
 		// Links copy symlinks as symlinks
 		Links: true,
+		// Delete removes files which are no longer in the source
+		Delete: true,
+		// DockerIgnore skips the files excluded from the build context
+		DockerIgnore: true,
+		// Dockerfile is kept even if excluded by the .dockerignore
+		Dockerfile: b.relDockerfile(),
 	})
 	return task.Run()
 }
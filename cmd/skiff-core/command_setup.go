@@ -3,14 +3,23 @@ package main
 import (
 	"os"
 	"strings"
+	"time"
 
+	units "github.com/docker/go-units"
+	"github.com/skiffos/skiff-core/builder"
 	"github.com/skiffos/skiff-core/setup"
 	"github.com/urfave/cli/v2"
 )
 
 var setupArgs struct {
-	CreateUsers bool
-	WorkDir     string
+	CreateUsers     bool
+	WorkDir         string
+	Rebuild         bool
+	SourceCacheSize string
+	Progress        string
+	LibraryCacheTTL time.Duration
+	LibrarySeed     string
+	LibraryOffline  bool
 }
 
 // SetupCommands define the commands for "setup"
@@ -29,6 +38,45 @@ var SetupCommands cli.Commands = []*cli.Command{
 				Destination: &setupArgs.WorkDir,
 				EnvVars:     []string{"SKIFF_CORE_WORK_DIR"},
 			},
+			&cli.BoolFlag{
+				Name:        "rebuild",
+				Usage:       "If set, core will rebuild images even if they are up to date.",
+				Destination: &setupArgs.Rebuild,
+				EnvVars:     []string{"SKIFF_CORE_REBUILD"},
+			},
+			&cli.StringFlag{
+				Name:        "source-cache-size",
+				Usage:       "Max size of the image source cache in the work dir.",
+				Value:       "2GiB",
+				Destination: &setupArgs.SourceCacheSize,
+				EnvVars:     []string{"SKIFF_CORE_SOURCE_CACHE_SIZE"},
+			},
+			&cli.StringFlag{
+				Name:        "progress",
+				Usage:       "How to render the build progress: auto, tty, plain or json.",
+				Value:       "auto",
+				Destination: &setupArgs.Progress,
+				EnvVars:     []string{"SKIFF_CORE_PROGRESS"},
+			},
+			&cli.DurationFlag{
+				Name:        "library-cache-ttl",
+				Usage:       "Time after which the cached library for scratchBuild is refreshed.",
+				Value:       builder.DefaultLibraryCacheTTL,
+				Destination: &setupArgs.LibraryCacheTTL,
+				EnvVars:     []string{"SKIFF_CORE_LIBRARY_CACHE_TTL"},
+			},
+			&cli.StringFlag{
+				Name:        "library-seed",
+				Usage:       "Tarball or directory to seed the empty library cache for scratchBuild from.",
+				Destination: &setupArgs.LibrarySeed,
+				EnvVars:     []string{"SKIFF_CORE_LIBRARY_SEED"},
+			},
+			&cli.BoolFlag{
+				Name:        "library-offline",
+				Usage:       "If set, core will use the cached library for scratchBuild without refreshing it.",
+				Destination: &setupArgs.LibraryOffline,
+				EnvVars:     []string{"SKIFF_CORE_LIBRARY_OFFLINE"},
+			},
 		},
 		Name:  "setup",
 		Usage: "Sets up users and containers.",
@@ -41,19 +89,31 @@ var SetupCommands cli.Commands = []*cli.Command{
 
 			setupArgs.WorkDir = strings.TrimSpace(setupArgs.WorkDir)
 			if setupArgs.WorkDir != "" {
-				if _, err := os.Stat(setupArgs.WorkDir); err != nil {
-					if os.IsNotExist(err) {
-						// if we created the dir, remove it afterwards.
-						defer os.RemoveAll(setupArgs.WorkDir)
-					}
-					err = os.Mkdir(setupArgs.WorkDir, 0755)
-					if err != nil {
-						return cli.NewExitError("Unable to create working directory: "+err.Error(), 1)
-					}
+				// the work dir contains the source cache: keep it afterwards.
+				if err := os.MkdirAll(setupArgs.WorkDir, 0755); err != nil {
+					return cli.NewExitError("Unable to create working directory: "+err.Error(), 1)
 				}
 			}
 
+			sourceCacheSize, err := units.RAMInBytes(setupArgs.SourceCacheSize)
+			if err != nil {
+				return cli.NewExitError("Invalid source cache size: "+err.Error(), 1)
+			}
+
+			progressMode, err := builder.ParseProgressMode(setupArgs.Progress)
+			if err != nil {
+				return cli.NewExitError("Invalid progress mode: "+err.Error(), 1)
+			}
+
 			s := setup.NewSetup(conf, setupArgs.WorkDir, setupArgs.CreateUsers)
+			s.SetRebuild(setupArgs.Rebuild)
+			s.SetSourceCacheSize(sourceCacheSize)
+			s.SetProgressMode(progressMode)
+			s.SetLibraryCacheOptions(builder.LibraryCacheOptions{
+				TTL:     setupArgs.LibraryCacheTTL,
+				Seed:    setupArgs.LibrarySeed,
+				Offline: setupArgs.LibraryOffline,
+			})
 
 			err = s.Execute()
 			if err != nil {
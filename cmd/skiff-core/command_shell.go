@@ -2,35 +2,168 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os/user"
+	"strings"
+	"time"
 
 	"github.com/skiffos/skiff-core/shell"
 	"github.com/urfave/cli/v2"
 )
 
+var idleStopArgs struct {
+	Timeout time.Duration
+	Signal  string
+}
+
+var shellArgs struct {
+	Session      string
+	Attach       string
+	List         bool
+	DetachKeys   string
+	SetupTimeout time.Duration
+}
+
+// buildShell builds the shell for the current user.
+func buildShell() (*shell.Shell, error) {
+	// Check the home directory
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	if currentUser.HomeDir == "" {
+		return nil, errors.New("Cannot determine home directory.")
+	}
+
+	return shell.NewShell(currentUser.HomeDir), nil
+}
+
+// shellExitError converts an error from the shell to an exit error.
+func shellExitError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// exit with the same status as the process in the container
+	var exitErr *shell.ExitError
+	if errors.As(err, &exitErr) {
+		return cli.Exit("", exitErr.Code)
+	}
+	return cli.NewExitError(err.Error(), 1)
+}
+
 // ShellCommands define the commands for "shell"
 var ShellCommands cli.Commands = []*cli.Command{
 	{
 		Name:  "shell",
 		Usage: "Runs skiff-core in shell mode.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "session",
+				Usage:       "Attach to the named persistent session, creating it if necessary. Only used for interactive logins without a command.",
+				Destination: &shellArgs.Session,
+				EnvVars:     []string{shell.SessionEnv},
+			},
+			&cli.StringFlag{
+				Name:        "attach",
+				Usage:       "Attach to an existing persistent session.",
+				Destination: &shellArgs.Attach,
+			},
+			&cli.BoolFlag{
+				Name:        "list",
+				Usage:       "List the running persistent sessions.",
+				Destination: &shellArgs.List,
+			},
+			&cli.DurationFlag{
+				Name:        "setup-timeout",
+				Usage:       "Max time to wait for container setup, zero to wait forever.",
+				Value:       time.Minute * 10,
+				Destination: &shellArgs.SetupTimeout,
+				EnvVars:     []string{"SKIFF_CORE_SETUP_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:        "detach-keys",
+				Usage:       "Key sequence to detach from a persistent session.",
+				Value:       shell.DefaultDetachKeys,
+				Destination: &shellArgs.DetachKeys,
+			},
+		},
 		Action: func(c *cli.Context) error {
-			// Check the home directory
-			currentUser, err := user.Current()
+			sh, err := buildShell()
 			if err != nil {
 				return err
 			}
+			sh.SetDetachKeys(shellArgs.DetachKeys)
+			sh.SetSetupTimeout(shellArgs.SetupTimeout)
 
-			if currentUser.HomeDir == "" {
-				return errors.New("Cannot determine home directory.")
+			if shellArgs.List {
+				sessions, err := sh.ListSessions()
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				for _, sess := range sessions {
+					fmt.Printf(
+						"%s\t%s\t%s\t%s\n",
+						sess.Name,
+						sess.Created.Format("2006-01-02 15:04:05"),
+						sess.ContainerId[:min(12, len(sess.ContainerId))],
+						strings.Join(sess.Cmd, " "),
+					)
+				}
+				return nil
 			}
 
-			sh := shell.NewShell(currentUser.HomeDir)
+			if shellArgs.Attach != "" {
+				return shellExitError(sh.AttachSession(shellArgs.Attach))
+			}
+
+			sh.SetSession(shellArgs.Session)
 			// cmd, if unset, defaults to config.UserShell
 			// arg 2, execWithShell, indicates the cmd should be run in user shell.
 			// ex: cmd={"rsync", "~/test", "remote:test"}, converts to:
 			// docker exec -it container-id /bin/sh -c 'rsync ~/test remote:test'
-			err = sh.Execute(globalFlags.Command, true)
+			return shellExitError(sh.Execute(globalFlags.Command, true))
+		},
+	},
+	{
+		Name:      shell.SessionServerCommand,
+		Usage:     "Runs the server for a persistent session.",
+		ArgsUsage: "<name>",
+		Hidden:    true,
+		Action: func(c *cli.Context) error {
+			sh, err := buildShell()
 			if err != nil {
+				return err
+			}
+			if err := sh.ServeSession(c.Args().First()); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		},
+	},
+	{
+		Name:      shell.IdleStopCommand,
+		Usage:     "Stops a container once it has no shell sessions for the timeout.",
+		ArgsUsage: "<container-id>",
+		Hidden:    true,
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "Time without sessions before stopping the container.",
+				Destination: &idleStopArgs.Timeout,
+			},
+			&cli.StringFlag{
+				Name:        "signal",
+				Usage:       "Signal to stop the container with.",
+				Destination: &idleStopArgs.Signal,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			sh, err := buildShell()
+			if err != nil {
+				return err
+			}
+			if err := sh.ServeIdleStop(c.Args().First(), idleStopArgs.Timeout, idleStopArgs.Signal); err != nil {
 				return cli.NewExitError(err.Error(), 1)
 			}
 			return nil
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/sshd"
+	"github.com/urfave/cli/v2"
+)
+
+var sshdArgs struct {
+	Listen string
+}
+
+// SshdCommands define the commands for "sshd"
+var SshdCommands cli.Commands = []*cli.Command{
+	{
+		Name:  "sshd",
+		Usage: "Runs the built-in SSH server which routes sessions directly to containers.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "listen",
+				Usage:       "Address to listen on, overrides the config.",
+				Destination: &sshdArgs.Listen,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := parseGlobalConfig()
+			if err != nil {
+				return err
+			}
+			if conf.Sshd == nil {
+				conf.Sshd = &config.ConfigSshd{}
+				conf.Sshd.FillDefaults()
+			}
+			if sshdArgs.Listen != "" {
+				conf.Sshd.Listen = sshdArgs.Listen
+			}
+
+			srv, err := sshd.NewServer(conf)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			if err := srv.ListenAndServe(conf.Sshd.Listen); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		},
+	},
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/web"
+	"github.com/urfave/cli/v2"
+)
+
+var webArgs struct {
+	Listen string
+}
+
+// WebCommands define the commands for "web"
+var WebCommands cli.Commands = []*cli.Command{
+	{
+		Name:  "web",
+		Usage: "Runs the local web terminal for container shells.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "listen",
+				Usage:       "Address to listen on, overrides the config.",
+				Destination: &webArgs.Listen,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			conf, err := parseGlobalConfig()
+			if err != nil {
+				return err
+			}
+			if conf.Web == nil {
+				conf.Web = &config.ConfigWeb{}
+				conf.Web.FillDefaults()
+			}
+			if webArgs.Listen != "" {
+				conf.Web.Listen = webArgs.Listen
+			}
+			if err := conf.Web.Validate(); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+
+			srv := web.NewServer(conf)
+			if err := srv.ListenAndServe(conf.Web.Listen); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		},
+	},
+}
@@ -58,6 +58,8 @@ func main() {
 	app.Commands = append(app.Commands, ShellCommands...)
 	app.Commands = append(app.Commands, SysInfoCommands...)
 	app.Commands = append(app.Commands, ScratchBuildCommands...)
+	app.Commands = append(app.Commands, SshdCommands...)
+	app.Commands = append(app.Commands, WebCommands...)
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
 			Name:        "config",
@@ -1,9 +1,19 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
 	"path"
+	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
+	units "github.com/docker/go-units"
 	"gopkg.in/yaml.v3"
 )
 
@@ -11,6 +21,107 @@ type Config struct {
 	Containers map[string]*ConfigContainer `json:"containers" yaml:"containers"`
 	Users      map[string]*ConfigUser      `json:"users" yaml:"users"`
 	Images     map[string]*ConfigImage     `json:"images,omitempty" yaml:"images,omitempty"`
+	// Audit configures the audit log of shell sessions.
+	Audit *ConfigAudit `json:"audit,omitempty" yaml:"audit,omitempty"`
+	// Sshd configures the built-in SSH server.
+	Sshd *ConfigSshd `json:"sshd,omitempty" yaml:"sshd,omitempty"`
+	// Web configures the web terminal.
+	Web *ConfigWeb `json:"web,omitempty" yaml:"web,omitempty"`
+}
+
+// ConfigWeb configures the web terminal (skiff-core web).
+type ConfigWeb struct {
+	// Listen is the address to listen on.
+	// Defaults to the local address 127.0.0.1:8022.
+	Listen string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	// AssetsDir is a directory containing xterm.js and xterm.css to serve.
+	// Defaults to DefaultWebAssetsDir if XtermURL is empty.
+	AssetsDir string `json:"assetsDir,omitempty" yaml:"assetsDir,omitempty"`
+	// XtermURL is the base path of the xterm.js package, used if AssetsDir is empty.
+	// Must be a path on the same origin, e.g. served by a reverse proxy.
+	XtermURL string `json:"xtermUrl,omitempty" yaml:"xtermUrl,omitempty"`
+}
+
+// FillDefaults fills the config with reasonable values.
+func (c *ConfigWeb) FillDefaults() {
+	if c.Listen == "" {
+		c.Listen = DefaultWebListen
+	}
+	if c.AssetsDir == "" && c.XtermURL == "" {
+		c.AssetsDir = DefaultWebAssetsDir
+	}
+}
+
+// Validate checks the web terminal config.
+func (c *ConfigWeb) Validate() error {
+	if c.XtermURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.XtermURL)
+	if err != nil {
+		return fmt.Errorf("invalid xtermUrl %q: %v", c.XtermURL, err)
+	}
+	if u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("invalid xtermUrl %q: must be a path on the same origin", c.XtermURL)
+	}
+	return nil
+}
+
+// ConfigSshd configures the built-in SSH server (skiff-core sshd).
+type ConfigSshd struct {
+	// Listen is the address to listen on.
+	Listen string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	// HostKeys is a list of paths to the host private keys.
+	// If the default key does not exist, an ed25519 key is generated.
+	HostKeys []string `json:"hostKeys,omitempty" yaml:"hostKeys,omitempty"`
+}
+
+// FillDefaults fills the config with reasonable values.
+func (c *ConfigSshd) FillDefaults() {
+	if c.Listen == "" {
+		c.Listen = DefaultSshdListen
+	}
+	if len(c.HostKeys) == 0 {
+		c.HostKeys = []string{DefaultSshdHostKey}
+	}
+}
+
+// ConfigAudit configures the JSON-lines audit log written by the shell.
+type ConfigAudit struct {
+	// Dir is the directory on the host to store the audit logs in.
+	// Each user has a sub-directory with their audit log.
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+	// MaxFileSize is the size in bytes at which the log is rotated.
+	MaxFileSize int64 `json:"maxFileSize,omitempty" yaml:"maxFileSize,omitempty"`
+	// MaxFiles is the number of rotated logs to keep.
+	MaxFiles int `json:"maxFiles,omitempty" yaml:"maxFiles,omitempty"`
+}
+
+// FillDefaults fills the config with reasonable values.
+func (c *ConfigAudit) FillDefaults() {
+	if c.Dir == "" {
+		c.Dir = DefaultAuditDir
+	}
+	if c.MaxFileSize == 0 {
+		c.MaxFileSize = DefaultAuditMaxFileSize
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = DefaultAuditMaxFiles
+	}
+}
+
+// UserDir returns the directory for the audit log of a user.
+func (c *ConfigAudit) UserDir(userName string) string {
+	return path.Join(c.Dir, userName)
+}
+
+// ToConfigUserShellAuditLog builds the audit log config for a user.
+func (c *ConfigAudit) ToConfigUserShellAuditLog(userName string) *ConfigUserShellAuditLog {
+	return &ConfigUserShellAuditLog{
+		Path:        path.Join(c.UserDir(userName), AuditLogFile),
+		MaxFileSize: c.MaxFileSize,
+		MaxFiles:    c.MaxFiles,
+	}
 }
 
 // FillDefaults fills the config with reasonable values where necessary.
@@ -23,6 +134,20 @@ func (c *Config) FillDefaults() {
 			img.Pull.FillDefaults()
 		}
 	}
+	if c.Audit != nil {
+		c.Audit.FillDefaults()
+	}
+	if c.Sshd != nil {
+		c.Sshd.FillDefaults()
+	}
+	if c.Web != nil {
+		c.Web.FillDefaults()
+	}
+	for _, user := range c.Users {
+		if user.RecordSessions != nil {
+			user.RecordSessions.FillDefaults()
+		}
+	}
 }
 
 // FillPrivateFields fills hidden fields on the config.
@@ -89,6 +214,29 @@ type ConfigContainer struct {
 	StartAfterCreate bool `json:"startAfterCreate,omitempty" yaml:"startAfterCreate,omitempty"`
 	// StopSignal contains the stop signal to use when stopping the container.
 	StopSignal string `json:"stopSignal,omitempty" yaml:"stopSignal,omitempty"`
+	// IdleTimeout stops the container when no shell sessions have used it for this duration.
+	// Go duration format, for example: 10m. Disabled if empty.
+	// The container is started again on demand by the next session.
+	IdleTimeout string `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	// AlwaysOn exempts the container from IdleTimeout.
+	AlwaysOn bool `json:"alwaysOn,omitempty" yaml:"alwaysOn,omitempty"`
+}
+
+// IdleTimeoutDuration parses the idle timeout.
+//
+// Returns 0 if idle shutdown is disabled.
+func (c *ConfigContainer) IdleTimeoutDuration() (time.Duration, error) {
+	if c.AlwaysOn || c.IdleTimeout == "" {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(c.IdleTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid idleTimeout %q: %v", c.IdleTimeout, err)
+	}
+	if dur <= 0 {
+		return 0, fmt.Errorf("invalid idleTimeout %q: must be positive", c.IdleTimeout)
+	}
+	return dur, nil
 }
 
 // ConfigContainerEnvironmentVariable configures an environment variable.
@@ -182,6 +330,11 @@ type ConfigImageBuild struct {
 	Root string `json:"root,omitempty" yaml:"root,omitempty"`
 	// Dockerfile controls the path to the Dockerfile inside the repository/source.
 	Dockerfile string `json:"dockerfile,omitempty" yaml:"dockerfile,omitempty"`
+	// DockerfileInline is the contents of the Dockerfile, instead of a file in the source.
+	// The source is optional if set.
+	DockerfileInline string `json:"dockerfileInline,omitempty" yaml:"dockerfileInline,omitempty"`
+	// Template indicates the Dockerfile is rendered as a Go template before building.
+	Template bool `json:"template,omitempty" yaml:"template,omitempty"`
 	// BuildArgs contains key/value build arguments to set in the Dockerfile.
 	BuildArgs map[string]*string `json:"buildArgs,omitempty" yaml:"buildArgs,omitempty"`
 	// PreserveIntermediate indicates we should preserve intermediate build containers.
@@ -192,6 +345,78 @@ type ConfigImageBuild struct {
 	ScratchBuild bool `json:"scratchBuild,omitempty" yaml:"scratchBuild,omitempty"`
 	// Squash indicates we should squash the results into a single layer before committing.
 	Squash bool `json:"squash,omitempty" yaml:"squash,omitempty"`
+	// BuildKit indicates we should build with BuildKit if the daemon supports it.
+	// Falls back to the classic builder otherwise.
+	BuildKit bool `json:"buildKit,omitempty" yaml:"buildKit,omitempty"`
+	// Secrets are available to RUN --mount=type=secret when building with BuildKit.
+	Secrets []*ConfigImageBuildSecret `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	// Git configures cloning git sources.
+	Git *ConfigImageBuildGit `json:"git,omitempty" yaml:"git,omitempty"`
+	// StripComponents removes leading path components when extracting archive sources.
+	StripComponents int `json:"stripComponents,omitempty" yaml:"stripComponents,omitempty"`
+	// Sha256 is the expected checksum of an archive source.
+	Sha256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	// Target is the stage to build in a multi-stage Dockerfile.
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+	// Labels are set on the image.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// Platform is the platform to build for, for example linux/arm64.
+	Platform string `json:"platform,omitempty" yaml:"platform,omitempty"`
+	// NetworkMode is the network mode for RUN instructions.
+	NetworkMode string `json:"networkMode,omitempty" yaml:"networkMode,omitempty"`
+	// ExtraHosts are added to /etc/hosts for RUN instructions as host:ip.
+	ExtraHosts []string `json:"extraHosts,omitempty" yaml:"extraHosts,omitempty"`
+	// CacheFrom are images to use as cache sources.
+	CacheFrom []string `json:"cacheFrom,omitempty" yaml:"cacheFrom,omitempty"`
+	// NoCache indicates we should not use the build cache.
+	NoCache bool `json:"noCache,omitempty" yaml:"noCache,omitempty"`
+	// PullParent indicates we should always pull newer versions of the base images.
+	PullParent bool `json:"pullParent,omitempty" yaml:"pullParent,omitempty"`
+	// ShmSize is the size of /dev/shm for RUN instructions, for example 128MiB.
+	ShmSize string `json:"shmSize,omitempty" yaml:"shmSize,omitempty"`
+	// Tags are additional tags for the image.
+	// Go templates with the fields Image, Repository, Commit and ShortCommit.
+	// Tags starting with : are added to the repository of the image.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// ReservedLabelPrefix is the prefix of the image labels set by skiff-core.
+const ReservedLabelPrefix = "org.skiffos.skiff-core."
+
+// platformPattern matches os/arch[/variant].
+var platformPattern = regexp.MustCompile(`^[a-z0-9_]+/[a-z0-9_]+(/[a-z0-9_]+)?$`)
+
+// buildKitNetworkModes are the network modes supported by BuildKit.
+var buildKitNetworkModes = map[string]bool{"": true, "default": true, "host": true, "none": true}
+
+// ShmSizeBytes parses the size of /dev/shm.
+//
+// Returns 0 if not set.
+func (b *ConfigImageBuild) ShmSizeBytes() (int64, error) {
+	if b.ShmSize == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(b.ShmSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shmSize %q: %v", b.ShmSize, err)
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid shmSize %q: must be positive", b.ShmSize)
+	}
+	return size, nil
+}
+
+// ParseTags parses the templates of the additional tags.
+func (b *ConfigImageBuild) ParseTags() ([]*template.Template, error) {
+	tmpls := make([]*template.Template, 0, len(b.Tags))
+	for i, tag := range b.Tags {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(tag)
+		if err != nil {
+			return nil, fmt.Errorf("tags[%d]: %v", i, err)
+		}
+		tmpls = append(tmpls, tmpl)
+	}
+	return tmpls, nil
 }
 
 // ImageName returns the imageName
@@ -211,12 +436,145 @@ func (b *ConfigImageBuild) FillDefaults() {
 	}
 }
 
+// Validate checks the build config.
+func (b *ConfigImageBuild) Validate() error {
+	if b.DockerfileInline != "" && b.Dockerfile != "" {
+		return errors.New("dockerfileInline cannot be used with dockerfile")
+	}
+	if b.ScratchBuild && (b.DockerfileInline != "" || b.Template) {
+		return errors.New("scratchBuild cannot be used with dockerfileInline or template")
+	}
+	if len(b.Secrets) != 0 && !b.BuildKit {
+		return errors.New("secrets require buildKit")
+	}
+	if b.BuildKit && b.ScratchBuild {
+		return errors.New("buildKit cannot be used with scratchBuild")
+	}
+	if b.BuildKit && b.Squash {
+		return errors.New("buildKit cannot be used with squash")
+	}
+	if b.BuildKit && b.ShmSize != "" {
+		return errors.New("buildKit cannot be used with shmSize")
+	}
+	if b.BuildKit && !buildKitNetworkModes[b.NetworkMode] {
+		return fmt.Errorf("buildKit does not support networkMode %q", b.NetworkMode)
+	}
+	if b.ScratchBuild &&
+		(b.Target != "" || len(b.Labels) != 0 || b.Platform != "" || b.NetworkMode != "" ||
+			len(b.ExtraHosts) != 0 || len(b.CacheFrom) != 0 || b.NoCache || b.PullParent ||
+			b.ShmSize != "" || len(b.Tags) != 0) {
+		return errors.New("scratchBuild cannot be used with the other build options")
+	}
+	if b.Platform != "" && !platformPattern.MatchString(b.Platform) {
+		return fmt.Errorf("invalid platform %q: expected os/arch[/variant]", b.Platform)
+	}
+	for key := range b.Labels {
+		if strings.HasPrefix(key, ReservedLabelPrefix) {
+			return fmt.Errorf("label %q uses the reserved prefix %s", key, ReservedLabelPrefix)
+		}
+	}
+	for _, host := range b.ExtraHosts {
+		if name, ip, ok := strings.Cut(host, ":"); !ok || name == "" || ip == "" {
+			return fmt.Errorf("invalid extraHosts entry %q: expected host:ip", host)
+		}
+	}
+	if _, err := b.ShmSizeBytes(); err != nil {
+		return err
+	}
+	if _, err := b.ParseTags(); err != nil {
+		return err
+	}
+	if b.StripComponents < 0 {
+		return errors.New("stripComponents cannot be negative")
+	}
+	if b.Sha256 != "" {
+		if sum, err := hex.DecodeString(b.Sha256); err != nil || len(sum) != sha256.Size {
+			return errors.New("sha256 must be 64 hex characters")
+		}
+	}
+	if b.Git != nil {
+		if err := b.Git.Validate(); err != nil {
+			return fmt.Errorf("git: %s", err.Error())
+		}
+	}
+	ids := make(map[string]bool)
+	for i, secret := range b.Secrets {
+		if err := secret.Validate(); err != nil {
+			return fmt.Errorf("secrets[%d]: %s", i, err.Error())
+		}
+		if ids[secret.ID] {
+			return fmt.Errorf("secrets[%d]: duplicate id %q", i, secret.ID)
+		}
+		ids[secret.ID] = true
+	}
+	return nil
+}
+
+// ConfigImageBuildGit configures cloning a git source.
+type ConfigImageBuildGit struct {
+	// Ref is the branch, tag or commit to check out.
+	// Defaults to the default branch of the remote.
+	Ref string `json:"ref,omitempty" yaml:"ref,omitempty"`
+	// Depth limits the history to clone, zero clones the full history.
+	// Ignored if Ref is a commit.
+	Depth int `json:"depth,omitempty" yaml:"depth,omitempty"`
+	// DisableSubmodules indicates we should not clone submodules.
+	DisableSubmodules bool `json:"disableSubmodules,omitempty" yaml:"disableSubmodules,omitempty"`
+	// SSHKey is the path to the private key to use for ssh URLs.
+	SSHKey string `json:"sshKey,omitempty" yaml:"sshKey,omitempty"`
+	// KnownHosts is the path to the known_hosts file to use for ssh URLs.
+	// Defaults to the known_hosts files of the user running setup.
+	KnownHosts string `json:"knownHosts,omitempty" yaml:"knownHosts,omitempty"`
+	// TokenFile is the path to a file containing the token to use for http URLs.
+	TokenFile string `json:"tokenFile,omitempty" yaml:"tokenFile,omitempty"`
+	// Username is the user name to send with the token.
+	// Defaults to "git".
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+}
+
+// Validate checks the git config.
+func (g *ConfigImageBuildGit) Validate() error {
+	if g.Depth < 0 {
+		return errors.New("depth cannot be negative")
+	}
+	if g.SSHKey != "" && g.TokenFile != "" {
+		return errors.New("only one of sshKey or tokenFile can be set")
+	}
+	if g.KnownHosts != "" && g.SSHKey == "" {
+		return errors.New("knownHosts requires sshKey")
+	}
+	return nil
+}
+
+// ConfigImageBuildSecret is a secret available to a BuildKit build.
+type ConfigImageBuildSecret struct {
+	// ID is the id used in the Dockerfile: RUN --mount=type=secret,id=<id>
+	ID string `json:"id" yaml:"id"`
+	// Src is the path to a file on the host containing the secret.
+	Src string `json:"src,omitempty" yaml:"src,omitempty"`
+	// Env is the environment variable of skiff-core containing the secret.
+	Env string `json:"env,omitempty" yaml:"env,omitempty"`
+}
+
+// Validate checks the secret config.
+func (s *ConfigImageBuildSecret) Validate() error {
+	if s.ID == "" {
+		return errors.New("id must be set")
+	}
+	if (s.Src == "") == (s.Env == "") {
+		return errors.New("exactly one of src or env must be set")
+	}
+	return nil
+}
+
 // ConfigUser is a user in the system.
 type ConfigUser struct {
 	// name is the name of the user
 	name string
-	// Container is the ID of the container for this user.
+	// Container is the ID of the default container for this user.
 	Container string `json:"container,omitempty" yaml:"container,omitempty"`
+	// Containers is a list of additional containers the user can select at login.
+	Containers []string `json:"containers,omitempty" yaml:"containers,omitempty"`
 	// Auth is the authentication config for the user.
 	Auth *ConfigUserAuth `json:"auth,omitempty" yaml:"auth,omitempty"`
 	// ContainerUser is the user to execute as inside the container.
@@ -227,6 +585,158 @@ type ConfigUser struct {
 	//
 	// Note: if this step fails the error is logged but ignored.
 	CreateContainerUser bool `json:"createContainerUser,omitempty" yaml:"createContainerUser,omitempty"`
+	// ForwardEnv is a list of patterns of environment variables to forward from the session.
+	// Supports glob patterns, for example: LC_* or MY_VAR
+	ForwardEnv []string `json:"forwardEnv,omitempty" yaml:"forwardEnv,omitempty"`
+	// Env is a list of additional environment variables in Key=Value form.
+	// Overrides any forwarded variables with the same name.
+	Env []string `json:"env,omitempty" yaml:"env,omitempty"`
+	// SSHAgent configures forwarding the SSH agent (ssh -A) into the container.
+	SSHAgent *ConfigUserSSHAgent `json:"sshAgent,omitempty" yaml:"sshAgent,omitempty"`
+	// RecordSessions enables recording interactive sessions in asciicast v2 format.
+	RecordSessions *ConfigUserRecordSessions `json:"recordSessions,omitempty" yaml:"recordSessions,omitempty"`
+	// Admin indicates the user administers the system.
+	// Admin users are shown troubleshooting help if setup fails.
+	Admin bool `json:"admin,omitempty" yaml:"admin,omitempty"`
+	// Rescue allows falling back to a shell on the host if the container is unavailable.
+	Rescue bool `json:"rescue,omitempty" yaml:"rescue,omitempty"`
+	// RescueShell is the host shell to use for rescue.
+	// Defaults to /bin/sh.
+	RescueShell []string `json:"rescueShell,omitempty" yaml:"rescueShell,omitempty"`
+	// Routes are rules routing commands from the SSH client.
+	// The first matching route is used.
+	Routes []*ConfigUserRoute `json:"routes,omitempty" yaml:"routes,omitempty"`
+	// Restrict restricts the commands the user can run.
+	// Checked before Routes.
+	Restrict *ConfigUserRestrict `json:"restrict,omitempty" yaml:"restrict,omitempty"`
+}
+
+// ConfigUserRestrict restricts the commands a user can run, for example for deploy keys.
+type ConfigUserRestrict struct {
+	// AllowCommands is a list of allowed command patterns.
+	// Each word of a pattern is a glob matched against the same argument.
+	// A final ** word matches any remaining arguments.
+	// Allowed commands are executed directly without the user shell.
+	AllowCommands []string `json:"allowCommands,omitempty" yaml:"allowCommands,omitempty"`
+	// ForceCommand replaces any command sent by the client.
+	// The original command is set in SSH_ORIGINAL_COMMAND.
+	ForceCommand string `json:"forceCommand,omitempty" yaml:"forceCommand,omitempty"`
+	// AllowTty allows interactive sessions: a tty, or the login shell.
+	AllowTty bool `json:"allowTty,omitempty" yaml:"allowTty,omitempty"`
+	// AllowSftp allows the sftp subsystem.
+	AllowSftp bool `json:"allowSftp,omitempty" yaml:"allowSftp,omitempty"`
+}
+
+// Validate checks the restrictions.
+func (r *ConfigUserRestrict) Validate() error {
+	for _, pattern := range r.AllowCommands {
+		words := strings.Fields(pattern)
+		if len(words) == 0 {
+			return errors.New("empty allowCommands pattern")
+		}
+		for _, word := range words {
+			if _, err := path.Match(word, ""); err != nil {
+				return fmt.Errorf("allowCommands pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigUserRecordSessions configures recording interactive sessions.
+type ConfigUserRecordSessions struct {
+	// Dir is the directory on the host to store recordings in.
+	// Each user has a sub-directory with their recordings.
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+	// RecordInput indicates we should also record the input.
+	// Note: this will record any passwords typed in the session.
+	RecordInput bool `json:"recordInput,omitempty" yaml:"recordInput,omitempty"`
+	// MaxFileSize is the max size of a recording in bytes.
+	MaxFileSize int64 `json:"maxFileSize,omitempty" yaml:"maxFileSize,omitempty"`
+	// MaxFiles is the max number of recordings to keep for the user.
+	// The oldest recordings are removed first.
+	MaxFiles int `json:"maxFiles,omitempty" yaml:"maxFiles,omitempty"`
+}
+
+// FillDefaults fills the config with reasonable values.
+func (c *ConfigUserRecordSessions) FillDefaults() {
+	if c.Dir == "" {
+		c.Dir = DefaultRecordSessionsDir
+	}
+	if c.MaxFileSize == 0 {
+		c.MaxFileSize = DefaultRecordSessionsMaxFileSize
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = DefaultRecordSessionsMaxFiles
+	}
+}
+
+// ConfigUserSSHAgent configures forwarding the SSH agent into the container.
+//
+// A socket is created for each session in HostDir which relays to the agent.
+// HostDir must be bind-mounted into the container at ContainerDir.
+type ConfigUserSSHAgent struct {
+	// HostDir is the directory on the host to create the sockets in.
+	HostDir string `json:"hostDir" yaml:"hostDir"`
+	// ContainerDir is the path HostDir is mounted at in the container.
+	// Defaults to HostDir.
+	ContainerDir string `json:"containerDir,omitempty" yaml:"containerDir,omitempty"`
+}
+
+// ConfigUserRoute is a rule routing a command from the SSH client.
+//
+// At least one of Match and Argv0 must be set. If both are set, both must match.
+type ConfigUserRoute struct {
+	// Match is a regular expression matched against the full command.
+	Match string `json:"match,omitempty" yaml:"match,omitempty"`
+	// Argv0 matches the base name of the first word of the command.
+	Argv0 string `json:"argv0,omitempty" yaml:"argv0,omitempty"`
+	// Command replaces the command.
+	// Expands $0 to the full command and $1 ... to the groups of Match.
+	// If only Argv0 is set, $1 expands to the arguments after the first word.
+	Command string `json:"command,omitempty" yaml:"command,omitempty"`
+	// User is the container user to run the command as.
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	// Container is the container to run the command in.
+	// Must be the default container or in the user's Containers.
+	Container string `json:"container,omitempty" yaml:"container,omitempty"`
+	// Host runs the command on the host as the host user.
+	Host bool `json:"host,omitempty" yaml:"host,omitempty"`
+	// Reject rejects the command.
+	Reject bool `json:"reject,omitempty" yaml:"reject,omitempty"`
+	// Message is printed when the command is rejected.
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+// Validate checks the route.
+//
+// allowedContainers is the list of containers the user can select.
+func (r *ConfigUserRoute) Validate(allowedContainers []string) error {
+	if r.Match == "" && r.Argv0 == "" {
+		return errors.New("route must set match or argv0")
+	}
+	if r.Match != "" {
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("route match %q: %v", r.Match, err)
+		}
+	}
+	if r.Host && (r.Container != "" || r.User != "") {
+		return errors.New("host route cannot set container or user")
+	}
+	if r.Container != "" {
+		name := "/" + strings.TrimPrefix(r.Container, "/")
+		found := false
+		for _, allowed := range allowedContainers {
+			if allowed == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("route container %s is not allowed for the user", r.Container)
+		}
+	}
+	return nil
 }
 
 // Name returns the name of the user.
@@ -234,13 +744,61 @@ func (u *ConfigUser) Name() string {
 	return u.name
 }
 
+// RecordSessionsDir returns the directory to store the user's recordings in.
+func (u *ConfigUser) RecordSessionsDir() string {
+	if u.RecordSessions == nil {
+		return ""
+	}
+	return path.Join(u.RecordSessions.Dir, u.name)
+}
+
+// AllowedContainers returns the default container followed by the additional
+// containers, without duplicates.
+func (u *ConfigUser) AllowedContainers() []string {
+	var res []string
+	seen := make(map[string]struct{})
+	for _, name := range append([]string{u.Container}, u.Containers...) {
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		res = append(res, name)
+	}
+	return res
+}
+
 // ToConfigUserShell builds a ConfigUserShell from the ConfigUser.
-func (u *ConfigUser) ToConfigUserShell(containerId string) *ConfigUserShell {
-	return &ConfigUserShell{
-		ContainerId: containerId,
+//
+// containerIds maps the container names from AllowedContainers to IDs.
+func (u *ConfigUser) ToConfigUserShell(containerIds map[string]string) *ConfigUserShell {
+	res := &ConfigUserShell{
+		ContainerId: containerIds[u.Container],
 		User:        u.ContainerUser,
 		Shell:       u.ContainerShell,
+		Containers:  make(map[string]*ConfigUserShellContainer),
+		ForwardEnv:  u.ForwardEnv,
+		Env:         u.Env,
+		SSHAgent:    u.SSHAgent,
+		Admin:       u.Admin,
+		Rescue:      u.Rescue,
+		RescueShell: u.RescueShell,
+		Routes:      u.Routes,
+		Restrict:    u.Restrict,
 	}
+	if u.RecordSessions != nil {
+		rec := *u.RecordSessions
+		rec.Dir = u.RecordSessionsDir()
+		res.RecordSessions = &rec
+	}
+	for _, name := range u.AllowedContainers() {
+		if id, ok := containerIds[name]; ok {
+			res.Containers[strings.TrimPrefix(name, "/")] = &ConfigUserShellContainer{Id: id}
+		}
+	}
+	return res
 }
 
 // ConfigUserAuth is the user authentication configuration.
@@ -257,13 +815,104 @@ type ConfigUserAuth struct {
 	AllowEmptyPassword bool `json:"allowEmptyPassword,omitempty" yaml:"allowEmptyPassword,omitempty"`
 	// Locked indicates the user should be locked.
 	Locked bool `json:"locked,omitempty" yaml:"locked,omitempty"`
+	// Tokens are access tokens for the web terminal.
+	// Accepted in place of the password.
+	Tokens []string `json:"tokens,omitempty" yaml:"tokens,omitempty"`
+}
+
+// CheckPassword checks a password for the built-in servers.
+//
+// Uses the same rules as setup: an empty password is only allowed with AllowEmptyPassword.
+func (a *ConfigUserAuth) CheckPassword(password string) bool {
+	if a.Locked {
+		return false
+	}
+	if a.Password == "" {
+		return a.AllowEmptyPassword && password == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(a.Password), []byte(password)) == 1
+}
+
+// CheckToken checks an access token.
+func (a *ConfigUserAuth) CheckToken(token string) bool {
+	if a.Locked || token == "" {
+		return false
+	}
+	var ok bool
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
 }
 
 // ConfigUserShell is the configuration file loaded from the users' home directory.
+//
+// Setup writes the file without a ContainerId while the containers are pending.
 type ConfigUserShell struct {
 	ContainerId string   `json:"containerId" yaml:"containerId"`
 	User        string   `json:"user,omitempty" yaml:"user,omitempty"`
 	Shell       []string `json:"shell,omitempty" yaml:"shell,omitempty"`
+	// Containers contains every container the user is allowed to select, by name.
+	// The default container (ContainerId) is also included.
+	Containers map[string]*ConfigUserShellContainer `json:"containers,omitempty" yaml:"containers,omitempty"`
+	// ForwardEnv is a list of patterns of additional environment variables to forward.
+	ForwardEnv []string `json:"forwardEnv,omitempty" yaml:"forwardEnv,omitempty"`
+	// Env is a list of environment variables to set in Key=Value form.
+	Env []string `json:"env,omitempty" yaml:"env,omitempty"`
+	// SSHAgent configures forwarding the SSH agent into the container.
+	SSHAgent *ConfigUserSSHAgent `json:"sshAgent,omitempty" yaml:"sshAgent,omitempty"`
+	// RecordSessions configures recording interactive sessions.
+	// Dir is the user's recording directory.
+	RecordSessions *ConfigUserRecordSessions `json:"recordSessions,omitempty" yaml:"recordSessions,omitempty"`
+	// AuditLog configures the audit log of sessions.
+	AuditLog *ConfigUserShellAuditLog `json:"auditLog,omitempty" yaml:"auditLog,omitempty"`
+	// Admin indicates the user administers the system.
+	Admin bool `json:"admin,omitempty" yaml:"admin,omitempty"`
+	// Rescue allows falling back to a shell on the host.
+	Rescue bool `json:"rescue,omitempty" yaml:"rescue,omitempty"`
+	// RescueShell is the host shell to use for rescue.
+	RescueShell []string `json:"rescueShell,omitempty" yaml:"rescueShell,omitempty"`
+	// Routes are rules routing commands from the SSH client.
+	Routes []*ConfigUserRoute `json:"routes,omitempty" yaml:"routes,omitempty"`
+	// Restrict restricts the commands the user can run.
+	Restrict *ConfigUserRestrict `json:"restrict,omitempty" yaml:"restrict,omitempty"`
+}
+
+// ConfigUserShellAuditLog configures the audit log in the user shell.
+type ConfigUserShellAuditLog struct {
+	// Path is the path to the log file.
+	Path string `json:"path" yaml:"path"`
+	// MaxFileSize is the size in bytes at which the log is rotated.
+	MaxFileSize int64 `json:"maxFileSize,omitempty" yaml:"maxFileSize,omitempty"`
+	// MaxFiles is the number of rotated logs to keep.
+	MaxFiles int `json:"maxFiles,omitempty" yaml:"maxFiles,omitempty"`
+}
+
+// ConfigUserShellContainer is a container the user can select in the shell.
+type ConfigUserShellContainer struct {
+	Id string `json:"id" yaml:"id"`
+	// IdleTimeout is the idle timeout of the container, if idle shutdown is enabled.
+	IdleTimeout string `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	// StopSignal is the signal to use when stopping the idle container.
+	StopSignal string `json:"stopSignal,omitempty" yaml:"stopSignal,omitempty"`
+}
+
+// FillContainerConfigs fills the settings of Containers from the container configs.
+//
+// getConfig returns the config of a container by name, or nil.
+func (s *ConfigUserShell) FillContainerConfigs(getConfig func(name string) *ConfigContainer) {
+	for name, ctr := range s.Containers {
+		ctrConf := getConfig(name)
+		if ctrConf == nil {
+			continue
+		}
+		if idleTimeout, _ := ctrConf.IdleTimeoutDuration(); idleTimeout != 0 {
+			ctr.IdleTimeout = idleTimeout.String()
+			ctr.StopSignal = ctrConf.StopSignal
+		}
+	}
 }
 
 // Marshal encodes the user shell config as yaml.
@@ -3,5 +3,45 @@ package config
 // UserConfigFile is the name of the config file in the home directory
 var UserConfigFile string = ".skiff-core.yaml"
 
+// UserAdminConfigDir is the directory with the copies of the user configs owned by root.
+// Settings granting access to the host, like rescue, are read from here.
+var UserAdminConfigDir string = "/etc/skiff-core/users"
+
 // UserLogFile is the name of the log file in the home directory
 var UserLogFile string = ".skiff-core-setup.log"
+
+// DefaultRecordSessionsDir is the default directory for session recordings.
+var DefaultRecordSessionsDir string = "/var/log/skiff-core/sessions"
+
+// DefaultRecordSessionsMaxFileSize is the default max size of a recording.
+var DefaultRecordSessionsMaxFileSize int64 = 64 * 1024 * 1024
+
+// DefaultRecordSessionsMaxFiles is the default number of recordings to keep per user.
+var DefaultRecordSessionsMaxFiles int = 100
+
+// AuditLogFile is the name of the audit log file in the user's audit dir
+var AuditLogFile string = "audit.jsonl"
+
+// DefaultAuditDir is the default directory for audit logs.
+var DefaultAuditDir string = "/var/log/skiff-core/audit"
+
+// DefaultAuditMaxFileSize is the default size at which the audit log is rotated.
+var DefaultAuditMaxFileSize int64 = 16 * 1024 * 1024
+
+// DefaultAuditMaxFiles is the default number of rotated audit logs to keep.
+var DefaultAuditMaxFiles int = 5
+
+// IdleDir is the directory tracking the shell sessions of containers with an idle timeout.
+var IdleDir string = "/run/skiff-core/idle"
+
+// DefaultSshdListen is the default listen address of the built-in SSH server.
+var DefaultSshdListen string = ":2222"
+
+// DefaultSshdHostKey is the default host key of the built-in SSH server.
+var DefaultSshdHostKey string = "/etc/skiff-core/ssh_host_ed25519_key"
+
+// DefaultWebListen is the default listen address of the web terminal.
+var DefaultWebListen string = "127.0.0.1:8022"
+
+// DefaultWebAssetsDir is the default directory containing xterm.js and xterm.css.
+var DefaultWebAssetsDir string = "/usr/share/skiff-core/xterm"
@@ -0,0 +1,94 @@
+package grsync
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/command/image/build"
+	"github.com/moby/patternmatcher"
+)
+
+// rsyncPatternEscaper escapes the wildcard characters of rsync patterns.
+var rsyncPatternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
+
+// dockerignoreMatcher loads the .dockerignore patterns of a directory.
+//
+// Like the docker CLI, the .dockerignore and the Dockerfile are never excluded.
+func dockerignoreMatcher(dir, dockerfile string) (*patternmatcher.PatternMatcher, error) {
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	excludes, err := build.ReadDockerignore(dir)
+	if err != nil {
+		return nil, err
+	}
+	excludes = build.TrimBuildFilesFromExcludes(excludes, dockerfile, false)
+	return patternmatcher.New(excludes)
+}
+
+// writeDockerignoreExcludes writes the paths excluded by the .dockerignore in
+// the source to a temporary file for --exclude-from.
+//
+// The .dockerignore patterns are matched in Go and each excluded path is
+// written as an anchored rsync pattern. Returns the path to the file.
+func writeDockerignoreExcludes(source, dockerfile string) (string, error) {
+	root := filepath.Clean(source)
+	// a source without a trailing slash is the top dir of the transfer.
+	var prefix string
+	if !strings.HasSuffix(source, "/") {
+		prefix = "/" + filepath.Base(root)
+	}
+
+	pm, err := dockerignoreMatcher(root, dockerfile)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "grsync-exclude-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	err = filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		excluded, err := pm.MatchesOrParentMatches(relPath)
+		if err != nil || !excluded {
+			return err
+		}
+		if info.IsDir() {
+			// rsync does not descend into excluded dirs, so with exception
+			// patterns the excluded contents are listed instead.
+			if pm.Exclusions() {
+				return nil
+			}
+			_, err = w.WriteString(prefix + "/" + rsyncPatternEscaper.Replace(relPath) + "/\n")
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		_, err = w.WriteString(prefix + "/" + rsyncPatternEscaper.Replace(relPath) + "\n")
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,384 @@
+package grsync
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+)
+
+// errNativeUnsupported is returned for options the native sync does not support.
+var errNativeUnsupported = errors.New("option not supported without the rsync binary")
+
+// syncModeMask is the part of the mode preserved by the native sync.
+const syncModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// nativeSync copies a directory tree without the rsync binary.
+//
+// Supports the options used for local copies: archive mode, recursion,
+// symlinks, permissions, times, owner and group (as root), delete and
+// DockerIgnore. Regular files with the same size and mtime in the
+// destination are skipped, like the rsync quick check.
+type nativeSync struct {
+	source      string
+	destination string
+	options     RsyncOptions
+
+	// excludes matches the paths excluded by DockerIgnore.
+	excludes *patternmatcher.PatternMatcher
+	// dirs are the directories to set the attributes of after copying.
+	dirs []syncEntry
+}
+
+// syncEntry is a file in the source tree.
+type syncEntry struct {
+	relPath string
+	info    os.FileInfo
+}
+
+// checkNativeOptions checks the options are supported by the native sync.
+func checkNativeOptions(options RsyncOptions) error {
+	if options.DryRun || options.Checksum || options.Relative || options.CopyLinks ||
+		options.HardLinks || options.ACLs || options.XAttrs || options.RemoveSourceFiles ||
+		options.Update || options.Existing || options.IgnoreExisting ||
+		len(options.Include) != 0 || len(options.Exclude) != 0 || options.Filter != "" ||
+		options.Chown != "" || options.CHMOD != 0 || options.LinkDest != "" ||
+		options.CopyDest != "" || options.CompareDest != "" {
+		return errNativeUnsupported
+	}
+	return nil
+}
+
+// newNativeSync builds a native sync.
+//
+// Like rsync, a source without a trailing slash is copied into a directory
+// with the same name in the destination.
+func newNativeSync(source, destination string, options RsyncOptions) *nativeSync {
+	if !strings.HasSuffix(source, "/") {
+		destination = filepath.Join(destination, filepath.Base(source))
+	}
+	return &nativeSync{
+		source:      filepath.Clean(source),
+		destination: filepath.Clean(destination),
+		options:     options,
+	}
+}
+
+// preserve* check which attributes are preserved.
+func (s *nativeSync) preservePerms() bool {
+	return (s.options.Perms || s.options.Archive) && !s.options.NoPerms
+}
+
+func (s *nativeSync) preserveTimes() bool {
+	return (s.options.Times || s.options.Archive) && !s.options.NoTimes
+}
+
+func (s *nativeSync) preserveLinks() bool {
+	return s.options.Links || s.options.Archive
+}
+
+func (s *nativeSync) preserveOwner() bool {
+	return os.Geteuid() == 0 &&
+		((s.options.Owner || s.options.Archive) && !s.options.NoOwner ||
+			(s.options.Group || s.options.Archive) && !s.options.NoGroup)
+}
+
+// loadExcludes loads the .dockerignore patterns of the source.
+func (s *nativeSync) loadExcludes() error {
+	if !s.options.DockerIgnore {
+		return nil
+	}
+	var err error
+	s.excludes, err = dockerignoreMatcher(s.source, s.options.Dockerfile)
+	return err
+}
+
+// excluded checks if the relative path is excluded by DockerIgnore.
+func (s *nativeSync) excluded(relPath string) (bool, error) {
+	if s.excludes == nil {
+		return false, nil
+	}
+	return s.excludes.MatchesOrParentMatches(filepath.ToSlash(relPath))
+}
+
+// walk lists the entries of the source tree.
+func (s *nativeSync) walk() ([]syncEntry, error) {
+	var entries []syncEntry
+	recursive := s.options.Recursive || s.options.Archive
+	err := filepath.Walk(s.source, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(s.source, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath != "." {
+			excluded, err := s.excluded(relPath)
+			if err != nil {
+				return err
+			}
+			if excluded {
+				if info.IsDir() && !s.excludes.Exclusions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		entries = append(entries, syncEntry{relPath: relPath, info: info})
+		if info.IsDir() && relPath != "." && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// run copies the tree, calling onEntry after each entry is processed.
+func (s *nativeSync) run(onEntry func(relPath string, copied bool, remain, total int)) error {
+	if err := checkNativeOptions(s.options); err != nil {
+		return err
+	}
+	st, err := os.Stat(s.source)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return errors.New("native sync requires a directory source: " + s.source)
+	}
+	if err := s.loadExcludes(); err != nil {
+		return err
+	}
+
+	entries, err := s.walk()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.destination, 0755); err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		copied, err := s.syncEntry(entry)
+		if err != nil {
+			return err
+		}
+		if onEntry != nil {
+			onEntry(entry.relPath, copied, len(entries)-i-1, len(entries))
+		}
+	}
+
+	if s.options.Delete || s.options.DeleteBefore || s.options.DeleteDuring ||
+		s.options.DeleteDelay || s.options.DeleteAfter {
+		if err := s.deleteExtraneous(entries); err != nil {
+			return err
+		}
+	}
+
+	// set directory attributes last: the contents change the mtime.
+	for i := len(s.dirs) - 1; i >= 0; i-- {
+		if err := s.setAttrs(filepath.Join(s.destination, s.dirs[i].relPath), s.dirs[i].info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncEntry copies a single entry if it changed.
+//
+// Returns if the entry was copied.
+func (s *nativeSync) syncEntry(entry syncEntry) (bool, error) {
+	destPath := filepath.Join(s.destination, entry.relPath)
+	mode := entry.info.Mode()
+	// the parent may be excluded while the entry is re-included.
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return false, err
+	}
+	destInfo, destErr := os.Lstat(destPath)
+
+	switch {
+	case mode.IsDir():
+		if destErr == nil && !destInfo.IsDir() {
+			if err := os.Remove(destPath); err != nil {
+				return false, err
+			}
+			destErr = os.ErrNotExist
+		}
+		if destErr != nil {
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				return false, err
+			}
+		}
+		s.dirs = append(s.dirs, entry)
+		return destErr != nil, nil
+	case mode&os.ModeSymlink != 0:
+		if !s.preserveLinks() {
+			return false, nil
+		}
+		target, err := os.Readlink(filepath.Join(s.source, entry.relPath))
+		if err != nil {
+			return false, err
+		}
+		if destErr == nil && destInfo.Mode()&os.ModeSymlink != 0 {
+			if destTarget, err := os.Readlink(destPath); err == nil && destTarget == target {
+				return false, nil
+			}
+		}
+		if err := removeExisting(destPath, destInfo, destErr); err != nil {
+			return false, err
+		}
+		if err := os.Symlink(target, destPath); err != nil {
+			return false, err
+		}
+		return true, s.setOwner(destPath, entry.info)
+	case mode.IsRegular():
+		if destErr == nil && destInfo.Mode().IsRegular() &&
+			destInfo.Size() == entry.info.Size() &&
+			(!s.preserveTimes() || destInfo.ModTime().Equal(entry.info.ModTime())) {
+			// the contents are unchanged, update the attributes only.
+			return false, s.setAttrs(destPath, entry.info)
+		}
+		if err := s.copyFile(filepath.Join(s.source, entry.relPath), destPath, destInfo, destErr); err != nil {
+			return false, err
+		}
+		return true, s.setAttrs(destPath, entry.info)
+	default:
+		// devices, sockets and pipes are skipped.
+		return false, nil
+	}
+}
+
+// removeExisting removes an existing entry which has a different type.
+func removeExisting(destPath string, destInfo os.FileInfo, destErr error) error {
+	if destErr != nil {
+		return nil
+	}
+	if destInfo.IsDir() {
+		return os.RemoveAll(destPath)
+	}
+	return os.Remove(destPath)
+}
+
+// copyFile copies a regular file to a temporary file and renames it into place.
+func (s *nativeSync) copyFile(srcPath, destPath string, destInfo os.FileInfo, destErr error) error {
+	if destErr == nil && destInfo.IsDir() {
+		if err := os.RemoveAll(destPath); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(destPath), "."+filepath.Base(destPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), destPath)
+}
+
+// setAttrs sets the mode, owner and mtime of a file or directory.
+func (s *nativeSync) setAttrs(destPath string, info os.FileInfo) error {
+	if err := s.setOwner(destPath, info); err != nil {
+		return err
+	}
+	if s.preservePerms() {
+		if err := os.Chmod(destPath, info.Mode()&syncModeMask); err != nil {
+			return err
+		}
+	}
+	if s.preserveTimes() && !(info.IsDir() && s.options.OmitDirTimes) {
+		if err := os.Chtimes(destPath, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOwner sets the owner and group of an entry if preserved.
+func (s *nativeSync) setOwner(destPath string, info os.FileInfo) error {
+	if !s.preserveOwner() {
+		return nil
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return nil
+	}
+	if s.options.NoOwner || !(s.options.Owner || s.options.Archive) {
+		uid = -1
+	}
+	if s.options.NoGroup || !(s.options.Group || s.options.Archive) {
+		gid = -1
+	}
+	return os.Lchown(destPath, uid, gid)
+}
+
+// deleteExtraneous removes entries in the destination which are not in the source.
+//
+// Like rsync, excluded entries are kept unless DeleteExcluded is set.
+func (s *nativeSync) deleteExtraneous(entries []syncEntry) error {
+	keep := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		for p := entry.relPath; !keep[p]; p = filepath.Dir(p) {
+			keep[p] = true
+		}
+	}
+	return filepath.Walk(s.destination, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(s.destination, filePath)
+		if err != nil {
+			return err
+		}
+		if keep[relPath] {
+			return nil
+		}
+		if !s.options.DeleteExcluded {
+			excluded, err := s.excluded(relPath)
+			if err != nil {
+				return err
+			}
+			if excluded {
+				return nil
+			}
+		}
+		if err := os.RemoveAll(filePath); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// runNative runs the native sync and updates the task state and log.
+func (t *Task) runNative() error {
+	const maxPercents = float64(100)
+
+	s := newNativeSync(t.rsync.Source, t.rsync.Destination, t.rsync.options)
+	return s.run(func(relPath string, copied bool, remain, total int) {
+		t.state.Remain, t.state.Total = remain, total
+		t.state.Progress = float64(total-remain) / math.Max(float64(total), 1) * maxPercents
+		if copied && t.rsync.options.Verbose {
+			t.log.Stdout += relPath + "\n"
+		}
+	})
+}
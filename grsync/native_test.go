@@ -0,0 +1,101 @@
+package grsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, dir, name, data string, mode os.FileMode) {
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(p, []byte(data), mode); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestNativeSync(t *testing.T) {
+	src, dest := t.TempDir(), t.TempDir()
+	writeTestFile(t, src, "Dockerfile", "FROM alpine\n", 0644)
+	writeTestFile(t, src, ".dockerignore", "build\nDockerfile\n*.log\n!keep.log\n", 0644)
+	writeTestFile(t, src, "bin/run.sh", "#!/bin/sh\n", 0755)
+	writeTestFile(t, src, "build/out", "ignored\n", 0644)
+	writeTestFile(t, src, "debug.log", "ignored\n", 0644)
+	writeTestFile(t, src, "keep.log", "kept\n", 0644)
+	if err := os.Symlink("bin/run.sh", filepath.Join(src, "run")); err != nil {
+		t.Fatal(err.Error())
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "bin/run.sh"), mtime, mtime); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// extraneous files are removed, excluded files are kept.
+	writeTestFile(t, dest, "stale", "stale\n", 0644)
+	writeTestFile(t, dest, "build/cached", "cached\n", 0644)
+
+	options := RsyncOptions{Archive: true, Delete: true, DockerIgnore: true}
+	if err := newNativeSync(src+"/", dest, options).run(nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, name := range []string{"Dockerfile", ".dockerignore", "bin/run.sh", "keep.log", "build/cached"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); err != nil {
+			t.Fatalf("expected %s to exist: %v", name, err)
+		}
+	}
+	for _, name := range []string{"stale", "build/out", "debug.log"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to not exist", name)
+		}
+	}
+
+	st, err := os.Stat(filepath.Join(dest, "bin/run.sh"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if st.Mode().Perm() != 0755 {
+		t.Fatalf("expected mode 0755 but got %v", st.Mode())
+	}
+	if !st.ModTime().Equal(mtime) {
+		t.Fatalf("expected mtime %v but got %v", mtime, st.ModTime())
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "run")); err != nil || target != "bin/run.sh" {
+		t.Fatalf("expected symlink to bin/run.sh: %q %v", target, err)
+	}
+
+	// unchanged files are not copied again.
+	var copied []string
+	onEntry := func(relPath string, didCopy bool, remain, total int) {
+		if didCopy {
+			copied = append(copied, relPath)
+		}
+	}
+	writeTestFile(t, src, "keep.log", "changed\n", 0644)
+	if err := newNativeSync(src+"/", dest, options).run(onEntry); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(copied) != 1 || copied[0] != "keep.log" {
+		t.Fatalf("expected only keep.log to be copied but got %v", copied)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "keep.log"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(data) != "changed\n" {
+		t.Fatalf("unexpected contents: %q", string(data))
+	}
+}
+
+func TestNativeSyncUnsupported(t *testing.T) {
+	err := newNativeSync(t.TempDir()+"/", t.TempDir(), RsyncOptions{Exclude: []string{"*.o"}}).run(nil)
+	if err != errNativeUnsupported {
+		t.Fatalf("expected errNativeUnsupported but got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package grsync
+
+import (
+	"os"
+)
+
+// fileOwner returns the owner and group of a file.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package grsync
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the owner and group of a file.
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
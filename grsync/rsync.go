@@ -1,6 +1,7 @@
 package grsync
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -14,6 +15,8 @@ type Rsync struct {
 	Source      string
 	Destination string
 
+	options RsyncOptions
+	// cmd is nil if the rsync binary is not installed.
 	cmd *exec.Cmd
 }
 
@@ -189,6 +192,10 @@ type RsyncOptions struct {
 	Exclude []string
 	// Include --include="", include remote paths.
 	Include []string
+	// DockerIgnore excludes the paths matched by the .dockerignore in the source.
+	DockerIgnore bool
+	// Dockerfile is never excluded by DockerIgnore; by default just `Dockerfile`
+	Dockerfile string
 	// Filter --filter="", include filter rule.
 	Filter string
 	// Chown --chown="", chown on receipt.
@@ -203,26 +210,57 @@ type RsyncOptions struct {
 	OutFormat bool
 }
 
+// errNoBinary is returned for the pipes when using the native sync.
+var errNoBinary = errors.New("rsync binary not found, using the native sync")
+
+// Native checks if the native sync is used as the rsync binary is not installed.
+func (r Rsync) Native() bool {
+	return r.cmd == nil
+}
+
 // StdoutPipe returns a pipe that will be connected to the command's
 // standard output when the command starts.
 func (r Rsync) StdoutPipe() (io.ReadCloser, error) {
+	if r.cmd == nil {
+		return nil, errNoBinary
+	}
 	return r.cmd.StdoutPipe()
 }
 
 // StderrPipe returns a pipe that will be connected to the command's
 // standard error when the command starts.
 func (r Rsync) StderrPipe() (io.ReadCloser, error) {
+	if r.cmd == nil {
+		return nil, errNoBinary
+	}
 	return r.cmd.StderrPipe()
 }
 
 // Run start rsync task
 func (r Rsync) Run() error {
+	if r.cmd == nil {
+		return newNativeSync(r.Source, r.Destination, r.options).run(nil)
+	}
+
 	if !isExist(r.Destination) {
 		if err := createDir(r.Destination); err != nil {
 			return err
 		}
 	}
 
+	if r.options.DockerIgnore {
+		excludeFrom, err := writeDockerignoreExcludes(r.Source, r.options.Dockerfile)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(excludeFrom)
+		// the exclude rules must precede the source and destination.
+		n := len(r.cmd.Args) - 2
+		args := append([]string{}, r.cmd.Args[:n]...)
+		args = append(args, "--exclude-from="+excludeFrom)
+		r.cmd.Args = append(args, r.cmd.Args[n:]...)
+	}
+
 	if err := r.cmd.Start(); err != nil {
 		return err
 	}
@@ -231,6 +269,9 @@ func (r Rsync) Run() error {
 }
 
 // NewRsync returns task with described options
+//
+// Falls back to a native sync of local directories if the rsync binary is
+// not installed, which supports a subset of the options.
 func NewRsync(source, destination string, options RsyncOptions) *Rsync {
 	arguments := append(getArguments(options), source, destination)
 
@@ -239,11 +280,15 @@ func NewRsync(source, destination string, options RsyncOptions) *Rsync {
 		binaryPath = options.RsyncBinaryPath
 	}
 
-	return &Rsync{
+	r := &Rsync{
 		Source:      source,
 		Destination: destination,
-		cmd:         exec.Command(binaryPath, arguments...),
+		options:     options,
+	}
+	if _, err := exec.LookPath(binaryPath); err == nil {
+		r.cmd = exec.Command(binaryPath, arguments...)
 	}
+	return r
 }
 
 func getArguments(options RsyncOptions) []string {
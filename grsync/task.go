@@ -46,6 +46,10 @@ func (t Task) Log() Log {
 
 // Run starts rsync process with options
 func (t *Task) Run() error {
+	if t.rsync.Native() {
+		return t.runNative()
+	}
+
 	stderr, err := t.rsync.StderrPipe()
 	if err != nil {
 		return err
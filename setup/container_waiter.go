@@ -2,11 +2,14 @@ package setup
 
 import (
 	"io"
+
+	"github.com/skiffos/skiff-core/config"
 )
 
 // ContainerWaiter waits for a container to be ready.
 type ContainerWaiter interface {
 	CheckHasContainer(name string) bool
+	GetContainerConfig(name string) *config.ConfigContainer
 	WaitForContainer(name string, logOut io.Writer) (string, error)
 	ExecCmdContainer(containerID, userID string, stdIn io.Reader, stdOut, stdErr io.Writer, cmd string, args ...string) error
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/docker/docker/api/types"
 	dockerclient "github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/builder"
 	"github.com/skiffos/skiff-core/config"
 	"github.com/skiffos/skiff-core/util/execcmd"
 )
@@ -20,6 +21,10 @@ type Setup struct {
 	imageSetups     map[string]*ImageSetup
 	containerSetups map[string]*ContainerSetup
 	createUsers     bool
+	rebuild         bool
+	sourceCacheSize int64
+	progressMode    builder.ProgressMode
+	libraryCache    builder.LibraryCacheOptions
 }
 
 // SetupJob is a setup job that we can wait on.
@@ -60,6 +65,14 @@ func (s *Setup) CheckHasContainer(name string) bool {
 	return ok
 }
 
+// GetContainerConfig returns the config of the container with the specified name.
+func (s *Setup) GetContainerConfig(name string) *config.ConfigContainer {
+	if setup, ok := s.containerSetups[name]; ok {
+		return setup.config
+	}
+	return nil
+}
+
 // ExecCmdContainer executes a command in a container.
 func (s *Setup) ExecCmdContainer(containerID, userID string, stdIn io.Reader, stdOut, stdErr io.Writer, cmd string, args ...string) error {
 	dockerClient, err := dockerclient.NewEnvClient()
@@ -92,12 +105,38 @@ func NewSetup(conf *config.Config, workDir string, createUsers bool) *Setup {
 	}
 }
 
+// SetRebuild forces building images even if they are up to date.
+func (s *Setup) SetRebuild(rebuild bool) {
+	s.rebuild = rebuild
+}
+
+// SetSourceCacheSize sets the max size of the source cache in the work dir.
+//
+// Zero uses the default size.
+func (s *Setup) SetSourceCacheSize(size int64) {
+	s.sourceCacheSize = size
+}
+
+// SetProgressMode sets how the build progress is rendered.
+func (s *Setup) SetProgressMode(mode builder.ProgressMode) {
+	s.progressMode = mode
+}
+
+// SetLibraryCacheOptions configures the library cache used by ScratchBuild.
+func (s *Setup) SetLibraryCacheOptions(opts builder.LibraryCacheOptions) {
+	s.libraryCache = opts
+}
+
 // Execute runs the setup process.
 func (s *Setup) Execute() error {
 	var jobs []SetupJob
 
 	addImageJob := func(image *config.ConfigImage) {
 		pend := NewImageSetup(image, s.workDir)
+		pend.SetRebuild(s.rebuild)
+		pend.SetSourceCacheSize(s.sourceCacheSize)
+		pend.SetProgressMode(s.progressMode)
+		pend.SetLibraryCacheOptions(s.libraryCache)
 		jobs = append(jobs, pend)
 		s.imageSetups[image.Name()] = pend
 	}
@@ -121,7 +160,7 @@ func (s *Setup) Execute() error {
 	}
 
 	for _, user := range s.config.Users {
-		setup := NewUserSetup(user, s, s.createUsers)
+		setup := NewUserSetup(user, s.config.Audit, s, s.createUsers)
 		jobs = append(jobs, setup)
 	}
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"sync"
 
 	"github.com/docker/docker/api/types"
@@ -97,9 +98,28 @@ func (cs *ContainerSetup) Execute() (execError error) {
 	cs.wg.Add(1)
 	defer func() {
 		cs.err = execError
+		if execError != nil {
+			cs.logger.Write([]byte("Container setup failed for " + cs.config.Name() + " with error:\n"))
+			cs.logger.Write([]byte(execError.Error()))
+			cs.logger.Write([]byte("\n"))
+		}
 		cs.wg.Done()
 	}()
 
+	idleTimeout, err := cs.config.IdleTimeoutDuration()
+	if err != nil {
+		return fmt.Errorf("Container %s: %s", cs.config.Name(), err.Error())
+	}
+	if idleTimeout != 0 {
+		// shared between users: sticky so users can't remove other's registrations.
+		if err := os.MkdirAll(config.IdleDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(config.IdleDir, 0777|os.ModeSticky); err != nil {
+			return err
+		}
+	}
+
 	config := cs.config
 	if config.Image == "" {
 		return fmt.Errorf("Container %s must have image specified.", config.Name())
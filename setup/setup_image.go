@@ -21,6 +21,13 @@ type ImageSetup struct {
 	logger  multiwriter.MultiWriter
 	config  *config.ConfigImage
 	workDir string
+	rebuild bool
+	// sourceCacheSize is the max size of the source cache in the work dir.
+	sourceCacheSize int64
+	// progressMode controls how the build progress is rendered.
+	progressMode builder.ProgressMode
+	// libraryCache configures the library cache used by ScratchBuild.
+	libraryCache builder.LibraryCacheOptions
 
 	err error
 	wg  sync.WaitGroup
@@ -35,6 +42,41 @@ func NewImageSetup(conf *config.ConfigImage, workDir string) *ImageSetup {
 	return s
 }
 
+// SetRebuild forces building the image even if it is up to date.
+func (i *ImageSetup) SetRebuild(rebuild bool) {
+	i.rebuild = rebuild
+}
+
+// SetSourceCacheSize sets the max size of the source cache in bytes.
+func (i *ImageSetup) SetSourceCacheSize(size int64) {
+	i.sourceCacheSize = size
+}
+
+// SetProgressMode sets how the build progress is rendered.
+func (i *ImageSetup) SetProgressMode(mode builder.ProgressMode) {
+	i.progressMode = mode
+}
+
+// SetLibraryCacheOptions configures the library cache used by ScratchBuild.
+func (i *ImageSetup) SetLibraryCacheOptions(opts builder.LibraryCacheOptions) {
+	i.libraryCache = opts
+}
+
+// checkRebuild checks if an existing image should be rebuilt.
+//
+// Images built from a build config are rebuilt when the build inputs change.
+// Images which are pulled or built with ScratchBuild are rebuilt only if forced.
+func (i *ImageSetup) checkRebuild(postBuildPull bool) bool {
+	bc := i.config.Build
+	if bc == nil {
+		return false
+	}
+	if i.rebuild {
+		return true
+	}
+	return !bc.ScratchBuild && (i.config.Pull == nil || postBuildPull)
+}
+
 // checkImageExists checks if an image exists on the machine.
 func (i *ImageSetup) checkImageExists(dockerClient *client.Client, ref string) (bool, error) {
 	summaries, err := dockerClient.ImageList(context.Background(), types.ImageListOptions{})
@@ -98,6 +140,10 @@ func (i *ImageSetup) build() (buildError error) {
 	defer bldr.Close()
 
 	bldr.SetOutputStream(&i.logger)
+	bldr.SetRebuild(i.rebuild)
+	bldr.SetSourceCacheSize(i.sourceCacheSize)
+	bldr.SetProgressMode(i.progressMode)
+	bldr.SetLibraryCacheOptions(i.libraryCache)
 
 	return bldr.Build()
 }
@@ -108,7 +154,7 @@ func (i *ImageSetup) Execute() (exError error) {
 	defer func() {
 		i.err = exError
 		if exError != nil {
-			i.logger.Write([]byte("Image setup failed with error:\n"))
+			i.logger.Write([]byte("Image setup failed for " + i.config.Name() + " with error:\n"))
 			i.logger.Write([]byte(exError.Error()))
 			i.logger.Write([]byte("\n"))
 		}
@@ -146,13 +192,20 @@ func (i *ImageSetup) Execute() (exError error) {
 		}
 	}
 
-	if exists {
+	if exists && !i.checkRebuild(postBuildPull) {
 		return nil
 	}
 
 	if i.config.Build != nil {
 		err := i.build()
 		if err != nil {
+			if exists && !i.rebuild {
+				log.
+					WithError(err).
+					WithField("image", i.config.Name()).
+					Warn("Rebuild failed, keeping the existing image")
+				return nil
+			}
 			if postBuildPull {
 				if perr := i.pull(dockerClient); perr != nil {
 					return err
@@ -14,6 +14,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/util/auditlog"
 )
 
 // globalCreateContainerUserMtx prevents creating multiple users simultaneously.
@@ -25,6 +26,7 @@ var globalCreateHostUserMtx sync.Mutex
 // UserSetup sets up a container.
 type UserSetup struct {
 	config *config.ConfigUser
+	audit  *config.ConfigAudit
 	waiter ContainerWaiter
 	create bool
 
@@ -33,8 +35,10 @@ type UserSetup struct {
 }
 
 // NewUserSetup creates a new UserSetup.
-func NewUserSetup(config *config.ConfigUser, waiter ContainerWaiter, createUsers bool) *UserSetup {
-	return &UserSetup{config: config, waiter: waiter, create: createUsers}
+//
+// audit can be nil to disable the audit log.
+func NewUserSetup(config *config.ConfigUser, audit *config.ConfigAudit, waiter ContainerWaiter, createUsers bool) *UserSetup {
+	return &UserSetup{config: config, audit: audit, waiter: waiter, create: createUsers}
 }
 
 // Execute starts the user setup.
@@ -56,8 +60,26 @@ func (cs *UserSetup) Execute() (execError error) {
 	}
 
 	conf.Container = ensureSlashPrefix(conf.Container)
-	if !cs.waiter.CheckHasContainer(conf.Container) {
-		return fmt.Errorf("User %s: no such container: %s", conf.Name(), conf.Container)
+	for i, name := range conf.Containers {
+		conf.Containers[i] = ensureSlashPrefix(name)
+	}
+	for _, name := range conf.AllowedContainers() {
+		if !cs.waiter.CheckHasContainer(name) {
+			return fmt.Errorf("User %s: no such container: %s", conf.Name(), name)
+		}
+	}
+	for i, route := range conf.Routes {
+		if err := route.Validate(conf.AllowedContainers()); err != nil {
+			return fmt.Errorf("User %s: routes[%d]: %s", conf.Name(), i, err.Error())
+		}
+	}
+	if conf.Restrict != nil {
+		if err := conf.Restrict.Validate(); err != nil {
+			return fmt.Errorf("User %s: restrict: %s", conf.Name(), err.Error())
+		}
+		if conf.Rescue {
+			return fmt.Errorf("User %s: rescue cannot be combined with restrict", conf.Name())
+		}
 	}
 
 	le := log.WithField("user", conf.Name())
@@ -220,6 +242,55 @@ func (cs *UserSetup) Execute() (execError error) {
 		return err
 	}
 
+	if agentConf := conf.SSHAgent; agentConf != nil && agentConf.HostDir != "" {
+		// shared between users: sticky so users can't remove other's sockets.
+		le.WithField("path", agentConf.HostDir).Debug("Creating SSH agent socket dir")
+		if err := os.MkdirAll(agentConf.HostDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(agentConf.HostDir, 0777|os.ModeSticky); err != nil {
+			return err
+		}
+	}
+
+	if recDir := conf.RecordSessionsDir(); recDir != "" {
+		// owned by root and sticky: the user can add recordings but can't
+		// remove the dir or recordings written by the root-run servers.
+		le.WithField("path", recDir).Debug("Creating session recording dir")
+		if err := os.MkdirAll(path.Dir(recDir), 0755); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(recDir, 0770); err != nil {
+			return err
+		}
+		if err := os.Chown(recDir, 0, gid); err != nil {
+			return err
+		}
+		if err := os.Chmod(recDir, 0770|os.ModeSticky); err != nil {
+			return err
+		}
+	}
+
+	if cs.audit != nil {
+		// owned by root: the user can append to the log but not remove it.
+		auditConf := cs.audit.ToConfigUserShellAuditLog(conf.Name())
+		auditDir := path.Dir(auditConf.Path)
+		le.WithField("path", auditDir).Debug("Creating audit log dir")
+		if err := os.MkdirAll(auditDir, 0755); err != nil {
+			return err
+		}
+		if err := os.Chown(auditDir, 0, 0); err != nil {
+			return err
+		}
+		if err := os.Chmod(auditDir, 0755); err != nil {
+			return err
+		}
+		logger := auditlog.NewLogger(auditConf.Path, auditConf.MaxFileSize, auditConf.MaxFiles)
+		if err := logger.Prepare(gid); err != nil {
+			return err
+		}
+	}
+
 	setupPath := path.Join(euser.HomeDir, config.UserLogFile)
 	logFile, err := os.OpenFile(setupPath, os.O_TRUNC|os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -228,46 +299,69 @@ func (cs *UserSetup) Execute() (execError error) {
 	defer logFile.Close()
 	logFile.Sync()
 	logFile.Chown(uid, gid)
+	defer func() {
+		// the shell watches the log for this line.
+		if execError != nil {
+			logFile.WriteString("User setup failed for " + conf.Name() + " with error:\n")
+			logFile.WriteString(execError.Error() + "\n")
+		}
+	}()
 
-	containerId, err := cs.waiter.WaitForContainer(cs.config.Container, logFile)
-	if err != nil {
+	// Write the user settings early so the shell can use them while waiting.
+	// Keep the containers from the previous setup, if any. The root-owned
+	// copy is written first: the shell reads the settings from it.
+	userConfPath := path.Join(euser.HomeDir, config.UserConfigFile)
+	pendingConf := cs.buildUserConfig(nil)
+	if data, err := os.ReadFile(adminUserConfigPath(conf.Name())); err == nil {
+		if prevConf, err := config.UnmarshalConfigUserShell(data); err == nil {
+			pendingConf.ContainerId = prevConf.ContainerId
+			pendingConf.Containers = prevConf.Containers
+		}
+	}
+	if err := writeAdminUserConfig(conf.Name(), pendingConf); err != nil {
+		return err
+	}
+	if err := writeUserConfig(userConfPath, pendingConf, uid, gid); err != nil {
 		return err
 	}
 
-	if conf.ContainerUser != "" && conf.CreateContainerUser {
-		globalCreateContainerUserMtx.Lock()
-		// Check if user exists.
-		var outp bytes.Buffer
-		_ = cs.waiter.ExecCmdContainer(
-			containerId,
-			"root",
-			nil, nil, &outp, // catch stderr only
-			"id", conf.ContainerUser,
-		)
-		errStr := strings.TrimSpace(outp.String())
-		if strings.HasSuffix(errStr, "no such user") {
-			ule := le.
-				WithField("container-user", conf.ContainerUser).
-				WithField("container-id", containerId)
-			ule.Debug("Creating container user...")
-			err = cs.waiter.ExecCmdContainer(
-				containerId, "root",
-				nil, os.Stderr, os.Stderr,
-				"useradd", conf.ContainerUser,
-			)
-			if err != nil {
-				ule.
-					WithError(err).
-					Warn("Unable to create container user")
-			}
+	containerIds := make(map[string]string)
+	for _, name := range conf.AllowedContainers() {
+		id, err := cs.waiter.WaitForContainer(name, logFile)
+		if err != nil {
+			return err
 		}
+		containerIds[name] = id
+	}
 
-		globalCreateContainerUserMtx.Unlock()
+	if conf.ContainerUser != "" && conf.CreateContainerUser {
+		for _, containerId := range containerIds {
+			cs.createContainerUser(le, containerId)
+		}
 	}
 
-	userConfPath := path.Join(euser.HomeDir, config.UserConfigFile)
 	le.WithField("path", userConfPath).Debug("Writing user config...")
-	userConf := cs.config.ToConfigUserShell(containerId)
+	userConf := cs.buildUserConfig(containerIds)
+	if err := writeAdminUserConfig(conf.Name(), userConf); err != nil {
+		return err
+	}
+	return writeUserConfig(userConfPath, userConf, uid, gid)
+}
+
+// buildUserConfig builds the config for the user shell.
+func (cs *UserSetup) buildUserConfig(containerIds map[string]string) *config.ConfigUserShell {
+	userConf := cs.config.ToConfigUserShell(containerIds)
+	userConf.FillContainerConfigs(func(name string) *config.ConfigContainer {
+		return cs.waiter.GetContainerConfig(ensureSlashPrefix(name))
+	})
+	if cs.audit != nil {
+		userConf.AuditLog = cs.audit.ToConfigUserShellAuditLog(cs.config.Name())
+	}
+	return userConf
+}
+
+// writeUserConfig writes the config for the user shell.
+func writeUserConfig(userConfPath string, userConf *config.ConfigUserShell, uid, gid int) error {
 	userConfData, err := userConf.Marshal()
 	if err != nil {
 		return err
@@ -278,6 +372,7 @@ func (cs *UserSetup) Execute() (execError error) {
 		return err
 	}
 	if _, err := userConfFile.Write(userConfData); err != nil {
+		userConfFile.Close()
 		return err
 	}
 	userConfFile.Close()
@@ -285,6 +380,65 @@ func (cs *UserSetup) Execute() (execError error) {
 	return os.Chown(userConfPath, uid, gid)
 }
 
+// adminUserConfigPath returns the path to the copy of the user config owned by root.
+func adminUserConfigPath(userName string) string {
+	return path.Join(config.UserAdminConfigDir, userName+".yaml")
+}
+
+// writeAdminUserConfig writes the copy of the user config owned by root.
+//
+// The shell reads the user config from this copy, which the user can't change.
+func writeAdminUserConfig(userName string, userConf *config.ConfigUserShell) error {
+	userConfData, err := userConf.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(config.UserAdminConfigDir, 0755); err != nil {
+		return err
+	}
+	adminConfPath := adminUserConfigPath(userName)
+	if err := os.WriteFile(adminConfPath, userConfData, 0644); err != nil {
+		return err
+	}
+	// the file may have been created with other permissions.
+	return os.Chmod(adminConfPath, 0644)
+}
+
+// createContainerUser creates the container user if it doesn't exist.
+//
+// Note: errors are logged but ignored.
+func (cs *UserSetup) createContainerUser(le *log.Entry, containerId string) {
+	conf := cs.config
+	globalCreateContainerUserMtx.Lock()
+	defer globalCreateContainerUserMtx.Unlock()
+
+	// Check if user exists.
+	var outp bytes.Buffer
+	_ = cs.waiter.ExecCmdContainer(
+		containerId,
+		"root",
+		nil, nil, &outp, // catch stderr only
+		"id", conf.ContainerUser,
+	)
+	errStr := strings.TrimSpace(outp.String())
+	if strings.HasSuffix(errStr, "no such user") {
+		ule := le.
+			WithField("container-user", conf.ContainerUser).
+			WithField("container-id", containerId)
+		ule.Debug("Creating container user...")
+		err := cs.waiter.ExecCmdContainer(
+			containerId, "root",
+			nil, os.Stderr, os.Stderr,
+			"useradd", conf.ContainerUser,
+		)
+		if err != nil {
+			ule.
+				WithError(err).
+				Warn("Unable to create container user")
+		}
+	}
+}
+
 // Wait waits for Execute() to finish.
 func (i *UserSetup) Wait(io.Writer) error {
 	i.wg.Wait()
@@ -0,0 +1,173 @@
+package shell
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// agentSockEnv is the environment variable with the path to the SSH agent socket.
+const agentSockEnv = "SSH_AUTH_SOCK"
+
+// agentDirPrefix is the prefix of the per-session socket dirs.
+const agentDirPrefix = "agent."
+
+// agentSockName is the name of the socket in the per-session dir.
+const agentSockName = "agent.sock"
+
+// agentProxy relays connections from a per-session socket in a directory
+// shared with the container to the SSH agent socket on the host.
+//
+// The socket is created in a private directory so that other users can't
+// connect to it before its mode is restricted.
+type agentProxy struct {
+	listener      net.Listener
+	hostDir       string
+	hostPath      string
+	containerPath string
+
+	wg sync.WaitGroup
+
+	mtx       sync.Mutex
+	agentPath string
+}
+
+// startAgentProxy starts relaying connections to the agent at agentPath.
+func startAgentProxy(conf *config.ConfigUserSSHAgent, agentPath string) (*agentProxy, error) {
+	pruneStaleAgentSockets(conf.HostDir)
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	dirName := agentDirPrefix + hex.EncodeToString(id[:])
+	containerDir := conf.ContainerDir
+	if containerDir == "" {
+		containerDir = conf.HostDir
+	}
+
+	p := &agentProxy{
+		agentPath:     agentPath,
+		hostDir:       path.Join(conf.HostDir, dirName),
+		hostPath:      path.Join(conf.HostDir, dirName, agentSockName),
+		containerPath: path.Join(containerDir, dirName, agentSockName),
+	}
+	// only the owner of the session can use the agent
+	if err := os.Mkdir(p.hostDir, 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", p.hostPath)
+	if err != nil {
+		_ = os.Remove(p.hostDir)
+		return nil, err
+	}
+	if err := os.Chmod(p.hostPath, 0600); err != nil {
+		listener.Close()
+		_ = os.RemoveAll(p.hostDir)
+		return nil, err
+	}
+	p.listener = listener
+
+	p.wg.Add(1)
+	go p.acceptConns()
+	return p, nil
+}
+
+// ContainerPath returns the path to the socket inside the container.
+func (p *agentProxy) ContainerPath() string {
+	return p.containerPath
+}
+
+// SetAgentPath changes the agent new connections are relayed to.
+func (p *agentProxy) SetAgentPath(agentPath string) {
+	p.mtx.Lock()
+	p.agentPath = agentPath
+	p.mtx.Unlock()
+}
+
+// acceptConns accepts connections until the listener is closed.
+func (p *agentProxy) acceptConns() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.relay(conn)
+	}
+}
+
+// relay copies data between a connection and the host agent.
+func (p *agentProxy) relay(conn net.Conn) {
+	defer conn.Close()
+	p.mtx.Lock()
+	agentPath := p.agentPath
+	p.mtx.Unlock()
+	agentConn, err := net.Dial("unix", agentPath)
+	if err != nil {
+		log.WithError(err).Warn("Unable to connect to SSH agent")
+		return
+	}
+	defer agentConn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(agentConn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, agentConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Close stops the proxy and removes the socket and its dir.
+func (p *agentProxy) Close() {
+	p.listener.Close()
+	p.wg.Wait()
+	_ = os.Remove(p.hostPath)
+	_ = os.Remove(p.hostDir)
+}
+
+// pruneStaleAgentSockets removes sockets left behind by sessions that exited
+// without cleaning up.
+//
+// The directory is sticky, so only sockets owned by this user can be removed.
+func pruneStaleAgentSockets(dir string) {
+	matches, err := filepath.Glob(path.Join(dir, agentDirPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		st, err := os.Lstat(match)
+		if err != nil {
+			continue
+		}
+		// sockets from older versions are not in a dir.
+		sockPath := match
+		if st.IsDir() {
+			sockPath = path.Join(match, agentSockName)
+		}
+		conn, err := net.Dial("unix", sockPath)
+		if err == nil {
+			conn.Close()
+			continue
+		}
+		if strings.Contains(err.Error(), "connection refused") {
+			_ = os.Remove(sockPath)
+			if st.IsDir() {
+				_ = os.Remove(match)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+// startEchoAgent starts a fake agent which echoes the data sent to it.
+func startEchoAgent(t *testing.T) string {
+	agentPath := path.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", agentPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return agentPath
+}
+
+func TestAgentProxyPrivateSocket(t *testing.T) {
+	hostDir := t.TempDir()
+	if err := os.Chmod(hostDir, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err.Error())
+	}
+	conf := &config.ConfigUserSSHAgent{HostDir: hostDir, ContainerDir: "/run/skiff-core/agent"}
+
+	p, err := startAgentProxy(conf, startEchoAgent(t))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the socket is created in a private dir shared with the container.
+	sockDir := path.Dir(p.hostPath)
+	if path.Dir(sockDir) != hostDir {
+		t.Fatalf("expected the socket dir in %s, got %s", hostDir, sockDir)
+	}
+	if st, err := os.Stat(sockDir); err != nil || !st.IsDir() || st.Mode().Perm() != 0700 {
+		t.Fatalf("expected a private socket dir, got %v: %v", st, err)
+	}
+	if st, err := os.Stat(p.hostPath); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("expected a private socket, got %v: %v", st, err)
+	}
+	expectedContainerPath := path.Join("/run/skiff-core/agent", path.Base(sockDir), agentSockName)
+	if p.ContainerPath() != expectedContainerPath {
+		t.Fatalf("expected container path %s, got %s", expectedContainerPath, p.ContainerPath())
+	}
+
+	// connections are relayed to the agent.
+	conn, err := net.Dial("unix", p.hostPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err.Error())
+	}
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil || string(resp) != "ping" {
+		t.Fatalf("expected the agent to reply, got %q: %v", string(resp), err)
+	}
+	conn.Close()
+
+	p.Close()
+	if _, err := os.Stat(sockDir); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket dir to be removed, got %v", err)
+	}
+}
+
+func TestPruneStaleAgentSockets(t *testing.T) {
+	hostDir := t.TempDir()
+	conf := &config.ConfigUserSSHAgent{HostDir: hostDir}
+	agentPath := startEchoAgent(t)
+
+	live, err := startAgentProxy(conf, agentPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer live.Close()
+
+	// a session which exited without removing its socket.
+	stale, err := startAgentProxy(conf, agentPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stale.listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.listener.Close()
+	stale.wg.Wait()
+
+	pruneStaleAgentSockets(hostDir)
+	if _, err := os.Stat(path.Dir(stale.hostPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale socket dir to be removed, got %v", err)
+	}
+	if _, err := os.Stat(live.hostPath); err != nil {
+		t.Fatalf("expected the live socket to be kept: %v", err)
+	}
+}
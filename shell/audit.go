@@ -0,0 +1,135 @@
+package shell
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/user"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/util/auditlog"
+)
+
+// Audit log event types.
+const (
+	auditEventSessionStart  = "session_start"
+	auditEventSessionEnd    = "session_end"
+	auditEventSessionAttach = "session_attach"
+)
+
+// auditRecord is a line in the audit log.
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Session       string    `json:"session"`
+	HostUser      string    `json:"hostUser"`
+	ContainerId   string    `json:"containerId,omitempty"`
+	ContainerUser string    `json:"containerUser,omitempty"`
+	// Source is the SSH_CONNECTION of the session.
+	Source  string `json:"source,omitempty"`
+	Command string `json:"command,omitempty"`
+	// PersistentSession is the name of the persistent session, if any.
+	PersistentSession string `json:"persistentSession,omitempty"`
+	Tty               bool   `json:"tty"`
+	Sftp              bool   `json:"sftp,omitempty"`
+	// Host is set if the command ran on the host.
+	Host bool `json:"host,omitempty"`
+	// ExitCode is set on session_end if the process exited.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// DurationSec is set on session_end.
+	DurationSec float64 `json:"durationSec,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// auditSession writes the start and end of a session to the audit log.
+//
+// All methods are safe to call on a nil auditSession.
+type auditSession struct {
+	logger *auditlog.Logger
+	start  time.Time
+	rec    auditRecord
+}
+
+// newAuditSession builds a new session in the audit log.
+//
+// Returns nil if conf is nil.
+func newAuditSession(conf *config.ConfigUserShellAuditLog, rec auditRecord) *auditSession {
+	if conf == nil || conf.Path == "" {
+		return nil
+	}
+
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	rec.Session = hex.EncodeToString(id[:])
+	if rec.HostUser == "" {
+		rec.HostUser = currentUserName()
+	}
+
+	return &auditSession{
+		logger: auditlog.NewLogger(conf.Path, conf.MaxFileSize, conf.MaxFiles),
+		start:  time.Now(),
+		rec:    rec,
+	}
+}
+
+// startAuditSession writes the session start to the audit log.
+//
+// Returns nil if conf is nil.
+func startAuditSession(conf *config.ConfigUserShellAuditLog, rec auditRecord) *auditSession {
+	a := newAuditSession(conf, rec)
+	a.Event(auditEventSessionStart)
+	return a
+}
+
+// End writes the session end to the audit log.
+func (a *auditSession) End(err error) {
+	if a == nil {
+		return
+	}
+
+	rec := a.rec
+	rec.DurationSec = time.Since(a.start).Seconds()
+	var exitErr *ExitError
+	exitCode := 0
+	switch {
+	case err == nil:
+		rec.ExitCode = &exitCode
+	case errors.As(err, &exitErr):
+		exitCode = exitErr.Code
+		rec.ExitCode = &exitCode
+	default:
+		rec.Error = err.Error()
+	}
+	a.write(auditEventSessionEnd, rec)
+}
+
+// Event writes an event for the session to the audit log.
+func (a *auditSession) Event(event string) {
+	if a == nil {
+		return
+	}
+	a.write(event, a.rec)
+}
+
+// write writes a record to the log.
+func (a *auditSession) write(event string, rec auditRecord) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now()
+	rec.Event = event
+	if err := a.logger.Write(&rec); err != nil {
+		log.WithError(err).WithField("path", a.logger.Path()).Warn("Unable to write audit log")
+	}
+}
+
+// currentUserName returns the name of the host user.
+func currentUserName() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -1,27 +1,116 @@
 package shell
 
 import (
-	"fmt"
-	"os"
+	"path"
+	"strings"
+
+	"github.com/skiffos/skiff-core/config"
 )
 
-// preservedEnvVars are environment variables to include in the shell.
+// preservedEnvVars are patterns of environment variables to include in the shell.
 var preservedEnvVars []string = []string{
 	"SSH_CONNECTION",
 	"SSH_CLIENT",
 	"SSH_TTY",
 	"TERM",
 	"SHLVL",
+	"COLORTERM",
+	"LANG",
+	"LC_*",
+}
+
+// matchEnvPattern checks if the variable name matches any of the patterns.
+func matchEnvPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// envList is an ordered list of KEY=VALUE entries where later entries replace
+// earlier entries with the same key.
+type envList struct {
+	keys   []string
+	values map[string]string
+}
+
+// set sets the value of a key, replacing the value if already set.
+func (l *envList) set(key, value string) {
+	if l.values == nil {
+		l.values = make(map[string]string)
+	}
+	if _, ok := l.values[key]; !ok {
+		l.keys = append(l.keys, key)
+	}
+	l.values[key] = value
+}
+
+// entries returns the list in KEY=VALUE form.
+func (l *envList) entries() []string {
+	res := make([]string, 0, len(l.keys))
+	for _, key := range l.keys {
+		res = append(res, key+"="+l.values[key])
+	}
+	return res
+}
+
+// buildShellEnv builds the environment for the exec in the container.
+//
+// The variables are merged with the following precedence (lowest first):
+//
+//  1. variables from environ matching preservedEnvVars or the ForwardEnv patterns
+//  2. static Env entries from the user config, in order
+//
+// Static entries are set by the administrator and cannot be overridden by the client.
+func buildShellEnv(userConfig *config.ConfigUserShell, environ []string) []string {
+	patterns := preservedEnvVars
+	if userConfig != nil && len(userConfig.ForwardEnv) != 0 {
+		patterns = append(append([]string(nil), preservedEnvVars...), userConfig.ForwardEnv...)
+	}
+
+	var env envList
+	for _, entry := range environ {
+		name, val, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			continue
+		}
+		if matchEnvPattern(patterns, name) {
+			env.set(name, val)
+		}
+	}
+	if userConfig != nil {
+		for _, entry := range userConfig.Env {
+			name, val, ok := strings.Cut(entry, "=")
+			if !ok || name == "" {
+				continue
+			}
+			env.set(name, val)
+		}
+	}
+	return env.entries()
+}
+
+// setShellEnv sets a variable in a list of KEY=VALUE entries, replacing any
+// existing entry with the same name.
+func setShellEnv(env []string, key, value string) []string {
+	var res envList
+	for _, entry := range env {
+		name, val, _ := strings.Cut(entry, "=")
+		res.set(name, val)
+	}
+	res.set(key, value)
+	return res.entries()
 }
 
-// buildShellEnv loads ssh-related environment variables.
-func buildShellEnv() []string {
-	var env []string
-	for _, name := range preservedEnvVars {
-		val, ok := os.LookupEnv(name)
-		if ok {
-			env = append(env, fmt.Sprintf("%s=%s", name, val))
+// getShellEnv returns the value of a variable in a list of KEY=VALUE entries.
+func getShellEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		name, val, ok := strings.Cut(env[i], "=")
+		if ok && name == key {
+			return val
 		}
 	}
-	return env
+	return ""
 }
@@ -0,0 +1,56 @@
+package shell
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestBuildShellEnvForwardsDefaultVariables(t *testing.T) {
+	env := buildShellEnv(nil, []string{
+		"SSH_CONNECTION=10.0.0.2 5000 10.0.0.1 22",
+		"TERM=xterm-256color",
+		"LANG=C.UTF-8",
+		"LC_ALL=C.UTF-8",
+		"HOME=/home/core",
+		"PATH=/usr/bin",
+	})
+	expected := []string{
+		"SSH_CONNECTION=10.0.0.2 5000 10.0.0.1 22",
+		"TERM=xterm-256color",
+		"LANG=C.UTF-8",
+		"LC_ALL=C.UTF-8",
+	}
+	if !slices.Equal(env, expected) {
+		t.Fatalf("expected %q, got %q", expected, env)
+	}
+}
+
+func TestBuildShellEnvForwardsConfiguredPatterns(t *testing.T) {
+	env := buildShellEnv(&config.ConfigUserShell{
+		ForwardEnv: []string{"GIT_*", "EDITOR"},
+	}, []string{
+		"GIT_AUTHOR_NAME=Core",
+		"EDITOR=vim",
+		"VISUAL=emacs",
+	})
+	expected := []string{"GIT_AUTHOR_NAME=Core", "EDITOR=vim"}
+	if !slices.Equal(env, expected) {
+		t.Fatalf("expected %q, got %q", expected, env)
+	}
+}
+
+func TestBuildShellEnvStaticEntriesTakePrecedence(t *testing.T) {
+	env := buildShellEnv(&config.ConfigUserShell{
+		ForwardEnv: []string{"EDITOR"},
+		Env:        []string{"EDITOR=nano", "FOO=bar", "invalid", "FOO=baz"},
+	}, []string{
+		"TERM=xterm",
+		"EDITOR=vim",
+	})
+	expected := []string{"TERM=xterm", "EDITOR=nano", "FOO=baz"}
+	if !slices.Equal(env, expected) {
+		t.Fatalf("expected %q, got %q", expected, env)
+	}
+}
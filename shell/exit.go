@@ -0,0 +1,66 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// ExitError is returned when the process executed in the container exits
+// with a non-zero status.
+type ExitError struct {
+	// Code is the exit status of the process.
+	// Processes killed by a signal report 128+signal.
+	Code int
+}
+
+// Error returns the error string.
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exited with status %d", e.Code)
+}
+
+// execExitPollInterval is the interval between inspecting a finishing exec.
+var execExitPollInterval = time.Millisecond * 50
+
+// execExitTimeout is the max time to wait for an exec to finish after streaming.
+var execExitTimeout = time.Second * 5
+
+// waitExecExitCode waits for the exec to stop running and returns its exit code.
+//
+// The output stream can close slightly before the daemon marks the exec as
+// exited, so the exec is polled until it is no longer running.
+func waitExecExitCode(ctx context.Context, dockerClient client.ContainerAPIClient, execID string) (int, error) {
+	deadline := time.Now().Add(execExitTimeout)
+	for {
+		ins, err := dockerClient.ContainerExecInspect(ctx, execID)
+		if err != nil {
+			return 0, err
+		}
+		if !ins.Running {
+			return ins.ExitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("exec %s still running after output closed", execID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(execExitPollInterval):
+		}
+	}
+}
+
+// checkExecExitCode returns an *ExitError if the exec exited with a non-zero status.
+func checkExecExitCode(ctx context.Context, dockerClient client.ContainerAPIClient, execID string) error {
+	code, err := waitExecExitCode(ctx, dockerClient, execID)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
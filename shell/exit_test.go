@@ -0,0 +1,124 @@
+package shell
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// fakeDockerClient implements the parts of the Docker API used by the shell.
+//
+// Calling any other method panics via the nil embedded interface.
+type fakeDockerClient struct {
+	client.APIClient
+
+	mtx sync.Mutex
+	// execInspects is the sequence of responses to ContainerExecInspect.
+	// The last response is repeated.
+	execInspects []types.ContainerExecInspect
+	// execCreates records the configs passed to ContainerExecCreate.
+	execCreates []types.ExecConfig
+	// execStarts records the IDs passed to ContainerExecStart.
+	execStarts []string
+	// execConn is returned by ContainerExecAttach as the connection to the process.
+	execConn net.Conn
+	// execResizes records the sizes passed to ContainerExecResize.
+	execResizes []types.ResizeOptions
+}
+
+func (f *fakeDockerClient) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.execConn == nil {
+		return types.HijackedResponse{}, errors.New("no such exec: " + execID)
+	}
+	return types.HijackedResponse{Conn: f.execConn, Reader: bufio.NewReader(f.execConn)}, nil
+}
+
+func (f *fakeDockerClient) ContainerExecResize(ctx context.Context, execID string, options types.ResizeOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.execResizes = append(f.execResizes, options)
+	return nil
+}
+
+func (f *fakeDockerClient) Close() error {
+	return nil
+}
+
+func (f *fakeDockerClient) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.execCreates = append(f.execCreates, config)
+	return types.IDResponse{ID: fmt.Sprintf("exec-helper-%d", len(f.execCreates))}, nil
+}
+
+func (f *fakeDockerClient) ContainerExecStart(ctx context.Context, execID string, config types.ExecStartCheck) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.execStarts = append(f.execStarts, execID)
+	return nil
+}
+
+func (f *fakeDockerClient) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if len(f.execInspects) == 0 {
+		return types.ContainerExecInspect{}, errors.New("no such exec: " + execID)
+	}
+	res := f.execInspects[0]
+	if len(f.execInspects) > 1 {
+		f.execInspects = f.execInspects[1:]
+	}
+	res.ExecID = execID
+	return res, nil
+}
+
+func TestCheckExecExitCodeSuccess(t *testing.T) {
+	dc := &fakeDockerClient{execInspects: []types.ContainerExecInspect{{ExitCode: 0}}}
+	if err := checkExecExitCode(context.Background(), dc, "exec-1"); err != nil {
+		t.Fatalf("expected no error for exit status 0, got %v", err)
+	}
+}
+
+func TestCheckExecExitCodeReturnsExitStatus(t *testing.T) {
+	dc := &fakeDockerClient{execInspects: []types.ContainerExecInspect{{ExitCode: 1}}}
+	err := checkExecExitCode(context.Background(), dc, "exec-1")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("expected ExitError, got %v", err)
+	}
+	if exitErr.Code != 1 {
+		t.Fatalf("expected exit status 1, got %d", exitErr.Code)
+	}
+}
+
+func TestCheckExecExitCodeWaitsForRunningExec(t *testing.T) {
+	// killed by SIGKILL: 128+9
+	dc := &fakeDockerClient{execInspects: []types.ContainerExecInspect{
+		{Running: true},
+		{Running: true},
+		{ExitCode: 137},
+	}}
+	err := checkExecExitCode(context.Background(), dc, "exec-1")
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 137 {
+		t.Fatalf("expected exit status 137, got %v", err)
+	}
+}
+
+func TestCheckExecExitCodeInspectError(t *testing.T) {
+	dc := &fakeDockerClient{}
+	err := checkExecExitCode(context.Background(), dc, "exec-1")
+	var exitErr *ExitError
+	if err == nil || errors.As(err, &exitErr) {
+		t.Fatalf("expected inspect error, got %v", err)
+	}
+}
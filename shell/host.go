@@ -0,0 +1,54 @@
+package shell
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/mgutz/str"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// runHostCmd runs a command on the host.
+//
+// env is appended to the environment of this process.
+// Returns an *ExitError if the command exits with a non-zero status.
+func runHostCmd(argv []string, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), env...)
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = &ExitError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// runHostRoute runs a command matched by a host route on the host.
+//
+// The command is split into arguments and executed directly, without a
+// shell, so the client cannot append commands with shell syntax.
+func runHostRoute(userConfig *config.ConfigUserShell, inputCmd string, req *Request) error {
+	argv := str.ToArgv(inputCmd)
+	if len(argv) == 0 {
+		return &RejectError{Message: "host routes require a command"}
+	}
+
+	log.WithField("command", inputCmd).Debug("Running command on host")
+	audit := startAuditSession(userConfig.AuditLog, auditRecord{
+		Source:  req.source(),
+		Command: inputCmd,
+		Tty:     req.Tty,
+		Host:    true,
+	})
+
+	err := runHostCmd(argv, nil, req.Stdin, req.Stdout, req.Stderr)
+	audit.End(err)
+	return err
+}
@@ -0,0 +1,338 @@
+package shell
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// IdleStopCommand is the skiff-core command which stops a container when it becomes idle.
+const IdleStopCommand = "idle-stop"
+
+// Idle registry files, prefixed with the container id.
+const (
+	idleLockExt    = ".lock"
+	idleStateExt   = ".state"
+	idleSessionExt = ".session"
+)
+
+// idleStateFormat is the format of the state files.
+const idleStateFormat = "%020d %010d\n"
+
+// startIdleStopper starts the idle-stop process and returns its pid.
+var startIdleStopper = spawnIdleStopper
+
+// idleStopTimeout is the max time to wait for docker to stop the container.
+var idleStopTimeout = time.Minute * 2
+
+// idleState is the state of a container in the idle registry written by a user.
+type idleState struct {
+	// LastEnd is the time the last session of the user ended.
+	LastEnd time.Time
+	// StopperPid is the pid of the idle-stop process started by the user, if any.
+	StopperPid int
+}
+
+// idleStates are the states of the registry by uid.
+type idleStates map[int]*idleState
+
+// own returns the state of the current user.
+func (s idleStates) own() *idleState {
+	uid := os.Getuid()
+	if s[uid] == nil {
+		s[uid] = &idleState{}
+	}
+	return s[uid]
+}
+
+// lastEnd returns the time the last session of any user ended.
+func (s idleStates) lastEnd() time.Time {
+	var res time.Time
+	for _, st := range s {
+		if st.LastEnd.After(res) {
+			res = st.LastEnd
+		}
+	}
+	return res
+}
+
+// stopperAlive checks if an idle-stop process of any user is running.
+func (s idleStates) stopperAlive() bool {
+	for _, st := range s {
+		if st.StopperPid != 0 && processAlive(st.StopperPid) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleRegistry tracks the shell sessions of a container with an idle timeout.
+//
+// The lock file serializes changes to the registry. Each user writes its
+// idleState to a file named with the container id and the uid, so users
+// cannot change the state of others. Each session has a file named with the
+// container id, the pid of the process holding the session and a unique id,
+// as a process can hold many sessions.
+type idleRegistry struct {
+	dir         string
+	containerId string
+}
+
+// newIdleRegistry builds the registry for a container.
+func newIdleRegistry(containerId string) *idleRegistry {
+	return &idleRegistry{dir: config.IdleDir, containerId: containerId}
+}
+
+// sessionPath returns the path to the session file for a pid and session id.
+func (r *idleRegistry) sessionPath(pid int, id string) string {
+	return path.Join(r.dir, r.containerId+"."+strconv.Itoa(pid)+"."+id+idleSessionExt)
+}
+
+// statePath returns the path to the state file of a user.
+func (r *idleRegistry) statePath(uid int) string {
+	return path.Join(r.dir, r.containerId+"."+strconv.Itoa(uid)+idleStateExt)
+}
+
+// lock locks the registry and reads the states.
+func (r *idleRegistry) lock() (idleStates, func(), error) {
+	unlock, err := lockIdleFile(path.Join(r.dir, r.containerId+idleLockExt))
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.readStates(), unlock, nil
+}
+
+// readStates reads the state files of the users.
+//
+// Files not owned by the user in their name are ignored.
+func (r *idleRegistry) readStates() idleStates {
+	states := make(idleStates)
+	matches, _ := filepath.Glob(path.Join(r.dir, r.containerId+".*"+idleStateExt))
+	for _, match := range matches {
+		uidStr := strings.TrimSuffix(strings.TrimPrefix(path.Base(match), r.containerId+"."), idleStateExt)
+		uid, err := strconv.Atoi(uidStr)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(match)
+		if err != nil || !info.Mode().IsRegular() || !fileOwnedBy(info, uid) {
+			continue
+		}
+		data, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		st := &idleState{}
+		var lastEnd int64
+		if _, err := fmt.Sscanf(string(data), idleStateFormat, &lastEnd, &st.StopperPid); err != nil {
+			continue
+		}
+		if lastEnd != 0 {
+			st.LastEnd = time.Unix(0, lastEnd)
+		}
+		states[uid] = st
+	}
+	return states
+}
+
+// writeState writes the state of the current user.
+//
+// Must be called with the registry locked.
+func (r *idleRegistry) writeState(st *idleState) error {
+	var lastEnd int64
+	if !st.LastEnd.IsZero() {
+		lastEnd = st.LastEnd.UnixNano()
+	}
+	data := fmt.Sprintf(idleStateFormat, lastEnd, st.StopperPid)
+	return os.WriteFile(r.statePath(os.Getuid()), []byte(data), 0644)
+}
+
+// liveSessions counts the sessions with a running process.
+//
+// Must be called with the registry locked.
+func (r *idleRegistry) liveSessions() int {
+	matches, err := filepath.Glob(path.Join(r.dir, r.containerId+".*"+idleSessionExt))
+	if err != nil {
+		return 0
+	}
+	var count int
+	for _, match := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(path.Base(match), r.containerId+"."), idleSessionExt)
+		pidStr, _, _ := strings.Cut(name, ".")
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			continue
+		}
+		if processAlive(pid) {
+			count++
+		} else {
+			// only succeeds for our own stale sessions
+			_ = os.Remove(match)
+		}
+	}
+	return count
+}
+
+// idleSession is a shell session registered with the idle registry.
+//
+// All methods are safe to call on a nil idleSession.
+type idleSession struct {
+	reg        *idleRegistry
+	path       string
+	timeout    time.Duration
+	stopSignal string
+}
+
+// newIdleSessionId returns a unique id for a session.
+func newIdleSessionId() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// registerIdleSession registers a session using the container.
+//
+// Returns nil if idle shutdown is disabled for the container.
+func registerIdleSession(userConfig *config.ConfigUserShell, containerId string) *idleSession {
+	var ctrConf *config.ConfigUserShellContainer
+	for _, ctr := range userConfig.Containers {
+		if ctr != nil && ctr.Id == containerId {
+			ctrConf = ctr
+			break
+		}
+	}
+	if ctrConf == nil || ctrConf.IdleTimeout == "" {
+		return nil
+	}
+	le := log.WithField("container", containerId)
+	timeout, err := time.ParseDuration(ctrConf.IdleTimeout)
+	if err != nil || timeout <= 0 {
+		le.WithField("idle-timeout", ctrConf.IdleTimeout).Warn("Invalid idle timeout, ignoring")
+		return nil
+	}
+	id, err := newIdleSessionId()
+	if err != nil {
+		le.WithError(err).Warn("Unable to register session for idle shutdown")
+		return nil
+	}
+
+	reg := newIdleRegistry(containerId)
+	sess := &idleSession{
+		reg:        reg,
+		path:       reg.sessionPath(os.Getpid(), id),
+		timeout:    timeout,
+		stopSignal: ctrConf.StopSignal,
+	}
+	_, unlock, err := reg.lock()
+	if err != nil {
+		le.WithError(err).Warn("Unable to register session for idle shutdown")
+		return nil
+	}
+	defer unlock()
+	if err := os.WriteFile(sess.path, nil, 0644); err != nil {
+		le.WithError(err).Warn("Unable to register session for idle shutdown")
+		return nil
+	}
+	return sess
+}
+
+// Close unregisters the session.
+//
+// Starts the idle-stop process if this was the last session.
+func (i *idleSession) Close() {
+	if i == nil {
+		return
+	}
+	le := log.WithField("container", i.reg.containerId)
+	states, unlock, err := i.reg.lock()
+	if err != nil {
+		le.WithError(err).Warn("Unable to unregister session for idle shutdown")
+		return
+	}
+	defer unlock()
+
+	_ = os.Remove(i.path)
+	st := states.own()
+	st.LastEnd = time.Now()
+	if i.reg.liveSessions() == 0 && !states.stopperAlive() {
+		pid, err := startIdleStopper(i.reg.containerId, i.timeout, i.stopSignal)
+		if err != nil {
+			le.WithError(err).Warn("Unable to start idle shutdown")
+		} else {
+			st.StopperPid = pid
+		}
+	}
+	if err := i.reg.writeState(st); err != nil {
+		le.WithError(err).Warn("Unable to write idle registry")
+	}
+}
+
+// ServeIdleStop stops the container once it has had no sessions for the timeout.
+//
+// Called in a detached process started when the last session ends. Exits
+// early if a new session starts.
+func (s *Shell) ServeIdleStop(containerId string, timeout time.Duration, stopSignal string) error {
+	reg := newIdleRegistry(containerId)
+	le := log.WithField("container", containerId)
+	for {
+		states, unlock, err := reg.lock()
+		if err != nil {
+			return err
+		}
+		st := states.own()
+		if st.StopperPid != os.Getpid() {
+			// replaced by another idle-stop process
+			unlock()
+			return nil
+		}
+		if reg.liveSessions() != 0 {
+			st.StopperPid = 0
+			err := reg.writeState(st)
+			unlock()
+			return err
+		}
+
+		wait := time.Until(states.lastEnd().Add(timeout))
+		if wait > 0 {
+			unlock()
+			<-time.After(wait)
+			continue
+		}
+
+		// stop with the registry locked so new sessions wait to start the container.
+		le.WithField("idle-timeout", timeout.String()).Info("Stopping idle container")
+		err = s.stopIdleContainer(containerId, stopSignal)
+		st.StopperPid = 0
+		if werr := reg.writeState(st); err == nil {
+			err = werr
+		}
+		unlock()
+		return err
+	}
+}
+
+// stopIdleContainer stops the container with the stop signal.
+func (s *Shell) stopIdleContainer(containerId, stopSignal string) error {
+	dockerClient, err := s.buildDockerClient()
+	if err != nil {
+		return err
+	}
+	defer dockerClient.Close()
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), idleStopTimeout)
+	defer ctxCancel()
+	return dockerClient.ContainerStop(ctx, containerId, container.StopOptions{Signal: stopSignal})
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockIdleFile is not supported on this platform.
+func lockIdleFile(lockPath string) (func(), error) {
+	return nil, errors.New("idle shutdown is not supported on this platform")
+}
+
+// fileOwnedBy reports all files as owned by the uid on this platform.
+func fileOwnedBy(info os.FileInfo, uid int) bool {
+	return true
+}
+
+// processAlive reports all processes as running on this platform.
+func processAlive(pid int) bool {
+	return pid > 0
+}
+
+// spawnIdleStopper is not supported on this platform.
+func spawnIdleStopper(containerId string, timeout time.Duration, stopSignal string) (int, error) {
+	return 0, errors.New("idle shutdown is not supported on this platform")
+}
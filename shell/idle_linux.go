@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// lockIdleFile opens and acquires an exclusive lock on the registry lock file.
+//
+// The file is shared between users, so it is opened read-only: the lock
+// does not need write access.
+func lockIdleFile(lockPath string) (func(), error) {
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// fileOwnedBy checks if the file is owned by the uid.
+func fileOwnedBy(info os.FileInfo, uid int) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == uid
+}
+
+// processAlive checks if the process is running.
+//
+// Processes of other users are reported as running.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// spawnIdleStopper starts the idle-stop process in a new detached process.
+func spawnIdleStopper(containerId string, timeout time.Duration, stopSignal string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(
+		exe,
+		IdleStopCommand,
+		"--timeout", timeout.String(),
+		"--signal", stopSignal,
+		containerId,
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	pid := cmd.Process.Pid
+	return pid, cmd.Process.Release()
+}
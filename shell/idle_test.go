@@ -0,0 +1,152 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func setupIdleTest(t *testing.T) *[]string {
+	prevDir, prevStart := config.IdleDir, startIdleStopper
+	config.IdleDir = t.TempDir()
+	var started []string
+	startIdleStopper = func(containerId string, timeout time.Duration, stopSignal string) (int, error) {
+		started = append(started, containerId+" "+timeout.String()+" "+stopSignal)
+		// use our own pid as a running process
+		return os.Getpid(), nil
+	}
+	t.Cleanup(func() {
+		config.IdleDir, startIdleStopper = prevDir, prevStart
+	})
+	return &started
+}
+
+func idleTestConfig(idleTimeout string) *config.ConfigUserShell {
+	return &config.ConfigUserShell{
+		ContainerId: "core-id",
+		Containers: map[string]*config.ConfigUserShellContainer{
+			"core": {Id: "core-id", IdleTimeout: idleTimeout, StopSignal: "SIGRTMIN+3"},
+		},
+	}
+}
+
+func TestRegisterIdleSessionDisabled(t *testing.T) {
+	setupIdleTest(t)
+	if sess := registerIdleSession(idleTestConfig(""), "core-id"); sess != nil {
+		t.Fatal("expected no registration without an idle timeout")
+	}
+	if sess := registerIdleSession(idleTestConfig("10m"), "other-id"); sess != nil {
+		t.Fatal("expected no registration for unknown container")
+	}
+}
+
+func TestIdleSessionStartsStopperAfterLastSession(t *testing.T) {
+	started := setupIdleTest(t)
+
+	sess := registerIdleSession(idleTestConfig("10m"), "core-id")
+	if sess == nil {
+		t.Fatal("expected session to be registered")
+	}
+	reg := newIdleRegistry("core-id")
+	_, unlock, err := reg.lock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count := reg.liveSessions(); count != 1 {
+		t.Fatalf("expected 1 live session, got %d", count)
+	}
+	unlock()
+
+	sess.Close()
+	if len(*started) != 1 || (*started)[0] != "core-id 10m0s SIGRTMIN+3" {
+		t.Fatalf("unexpected idle-stop processes: %q", *started)
+	}
+
+	states, unlock, err := reg.lock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer unlock()
+	if count := reg.liveSessions(); count != 0 {
+		t.Fatalf("expected no live sessions, got %d", count)
+	}
+	if st := states.own(); st.StopperPid != os.Getpid() || st.LastEnd.IsZero() {
+		t.Fatalf("unexpected idle state: %+v", st)
+	}
+}
+
+func TestIdleSessionsInOneProcess(t *testing.T) {
+	started := setupIdleTest(t)
+
+	// the built-in servers hold many sessions in a single process.
+	first := registerIdleSession(idleTestConfig("10m"), "core-id")
+	second := registerIdleSession(idleTestConfig("10m"), "core-id")
+	if first == nil || second == nil || first.path == second.path {
+		t.Fatal("expected sessions to be registered separately")
+	}
+	first.Close()
+	if len(*started) != 0 {
+		t.Fatalf("expected no idle-stop process with a live session, got %q", *started)
+	}
+	second.Close()
+	if len(*started) != 1 {
+		t.Fatalf("expected an idle-stop process after the last session, got %q", *started)
+	}
+
+	st, err := os.Stat(path.Join(config.IdleDir, "core-id"+idleLockExt))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if st.Mode().Perm()&0022 != 0 {
+		t.Fatalf("expected lock file to not be writable by others: %v", st.Mode())
+	}
+}
+
+func TestIdleSessionKeepsRunningStopper(t *testing.T) {
+	started := setupIdleTest(t)
+
+	registerIdleSession(idleTestConfig("1m"), "core-id").Close()
+	registerIdleSession(idleTestConfig("1m"), "core-id").Close()
+	if len(*started) != 1 {
+		t.Fatalf("expected a single idle-stop process, got %q", *started)
+	}
+}
+
+func TestServeIdleStopExitsWithLiveSession(t *testing.T) {
+	setupIdleTest(t)
+
+	reg := newIdleRegistry("core-id")
+	states, unlock, err := reg.lock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	st := states.own()
+	st.StopperPid = os.Getpid()
+	st.LastEnd = time.Now().Add(-time.Hour)
+	if err := reg.writeState(st); err != nil {
+		t.Fatal(err.Error())
+	}
+	unlock()
+
+	sess := registerIdleSession(idleTestConfig("1m"), "core-id")
+	defer os.Remove(sess.path)
+
+	// returns without contacting docker since a session is live.
+	if err := NewShell(t.TempDir()).ServeIdleStop("core-id", time.Minute, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	states, unlock, err = reg.lock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer unlock()
+	if st := states.own(); st.StopperPid != 0 {
+		t.Fatalf("expected stopper to be cleared, got %d", st.StopperPid)
+	}
+}
@@ -0,0 +1,102 @@
+package shell
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/util/asciicast"
+)
+
+// recordingExt is the extension of session recordings.
+const recordingExt = ".cast"
+
+// openSessionRecording creates a new recording in the user's recording dir.
+//
+// Once a file reaches MaxFileSize the recording continues in a new file.
+// Removes the oldest recordings to stay within MaxFiles.
+func openSessionRecording(
+	conf *config.ConfigUserRecordSessions,
+	width, height uint,
+	env map[string]string,
+) (*asciicast.Writer, error) {
+	// the dir is created by setup, owned by root: only create it if missing.
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	sessionId := hex.EncodeToString(id[:])
+	var part int
+	openNext := func() (io.WriteCloser, error) {
+		if conf.MaxFiles > 0 {
+			pruneSessionRecordings(conf.Dir, conf.MaxFiles-1)
+		}
+		name := fmt.Sprintf(
+			"%s-%s-%03d%s",
+			time.Now().UTC().Format("20060102T150405Z"),
+			sessionId,
+			part,
+			recordingExt,
+		)
+		part++
+		return os.OpenFile(path.Join(conf.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	}
+
+	f, err := openNext()
+	if err != nil {
+		return nil, err
+	}
+	rec, err := asciicast.NewWriter(f, asciicast.Header{
+		Width:  width,
+		Height: height,
+		Env:    env,
+	}, conf.MaxFileSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rec.SetRotate(openNext)
+	return rec, nil
+}
+
+// pruneSessionRecordings removes the oldest recordings until at most keep remain.
+func pruneSessionRecordings(dir string, keep int) {
+	matches, err := filepath.Glob(path.Join(dir, "*"+recordingExt))
+	if err != nil || len(matches) <= keep {
+		return
+	}
+
+	// names start with the timestamp: sort oldest first
+	sort.Strings(matches)
+	for _, p := range matches[:len(matches)-keep] {
+		// recordings written by root can't be removed by the user.
+		if err := os.Remove(p); err != nil {
+			log.WithError(err).WithField("path", p).Debug("Unable to remove old recording")
+		}
+	}
+}
+
+// teeReadCloser copies everything read to a writer.
+type teeReadCloser struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+// Read reads from the underlying reader and writes to w.
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		_, _ = t.w.Write(p[:n])
+	}
+	return n, err
+}
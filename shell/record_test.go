@@ -0,0 +1,81 @@
+package shell
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestPruneSessionRecordings(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"20240101T000000Z-aaaa-000.cast",
+		"20240102T000000Z-bbbb-000.cast",
+		"20240102T000000Z-bbbb-001.cast",
+		"20240103T000000Z-cccc-000.cast",
+		"notes.txt",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(path.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	pruneSessionRecordings(dir, 2)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var remaining []string
+	for _, ent := range entries {
+		remaining = append(remaining, ent.Name())
+	}
+	expected := "20240102T000000Z-bbbb-001.cast,20240103T000000Z-cccc-000.cast,notes.txt"
+	if strings.Join(remaining, ",") != expected {
+		t.Fatalf("expected %s, got %v", expected, remaining)
+	}
+}
+
+func TestSessionRecordingRotates(t *testing.T) {
+	conf := &config.ConfigUserRecordSessions{
+		Dir:         path.Join(t.TempDir(), "core"),
+		MaxFileSize: 256,
+		MaxFiles:    3,
+	}
+	rec, err := openSessionRecording(conf, 80, 24, map[string]string{"TERM": "xterm"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 50; i++ {
+		rec.WriteOutput([]byte("0123456789"))
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rec.Limited() {
+		t.Fatal("expected the recording to continue in new files")
+	}
+
+	matches, err := filepath.Glob(path.Join(conf.Dir, "*"+recordingExt))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(matches) != conf.MaxFiles {
+		t.Fatalf("expected %d recordings to be kept, got %v", conf.MaxFiles, matches)
+	}
+	sort.Strings(matches)
+	last := matches[len(matches)-1]
+	data, err := os.ReadFile(last)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(string(data), `{"version":2,"width":80,"height":24`) {
+		t.Fatalf("expected the last part to start with a header, got %q", string(data))
+	}
+}
@@ -0,0 +1,303 @@
+package shell
+
+import (
+	"context"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/util/execcmd"
+)
+
+// TtySize is the size of a terminal.
+type TtySize struct {
+	Height uint
+	Width  uint
+}
+
+// Request is a request to run a command or the shell in the user's container.
+//
+// Execute builds a Request from the standard streams of the process. Other
+// frontends, such as the built-in SSH server, build it from their sessions.
+type Request struct {
+	// Command is the command sent by the client, empty for the login shell.
+	Command string
+	// ExecWithShell indicates Command should be run with the user shell.
+	ExecWithShell bool
+
+	Stdin  io.ReadCloser
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Tty indicates the client has a terminal.
+	Tty bool
+	// Size is the initial size of the terminal.
+	Size TtySize
+	// Resize receives changes to the terminal size, if set.
+	Resize <-chan TtySize
+	// RawMode is called before streaming with a tty, if set.
+	// Returns a function to restore the terminal.
+	RawMode func() func()
+
+	// Environ is the environment of the client session in KEY=VALUE form.
+	Environ []string
+	// Signals receives the names of signals to forward to the process, if set.
+	// For example: INT, TERM or HUP.
+	Signals <-chan string
+
+	// Source is the address of the client in the audit log.
+	// Defaults to SSH_CONNECTION from Environ.
+	Source string
+	// UserName is the name of the user in the audit log.
+	// Defaults to the current host user.
+	UserName string
+	// AllowHost allows routes to run commands on the host.
+	AllowHost bool
+	// AgentSocket is the path to the SSH agent socket on the host to forward, if set.
+	// Set by the frontend, never taken from Environ.
+	AgentSocket string
+}
+
+// getenv returns the value of a variable in Environ.
+func (r *Request) getenv(key string) string {
+	return getShellEnv(r.Environ, key)
+}
+
+// source returns the address of the client for the audit log.
+func (r *Request) source() string {
+	if r.Source != "" {
+		return r.Source
+	}
+	return r.getenv("SSH_CONNECTION")
+}
+
+// containerStartError is returned by Run if the container cannot be started.
+type containerStartError struct {
+	err error
+}
+
+// Error returns the error string.
+func (e *containerStartError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error starting the container.
+func (e *containerStartError) Unwrap() error {
+	return e.err
+}
+
+// Run runs the request in the user's container.
+//
+// Returns an *ExitError if the process exits with a non-zero status, or a
+// *RejectError if the command is not allowed.
+func (s *Shell) Run(ctx context.Context, userConfig *config.ConfigUserShell, req *Request) (runErr error) {
+	dockerClient, err := s.buildDockerClient()
+	if err != nil {
+		return err
+	}
+	defer dockerClient.Close()
+
+	ctx, ctxCancel := context.WithCancel(ctx)
+	defer ctxCancel()
+
+	useTty := req.Tty
+	containerId, inputCmd, err := selectContainer(userConfig, req.Command, req.getenv)
+	if err != nil {
+		return err
+	}
+
+	// enforce the restrictions before routing the command.
+	restricted, err := restrictCmd(userConfig.Restrict, inputCmd, useTty)
+	if err != nil {
+		return err
+	}
+	originalCmd := inputCmd
+	inputCmd = restricted.Command
+	execWithShell := req.ExecWithShell && !restricted.Direct
+
+	routed, err := routeCmd(userConfig, containerId, inputCmd)
+	if err != nil {
+		return err
+	}
+	containerId, inputCmd, containerUser := routed.ContainerId, routed.Command, routed.User
+	if routed.Host {
+		if !req.AllowHost {
+			return &RejectError{Message: "host commands are not available"}
+		}
+		return runHostRoute(userConfig, inputCmd, req)
+	}
+
+	cmd, err := s.buildTargetCmd(userConfig, inputCmd, execWithShell)
+	if err != nil {
+		return err
+	}
+
+	_, isSftp := buildSSHSubsystemCmd(inputCmd)
+	auditRec := auditRecord{
+		HostUser:          req.UserName,
+		ContainerId:       containerId,
+		ContainerUser:     containerUser,
+		Source:            req.source(),
+		Command:           inputCmd,
+		Tty:               useTty,
+		Sftp:              isSftp,
+		PersistentSession: s.sessionName,
+	}
+	// persistent sessions are written to the audit log by the session server.
+	var audit *auditSession
+	if s.sessionName == "" {
+		audit = startAuditSession(userConfig.AuditLog, auditRec)
+	}
+	defer func() {
+		audit.End(runErr)
+	}()
+
+	// register the session before starting the container to hold off idle shutdown.
+	idle := registerIdleSession(userConfig, containerId)
+	defer idle.Close()
+
+	if err := ensureContainerRunning(ctx, dockerClient, containerId, req.Stderr); err != nil {
+		return &containerStartError{err: err}
+	}
+
+	env := buildShellEnv(userConfig, req.Environ)
+	if restricted.Forced {
+		env = setShellEnv(env, originalCommandEnv, originalCmd)
+	}
+
+	// attach to the persistent session, starting it if necessary.
+	// Checked after the restrictions, routes and audit log like other sessions.
+	if s.sessionName != "" {
+		if !useTty {
+			return errors.New("persistent sessions require a tty")
+		}
+		if inputCmd != "" {
+			return errors.New("persistent sessions are only available for the login shell")
+		}
+		newAuditSession(userConfig.AuditLog, auditRec).Event(auditEventSessionAttach)
+		if s.isSessionRunning(s.sessionName) {
+			spec, err := s.readSessionSpec(s.sessionName)
+			if err != nil {
+				return err
+			}
+			if spec.ContainerId != containerId {
+				return errors.Errorf("session %s is running in another container", s.sessionName)
+			}
+			return s.attachSession(s.sessionName, req.AgentSocket)
+		}
+		err := s.startSession(&sessionSpec{
+			Name:        s.sessionName,
+			ContainerId: containerId,
+			User:        containerUser,
+			Cmd:         cmd,
+			Env:         env,
+			Height:      req.Size.Height,
+			Width:       req.Size.Width,
+			Source:      req.source(),
+			AgentSocket: req.AgentSocket,
+		})
+		if err != nil {
+			return err
+		}
+		return s.attachSession(s.sessionName, req.AgentSocket)
+	}
+
+	if req.AgentSocket != "" && userConfig.SSHAgent != nil {
+		agent, err := startAgentProxy(userConfig.SSHAgent, req.AgentSocket)
+		if err != nil {
+			log.WithError(err).Warn("Unable to forward SSH agent")
+		} else {
+			defer agent.Close()
+			env = setShellEnv(env, agentSockEnv, agent.ContainerPath())
+		}
+	}
+
+	execCreate, err := dockerClient.ContainerExecCreate(ctx, containerId, types.ExecConfig{
+		Tty:  useTty,
+		User: containerUser,
+		Cmd:  cmd,
+		Env:  env,
+
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := dockerClient.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{
+		Tty: useTty,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// record interactive sessions if enabled
+	var onResize func(size TtySize)
+	streamIn, streamOut := req.Stdin, req.Stdout
+	if recConf := userConfig.RecordSessions; recConf != nil && useTty {
+		rec, err := openSessionRecording(recConf, req.Size.Width, req.Size.Height, map[string]string{
+			"TERM":  req.getenv("TERM"),
+			"SHELL": cmd[0],
+		})
+		if err != nil {
+			log.WithError(err).Warn("Unable to record session")
+		} else {
+			defer func() {
+				if rec.Limited() {
+					log.WithField("dir", recConf.Dir).Warn("Session recording stopped at the size limit")
+				}
+				rec.Close()
+			}()
+			streamOut = io.MultiWriter(req.Stdout, rec.OutputWriter())
+			if recConf.RecordInput {
+				streamIn = &teeReadCloser{ReadCloser: req.Stdin, w: rec.InputWriter()}
+			}
+			onResize = func(size TtySize) {
+				rec.WriteResize(size.Width, size.Height)
+			}
+		}
+	}
+
+	// forward signals to the process in non-tty sessions.
+	if !useTty && req.Signals != nil {
+		stopForwarding := forwardSignals(ctx, dockerClient, containerId, execCreate.ID, req.Signals, ctxCancel)
+		defer stopForwarding()
+	}
+
+	// pipe the input to the connection
+	errCh := make(chan error, 1)
+	go func() {
+		streamer := execcmd.HijackedIOStreamer{
+			InputStream:  streamIn,
+			OutputStream: streamOut,
+			ErrorStream:  req.Stderr,
+			Resp:         conn,
+			Tty:          useTty,
+		}
+		if useTty && req.RawMode != nil {
+			restore := req.RawMode()
+			defer restore()
+		}
+
+		errCh <- streamer.Stream(ctx)
+	}()
+
+	if useTty {
+		resizeTtyTo(ctx, dockerClient, execCreate.ID, req.Size.Height, req.Size.Width, true)
+		if req.Resize != nil {
+			go relayTtySize(ctx, dockerClient, execCreate.ID, req.Size, req.Resize, onResize)
+		}
+	}
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+
+	// Report the exit status of the process in the container.
+	return checkExecExitCode(ctx, dockerClient, execCreate.ID)
+}
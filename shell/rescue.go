@@ -0,0 +1,112 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// RescueEnv is the environment variable used to request the rescue shell.
+//
+// Can be sent by the client with SendEnv or set with environment= in authorized_keys.
+const RescueEnv = "SKIFF_CORE_RESCUE"
+
+// auditEventRescue is the audit log event when falling back to the rescue shell.
+const auditEventRescue = "rescue"
+
+// defaultRescueShell is the default host shell for rescue.
+var defaultRescueShell = []string{"/bin/sh"}
+
+// rescueRequested checks if the client requested the rescue shell.
+func rescueRequested() bool {
+	switch os.Getenv(RescueEnv) {
+	case "1", "true", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// loadRescueConfig loads the user config if the user is allowed to use the rescue shell.
+//
+// The config is the copy written by setup to UserAdminConfigDir, which the
+// user cannot change. It may be the pending config written before the
+// containers are ready. Restricted users cannot use the rescue shell.
+func (s *Shell) loadRescueConfig() *config.ConfigUserShell {
+	userConfig, err := s.loadUserConfig(adminUserConfigPath())
+	if err != nil || userConfig == nil || !userConfig.Rescue || userConfig.Restrict != nil {
+		return nil
+	}
+	return userConfig
+}
+
+// tryRescue falls back to the rescue shell if the user is allowed to.
+//
+// Returns cause if the user cannot use the rescue shell.
+func (s *Shell) tryRescue(inputCmd string, cause error, errOut io.Writer) error {
+	if cause == nil {
+		return nil
+	}
+	userConfig := s.loadRescueConfig()
+	if userConfig == nil {
+		return cause
+	}
+	return s.rescue(userConfig, inputCmd, cause.Error(), errOut)
+}
+
+// rescue executes the rescue shell on the host.
+func (s *Shell) rescue(
+	userConfig *config.ConfigUserShell,
+	inputCmd string,
+	reason string,
+	errOut io.Writer,
+) error {
+	rescueShell := userConfig.RescueShell
+	if len(rescueShell) == 0 {
+		rescueShell = defaultRescueShell
+	}
+
+	// avoid looping back into skiff-core.
+	if exe, err := os.Executable(); err == nil {
+		shellPath, _ := exec.LookPath(rescueShell[0])
+		if shellPath != "" {
+			shellPath, _ = filepath.EvalSymlinks(shellPath)
+			exe, _ = filepath.EvalSymlinks(exe)
+			if shellPath == exe {
+				return errors.New("rescue shell cannot be skiff-core")
+			}
+		}
+	}
+
+	le := log.
+		WithField("user", currentUserName()).
+		WithField("reason", reason).
+		WithField("shell", rescueShell[0])
+	le.Warn("FALLING BACK TO RESCUE HOST SHELL")
+	fmt.Fprintf(errOut, "\n*** skiff-core: RESCUE MODE ***\n*** %s\n*** Starting host shell %s\n\n", reason, rescueShell[0])
+
+	audit := startAuditSession(userConfig.AuditLog, auditRecord{
+		Source:  os.Getenv("SSH_CONNECTION"),
+		Command: inputCmd,
+		Error:   reason,
+	})
+	audit.Event(auditEventRescue)
+
+	argv := append([]string(nil), rescueShell...)
+	if inputCmd != "" {
+		argv = append(argv, "-c", inputCmd)
+	}
+	err := runHostCmd(
+		argv,
+		[]string{"SKIFF_CORE_RESCUE_REASON=" + reason},
+		os.Stdin, os.Stdout, os.Stderr,
+	)
+	audit.End(err)
+	return err
+}
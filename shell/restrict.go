@@ -0,0 +1,74 @@
+package shell
+
+import (
+	"path"
+	"strings"
+
+	"github.com/mgutz/str"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// originalCommandEnv is set to the command sent by the client when a command is forced.
+const originalCommandEnv = "SSH_ORIGINAL_COMMAND"
+
+// restrictedCmd is the result of checking a command against the restrictions.
+type restrictedCmd struct {
+	// Command is the command to run.
+	Command string
+	// Direct indicates the command must be executed without the user shell.
+	Direct bool
+	// Forced indicates Command is the forced command.
+	Forced bool
+}
+
+// matchCommandPattern checks if the argv matches an allowCommands pattern.
+func matchCommandPattern(pattern string, argv []string) bool {
+	words := strings.Fields(pattern)
+	for i, word := range words {
+		if word == "**" && i == len(words)-1 {
+			return true
+		}
+		if i >= len(argv) {
+			return false
+		}
+		if ok, _ := path.Match(word, argv[i]); !ok {
+			return false
+		}
+	}
+	return len(words) == len(argv)
+}
+
+// restrictCmd checks the command against the restrictions of the user.
+//
+// Returns a *RejectError if the command is not allowed.
+func restrictCmd(restrict *config.ConfigUserRestrict, inputCmd string, useTty bool) (*restrictedCmd, error) {
+	if restrict == nil {
+		return &restrictedCmd{Command: inputCmd}, nil
+	}
+	if useTty && !restrict.AllowTty {
+		return nil, &RejectError{Message: "interactive sessions are not allowed"}
+	}
+	if restrict.ForceCommand != "" {
+		return &restrictedCmd{Command: restrict.ForceCommand, Forced: true}, nil
+	}
+
+	argv := str.ToArgv(inputCmd)
+	if len(argv) == 0 {
+		if !restrict.AllowTty {
+			return nil, &RejectError{Message: "interactive sessions are not allowed"}
+		}
+		return &restrictedCmd{Command: inputCmd}, nil
+	}
+	if _, isSftp := buildSSHSubsystemCmd(inputCmd); isSftp {
+		if !restrict.AllowSftp {
+			return nil, &RejectError{Message: "sftp is not allowed"}
+		}
+		return &restrictedCmd{Command: inputCmd}, nil
+	}
+	for _, pattern := range restrict.AllowCommands {
+		if matchCommandPattern(pattern, argv) {
+			return &restrictedCmd{Command: inputCmd, Direct: true}, nil
+		}
+	}
+	return nil, &RejectError{Message: "command not allowed: " + argv[0]}
+}
@@ -0,0 +1,81 @@
+package shell
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func TestRestrictCmdAllowsMatchingCommand(t *testing.T) {
+	restrict := &config.ConfigUserRestrict{
+		AllowCommands: []string{"rsync --server **", "docker compose pull"},
+	}
+	for _, cmd := range []string{
+		"rsync --server -vlogDtpre.iLsfxC . /srv/app",
+		"docker compose pull",
+	} {
+		res, err := restrictCmd(restrict, cmd, false)
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		if res.Command != cmd || !res.Direct || res.Forced {
+			t.Fatalf("%s: unexpected result: %+v", cmd, res)
+		}
+	}
+}
+
+func TestRestrictCmdRejectsOtherCommands(t *testing.T) {
+	restrict := &config.ConfigUserRestrict{
+		AllowCommands: []string{"docker compose pull", "deploy.sh *"},
+	}
+	for _, cmd := range []string{
+		"docker compose pull extra",
+		"docker compose",
+		"deploy.sh",
+		"rm -rf /",
+		"",
+	} {
+		_, err := restrictCmd(restrict, cmd, false)
+		var rejectErr *RejectError
+		if !errors.As(err, &rejectErr) {
+			t.Fatalf("%q: expected RejectError, got %v", cmd, err)
+		}
+	}
+}
+
+func TestRestrictCmdForceCommand(t *testing.T) {
+	res, err := restrictCmd(&config.ConfigUserRestrict{
+		ForceCommand: "/usr/local/bin/deploy",
+	}, "rm -rf /", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Command != "/usr/local/bin/deploy" || !res.Forced || res.Direct {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestRestrictCmdTtyAndSftpToggles(t *testing.T) {
+	restrict := &config.ConfigUserRestrict{ForceCommand: "deploy"}
+	if _, err := restrictCmd(restrict, "", true); err == nil {
+		t.Fatal("expected tty to be rejected")
+	}
+	restrict.AllowTty = true
+	if _, err := restrictCmd(restrict, "", true); err != nil {
+		t.Fatalf("expected tty to be allowed: %v", err)
+	}
+
+	restrict = &config.ConfigUserRestrict{}
+	if _, err := restrictCmd(restrict, "/usr/libexec/sftp-server", false); err == nil {
+		t.Fatal("expected sftp to be rejected")
+	}
+	restrict.AllowSftp = true
+	res, err := restrictCmd(restrict, "/usr/libexec/sftp-server", false)
+	if err != nil {
+		t.Fatalf("expected sftp to be allowed: %v", err)
+	}
+	if res.Direct {
+		t.Fatal("expected sftp to use the subsystem handling")
+	}
+}
@@ -0,0 +1,121 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mgutz/str"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// routeArgsPattern matches the arguments after the first word of a command.
+var routeArgsPattern = regexp.MustCompile(`^\s*\S+\s*(.*)$`)
+
+// RejectError is returned when a route rejects the command.
+type RejectError struct {
+	// Message is the message configured on the route.
+	Message string
+}
+
+// Error returns the error string.
+func (e *RejectError) Error() string {
+	if e.Message == "" {
+		return "command not allowed"
+	}
+	return e.Message
+}
+
+// routedCmd is the result of routing a command.
+type routedCmd struct {
+	// Command is the command to run.
+	Command string
+	// ContainerId is the container to run the command in.
+	ContainerId string
+	// User is the container user to run the command as.
+	User string
+	// Host indicates the command runs on the host.
+	Host bool
+}
+
+// matchRoute checks if the route matches the command.
+//
+// Returns the expanded command if the route matches.
+func matchRoute(route *config.ConfigUserRoute, inputCmd string) (string, bool, error) {
+	var tmplRe *regexp.Regexp
+	if route.Argv0 != "" {
+		argv := str.ToArgv(inputCmd)
+		if len(argv) == 0 || path.Base(argv[0]) != route.Argv0 {
+			return "", false, nil
+		}
+		tmplRe = routeArgsPattern
+	}
+	if route.Match != "" {
+		re, err := regexp.Compile(route.Match)
+		if err != nil {
+			return "", false, err
+		}
+		if !re.MatchString(inputCmd) {
+			return "", false, nil
+		}
+		tmplRe = re
+	}
+	if tmplRe == nil {
+		return "", false, errors.New("route must set match or argv0")
+	}
+	if route.Command == "" {
+		return inputCmd, true, nil
+	}
+
+	var res []byte
+	for _, submatches := range tmplRe.FindAllStringSubmatchIndex(inputCmd, 1) {
+		res = tmplRe.ExpandString(res, route.Command, inputCmd, submatches)
+	}
+	return string(res), true, nil
+}
+
+// routeCmd applies the first matching route to the command.
+//
+// containerId is the container selected for the session.
+// Returns a *RejectError if the route rejects the command.
+func routeCmd(userConfig *config.ConfigUserShell, containerId, inputCmd string) (*routedCmd, error) {
+	res := &routedCmd{
+		Command:     inputCmd,
+		ContainerId: containerId,
+		User:        userConfig.User,
+	}
+	for i, route := range userConfig.Routes {
+		if route == nil {
+			continue
+		}
+		cmd, ok, err := matchRoute(route, inputCmd)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %v", i, err)
+		}
+		if !ok {
+			continue
+		}
+		log.WithField("route", i).Debug("Command matched route")
+		if route.Reject {
+			return nil, &RejectError{Message: route.Message}
+		}
+		res.Command = cmd
+		res.Host = route.Host
+		if route.User != "" {
+			res.User = route.User
+		}
+		if route.Container != "" {
+			name := strings.TrimPrefix(route.Container, "/")
+			container, ok := userConfig.Containers[name]
+			if !ok || container == nil || container.Id == "" {
+				return nil, fmt.Errorf("routes[%d]: container %s is not allowed", i, name)
+			}
+			res.ContainerId = container.Id
+		}
+		break
+	}
+	return res, nil
+}
@@ -0,0 +1,157 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+func routeTestConfig(routes ...*config.ConfigUserRoute) *config.ConfigUserShell {
+	return &config.ConfigUserShell{
+		ContainerId: "core-id",
+		User:        "core",
+		Containers: map[string]*config.ConfigUserShellContainer{
+			"core": {Id: "core-id"},
+			"git":  {Id: "git-id"},
+		},
+		Routes: routes,
+	}
+}
+
+func TestRouteCmdDefaultsToSelectedContainer(t *testing.T) {
+	routed, err := routeCmd(routeTestConfig(&config.ConfigUserRoute{
+		Argv0:     "git-upload-pack",
+		Container: "git",
+	}), "core-id", "ls -la")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if routed.Command != "ls -la" || routed.ContainerId != "core-id" || routed.User != "core" || routed.Host {
+		t.Fatalf("unexpected route result: %+v", routed)
+	}
+}
+
+func TestRouteCmdArgv0RoutesToContainer(t *testing.T) {
+	routed, err := routeCmd(routeTestConfig(&config.ConfigUserRoute{
+		Argv0:     "git-upload-pack",
+		Container: "git",
+		User:      "git",
+		Command:   "git-upload-pack --strict $1",
+	}), "core-id", "/usr/bin/git-upload-pack 'repo.git'")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if routed.ContainerId != "git-id" || routed.User != "git" {
+		t.Fatalf("unexpected route result: %+v", routed)
+	}
+	if expected := "git-upload-pack --strict 'repo.git'"; routed.Command != expected {
+		t.Fatalf("expected %q, got %q", expected, routed.Command)
+	}
+}
+
+func TestRouteCmdMatchRewritesCommand(t *testing.T) {
+	routed, err := routeCmd(routeTestConfig(&config.ConfigUserRoute{
+		Match:   `^rsync --server (.*)$`,
+		Command: "/opt/rsync/bin/rsync --server $1",
+	}), "core-id", "rsync --server -vlogDtpre.iLsfxC . /data")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "/opt/rsync/bin/rsync --server -vlogDtpre.iLsfxC . /data"; routed.Command != expected {
+		t.Fatalf("expected %q, got %q", expected, routed.Command)
+	}
+}
+
+func TestRouteCmdFirstMatchWins(t *testing.T) {
+	routed, err := routeCmd(routeTestConfig(
+		&config.ConfigUserRoute{Match: `^skiff-core `, Host: true},
+		&config.ConfigUserRoute{Match: `.*`, Reject: true},
+	), "core-id", "skiff-core setup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !routed.Host || routed.Command != "skiff-core setup" {
+		t.Fatalf("unexpected route result: %+v", routed)
+	}
+}
+
+func TestRouteCmdReject(t *testing.T) {
+	_, err := routeCmd(routeTestConfig(&config.ConfigUserRoute{
+		Argv0:   "git-receive-pack",
+		Reject:  true,
+		Message: "pushing is disabled",
+	}), "core-id", "git-receive-pack 'repo.git'")
+	var rejectErr *RejectError
+	if !errors.As(err, &rejectErr) {
+		t.Fatalf("expected RejectError, got %v", err)
+	}
+	if rejectErr.Error() != "pushing is disabled" {
+		t.Fatalf("unexpected message: %q", rejectErr.Error())
+	}
+}
+
+func TestRouteCmdEnforcesContainerAllowlist(t *testing.T) {
+	_, err := routeCmd(routeTestConfig(&config.ConfigUserRoute{
+		Argv0:     "make",
+		Container: "build",
+	}), "core-id", "make all")
+	if err == nil {
+		t.Fatal("expected error for container not in allowlist")
+	}
+}
+
+func TestRunHostRouteWithoutShell(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := runHostRoute(routeTestConfig(), "echo 'a b'; touch injected", &Request{
+		Stdin:  io.NopCloser(strings.NewReader("")),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "a b; touch injected\n"; stdout.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, stdout.String())
+	}
+
+	var rejectErr *RejectError
+	if err := runHostRoute(routeTestConfig(), "", &Request{}); !errors.As(err, &rejectErr) {
+		t.Fatalf("expected empty host command to be rejected, got %v", err)
+	}
+}
+
+func TestBuildUserConfigValidatesRoutes(t *testing.T) {
+	conf := &config.Config{Users: map[string]*config.ConfigUser{
+		"core": {
+			Container: "core",
+			Routes:    []*config.ConfigUserRoute{{Argv0: "git", Container: "other"}},
+		},
+	}}
+	if _, err := BuildUserConfig(context.Background(), conf, "core"); err == nil || !strings.Contains(err.Error(), "routes[0]") {
+		t.Fatalf("expected invalid route error, got %v", err)
+	}
+}
+
+func TestRoutesOnlyFromAdminConfig(t *testing.T) {
+	// the user added a host route to the copy in the home dir.
+	homeConf := routeTestConfig(&config.ConfigUserRoute{Match: ".*", Host: true})
+	homeDir := writeRescueTestConfigs(t, homeConf, routeTestConfig())
+	s := NewShell(homeDir)
+
+	userConfig, err := s.waitUserConfig(context.Background(), io.Discard)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	routed, err := routeCmd(userConfig, userConfig.ContainerId, "sh")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if routed.Host || routed.ContainerId != "core-id" {
+		t.Fatalf("expected the command to run in the container, got %+v", routed)
+	}
+}
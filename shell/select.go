@@ -0,0 +1,57 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/skiffos/skiff-core/config"
+)
+
+// ContainerSelectEnv is the environment variable used to select a container.
+//
+// Can be sent by the client with SendEnv or set with environment= in authorized_keys.
+const ContainerSelectEnv = "SKIFF_CORE_CONTAINER"
+
+// containerSelectPrefix is the prefix of the container name in the SSH command.
+// ex: ssh core@host @other-container ls
+const containerSelectPrefix = "@"
+
+// splitContainerPrefix splits a @container prefix from the input command.
+//
+// Returns the selected container name (or empty) and the remaining command.
+func splitContainerPrefix(inputCmd string) (string, string) {
+	trimmed := strings.TrimLeft(inputCmd, " \t")
+	if !strings.HasPrefix(trimmed, containerSelectPrefix) {
+		return "", inputCmd
+	}
+
+	trimmed = trimmed[len(containerSelectPrefix):]
+	name, rest, _ := strings.Cut(trimmed, " ")
+	return name, strings.TrimLeft(rest, " \t")
+}
+
+// selectContainer selects the container for the session.
+//
+// The @container prefix on the command takes precedence over the
+// SKIFF_CORE_CONTAINER environment variable. If neither is set, the default
+// container is used. Returns the container ID and the remaining command.
+func selectContainer(
+	userConfig *config.ConfigUserShell,
+	inputCmd string,
+	getEnv func(key string) string,
+) (string, string, error) {
+	name, inputCmd := splitContainerPrefix(inputCmd)
+	if name == "" && getEnv != nil {
+		name = strings.TrimSpace(getEnv(ContainerSelectEnv))
+	}
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		return userConfig.ContainerId, inputCmd, nil
+	}
+
+	ctr, ok := userConfig.Containers[name]
+	if !ok || ctr == nil || ctr.Id == "" {
+		return "", "", fmt.Errorf("Container %s is not allowed for this user.", name)
+	}
+	return ctr.Id, inputCmd, nil
+}
@@ -0,0 +1,383 @@
+package shell
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	gosignal "os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/moby/sys/signal"
+	"github.com/moby/term"
+	"github.com/pkg/errors"
+	"github.com/skiffos/skiff-core/util/execcmd"
+)
+
+// SessionEnv is the environment variable used to select a persistent session.
+//
+// Can be sent by the client with SendEnv.
+const SessionEnv = "SKIFF_CORE_SESSION"
+
+// SessionsDir is the directory in the home dir containing persistent sessions.
+const SessionsDir = ".skiff-core-sessions"
+
+// SessionServerCommand is the skiff-core command which runs a session server.
+const SessionServerCommand = "session-server"
+
+// DefaultDetachKeys is the default key sequence to detach from a session.
+const DefaultDetachKeys = "ctrl-p,ctrl-q"
+
+// Session files, suffixed to the session name.
+const (
+	sessionSpecExt = ".json"
+	sessionSockExt = ".sock"
+	sessionExitExt = ".exit"
+	sessionLogExt  = ".log"
+)
+
+// Session connection types, sent as the first byte by the client.
+const (
+	sessionConnAttach byte = 'a'
+	sessionConnResize byte = 'r'
+	sessionConnAgent  byte = 'g'
+)
+
+// sessionNamePattern matches valid session names.
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// startSessionServer starts the session server process.
+var startSessionServer = spawnSessionServer
+
+// sessionStartTimeout is the max time to wait for a session server to start.
+var sessionStartTimeout = time.Second * 10
+
+// sessionSpec describes a persistent session.
+type sessionSpec struct {
+	Name        string    `json:"name"`
+	Created     time.Time `json:"created"`
+	ContainerId string    `json:"containerId"`
+	User        string    `json:"user,omitempty"`
+	Cmd         []string  `json:"cmd"`
+	Env         []string  `json:"env,omitempty"`
+	Height      uint      `json:"height,omitempty"`
+	Width       uint      `json:"width,omitempty"`
+	// Source is the SSH_CONNECTION which started the session.
+	Source string `json:"source,omitempty"`
+	// AgentSocket is the SSH agent socket of the client which started the session.
+	AgentSocket string `json:"agentSocket,omitempty"`
+	// Pid is the pid of the session server.
+	Pid int `json:"pid,omitempty"`
+}
+
+// SessionInfo is information about a running persistent session.
+type SessionInfo struct {
+	Name        string
+	Created     time.Time
+	ContainerId string
+	Cmd         []string
+}
+
+// SetSession sets the name of the persistent session to attach to or create.
+//
+// If empty, Execute runs a regular session.
+func (s *Shell) SetSession(name string) {
+	s.sessionName = name
+}
+
+// SetDetachKeys sets the key sequence to detach from a persistent session.
+func (s *Shell) SetDetachKeys(keys string) {
+	s.detachKeys = keys
+}
+
+// validateSessionName checks the name of a session.
+func validateSessionName(name string) error {
+	if !sessionNamePattern.MatchString(name) {
+		return errors.Errorf("invalid session name: %q", name)
+	}
+	return nil
+}
+
+// sessionsDir returns the path to the sessions dir.
+func (s *Shell) sessionsDir() string {
+	return path.Join(s.homeDir, SessionsDir)
+}
+
+// sessionPath returns the path to a session file.
+func (s *Shell) sessionPath(name, ext string) string {
+	return path.Join(s.sessionsDir(), name+ext)
+}
+
+// readSessionSpec reads the spec of a session.
+func (s *Shell) readSessionSpec(name string) (*sessionSpec, error) {
+	data, err := os.ReadFile(s.sessionPath(name, sessionSpecExt))
+	if err != nil {
+		return nil, err
+	}
+	spec := &sessionSpec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// writeSessionSpec writes the spec of a session.
+func (s *Shell) writeSessionSpec(spec *sessionSpec) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.sessionPath(spec.Name, sessionSpecExt), data, 0600)
+}
+
+// removeSessionFiles removes the files of a session.
+func (s *Shell) removeSessionFiles(name string, exts ...string) {
+	for _, ext := range exts {
+		_ = os.Remove(s.sessionPath(name, ext))
+	}
+}
+
+// dialSession connects to the server of a session.
+func (s *Shell) dialSession(name string, connType byte) (net.Conn, error) {
+	conn, err := net.Dial("unix", s.sessionPath(name, sessionSockExt))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{connType}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// isSessionRunning checks if the session server is accepting connections.
+func (s *Shell) isSessionRunning(name string) bool {
+	conn, err := net.Dial("unix", s.sessionPath(name, sessionSockExt))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// ListSessions lists the running persistent sessions.
+//
+// Removes the files of sessions which are no longer running.
+func (s *Shell) ListSessions() ([]*SessionInfo, error) {
+	matches, err := filepath.Glob(path.Join(s.sessionsDir(), "*"+sessionSpecExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*SessionInfo
+	for _, match := range matches {
+		name := strings.TrimSuffix(path.Base(match), sessionSpecExt)
+		spec, err := s.readSessionSpec(name)
+		if err != nil || !s.isSessionRunning(name) {
+			s.removeSessionFiles(name, sessionSpecExt, sessionSockExt, sessionExitExt)
+			continue
+		}
+		res = append(res, &SessionInfo{
+			Name:        spec.Name,
+			Created:     spec.Created,
+			ContainerId: spec.ContainerId,
+			Cmd:         spec.Cmd,
+		})
+	}
+	return res, nil
+}
+
+// AttachSession attaches to a running persistent session.
+//
+// Returns an *ExitError if the session ends with a non-zero exit status.
+func (s *Shell) AttachSession(name string) error {
+	return s.attachSession(name, os.Getenv(agentSockEnv))
+}
+
+// attachSession attaches to a running persistent session.
+//
+// The session relays SSH agent connections to agentSocket, if set.
+func (s *Shell) attachSession(name, agentSocket string) error {
+	if err := validateSessionName(name); err != nil {
+		return err
+	}
+	if !s.isSessionRunning(name) {
+		return errors.Errorf("no such session: %s", name)
+	}
+
+	in := execcmd.NewInStream(os.Stdin, true)
+	out := execcmd.NewOutStream(os.Stdout)
+	inStrm, _ := in.(*execcmd.InStream)
+	outStrm, _ := out.(*execcmd.OutStream)
+	if inStrm == nil || !inStrm.IsTty() || outStrm == nil {
+		return errors.New("attaching to a session requires a tty")
+	}
+
+	detachKeys := s.detachKeys
+	if detachKeys == "" {
+		detachKeys = DefaultDetachKeys
+	}
+	detachKeyBytes, err := term.ToBytes(detachKeys)
+	if err != nil {
+		return errors.Wrap(err, "invalid detach keys")
+	}
+
+	if agentSocket != "" {
+		if err := s.setSessionAgent(name, agentSocket); err != nil {
+			return err
+		}
+	}
+
+	conn, err := s.dialSession(name, sessionConnAttach)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	// resize the session to the terminal size and on SIGWINCH
+	resize := func() {
+		height, width := outStrm.GetTtySize()
+		if err := s.resizeSession(name, height, width); err != nil {
+			// the session may have exited
+			return
+		}
+	}
+	resize()
+	sigchan := make(chan os.Signal, 1)
+	gosignal.Notify(sigchan, signal.SIGWINCH)
+	defer gosignal.Stop(sigchan)
+	go func() {
+		for range sigchan {
+			resize()
+		}
+	}()
+
+	streamer := execcmd.HijackedIOStreamer{
+		InputStream:  io.NopCloser(term.NewEscapeProxy(in, detachKeyBytes)),
+		OutputStream: out,
+		Resp: types.HijackedResponse{
+			Conn:   conn,
+			Reader: bufio.NewReader(conn),
+		},
+		Tty: true,
+	}
+	inStrm.SetRawMode()
+	err = streamer.Stream(ctx)
+	inStrm.RestoreTerminal()
+	if _, ok := err.(term.EscapeError); ok {
+		fmt.Fprintf(os.Stderr, "\r\n[detached from session %s]\r\n", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the output closed: either the session exited or the server died.
+	return s.readSessionExit(name)
+}
+
+// readSessionExit reads the exit status written by the session server.
+func (s *Shell) readSessionExit(name string) error {
+	exitPath := s.sessionPath(name, sessionExitExt)
+	deadline := time.Now().Add(execExitTimeout)
+	for {
+		data, err := os.ReadFile(exitPath)
+		if err == nil {
+			_ = os.Remove(exitPath)
+			code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				return &ExitError{Code: code}
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) || time.Now().After(deadline) {
+			return errors.Errorf("connection to session %s lost", name)
+		}
+		<-time.After(execExitPollInterval)
+	}
+}
+
+// resizeSession sends a terminal size to the session server.
+func (s *Shell) resizeSession(name string, height, width uint) error {
+	if height == 0 && width == 0 {
+		return nil
+	}
+	conn, err := s.dialSession(name, sessionConnResize)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf [4]byte
+	binary.BigEndian.PutUint16(buf[:2], uint16(height))
+	binary.BigEndian.PutUint16(buf[2:], uint16(width))
+	_, err = conn.Write(buf[:])
+	return err
+}
+
+// setSessionAgent sends the SSH agent socket of the client to the session server.
+func (s *Shell) setSessionAgent(name, agentSocket string) error {
+	if len(agentSocket) > 0xffff {
+		return errors.New("agent socket path too long")
+	}
+	conn, err := s.dialSession(name, sessionConnAgent)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 2, 2+len(agentSocket))
+	binary.BigEndian.PutUint16(buf, uint16(len(agentSocket)))
+	_, err = conn.Write(append(buf, agentSocket...))
+	return err
+}
+
+// startSession starts the server for a new persistent session.
+func (s *Shell) startSession(spec *sessionSpec) error {
+	if err := os.MkdirAll(s.sessionsDir(), 0700); err != nil {
+		return err
+	}
+	s.removeSessionFiles(spec.Name, sessionSockExt, sessionExitExt)
+	spec.Created = time.Now()
+	if err := s.writeSessionSpec(spec); err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(s.sessionPath(spec.Name, sessionLogExt), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	if err := startSessionServer(spec.Name, logFile); err != nil {
+		return errors.Wrap(err, "start session server")
+	}
+
+	deadline := time.Now().Add(sessionStartTimeout)
+	for !s.isSessionRunning(spec.Name) {
+		if time.Now().After(deadline) {
+			return errors.Errorf(
+				"session server did not start, see %s",
+				s.sessionPath(spec.Name, sessionLogExt),
+			)
+		}
+		<-time.After(time.Millisecond * 50)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package shell
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/util/asciicast"
+)
+
+// sessionScrollback is the amount of output replayed when attaching.
+const sessionScrollback = 64 * 1024
+
+// sessionWriteTimeout is the max time to block writing output to a client.
+var sessionWriteTimeout = time.Second * 5
+
+// sessionServer holds the exec of a persistent session and relays it to the
+// attached client, if any.
+type sessionServer struct {
+	mtx        sync.Mutex
+	client     net.Conn
+	scrollback []byte
+
+	// rec is the recording of the session, if enabled.
+	rec *asciicast.Writer
+	// recordInput indicates the input is also recorded.
+	recordInput bool
+	// agent relays SSH agent connections, if enabled.
+	agent *agentProxy
+}
+
+// ServeSession runs the server of a persistent session.
+//
+// Called in a detached process started by the shell. Exits when the process
+// in the container exits. The session is recorded and written to the audit
+// log as configured in the user config written by setup.
+func (s *Shell) ServeSession(name string) (serveErr error) {
+	if err := validateSessionName(name); err != nil {
+		return err
+	}
+	spec, err := s.readSessionSpec(name)
+	if err != nil {
+		return err
+	}
+	userConfig, err := s.loadUserConfig(adminUserConfigPath())
+	if err != nil {
+		return errors.Wrap(err, "load user config")
+	}
+	if err := s.checkSessionSpec(userConfig, spec); err != nil {
+		return err
+	}
+	spec.Pid = os.Getpid()
+	if err := s.writeSessionSpec(spec); err != nil {
+		return err
+	}
+	le := log.WithField("session", name)
+
+	dockerClient, err := s.buildDockerClient()
+	if err != nil {
+		return err
+	}
+	defer dockerClient.Close()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	audit := startAuditSession(userConfig.AuditLog, auditRecord{
+		ContainerId:       spec.ContainerId,
+		ContainerUser:     spec.User,
+		Source:            spec.Source,
+		Tty:               true,
+		PersistentSession: name,
+	})
+	defer func() {
+		audit.End(serveErr)
+	}()
+
+	// keep the container from idle shutdown while the session is running.
+	idle := registerIdleSession(userConfig, spec.ContainerId)
+	defer idle.Close()
+
+	srv := &sessionServer{}
+	env := spec.Env
+	if spec.AgentSocket != "" && userConfig.SSHAgent != nil {
+		srv.agent, err = startAgentProxy(userConfig.SSHAgent, spec.AgentSocket)
+		if err != nil {
+			le.WithError(err).Warn("Unable to forward SSH agent")
+		} else {
+			defer srv.agent.Close()
+			env = setShellEnv(env, agentSockEnv, srv.agent.ContainerPath())
+		}
+	}
+
+	execCreate, err := dockerClient.ContainerExecCreate(ctx, spec.ContainerId, types.ExecConfig{
+		Tty:  true,
+		User: spec.User,
+		Cmd:  spec.Cmd,
+		Env:  env,
+
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := dockerClient.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{
+		Tty: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	resizeTtyTo(ctx, dockerClient, execCreate.ID, spec.Height, spec.Width, true)
+
+	if recConf := userConfig.RecordSessions; recConf != nil {
+		srv.rec, err = openSessionRecording(recConf, spec.Width, spec.Height, map[string]string{
+			"TERM":  getShellEnv(spec.Env, "TERM"),
+			"SHELL": spec.Cmd[0],
+		})
+		if err != nil {
+			le.WithError(err).Warn("Unable to record session")
+		} else {
+			defer func() {
+				if srv.rec.Limited() {
+					le.WithField("dir", recConf.Dir).Warn("Session recording stopped at the size limit")
+				}
+				srv.rec.Close()
+			}()
+			srv.recordInput = recConf.RecordInput
+		}
+	}
+
+	sockPath := s.sessionPath(name, sessionSockExt)
+	_ = os.Remove(sockPath)
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(sockPath, 0600); err != nil {
+		return err
+	}
+	le.Debug("Session started")
+
+	go func() {
+		for {
+			clientConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handleConn(clientConn, conn.Conn, func(height, width uint) {
+				resizeTtyTo(ctx, dockerClient, execCreate.ID, height, width, true)
+				if srv.rec != nil {
+					srv.rec.WriteResize(width, height)
+				}
+			})
+		}
+	}()
+
+	// relay output until the process exits
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := conn.Reader.Read(buf)
+		if n > 0 {
+			srv.writeOutput(buf[:n])
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				le.WithError(rerr).Warn("Error reading session output")
+			}
+			break
+		}
+	}
+
+	code, err := waitExecExitCode(ctx, dockerClient, execCreate.ID)
+	if err != nil {
+		code = 1
+		le.WithError(err).Warn("Unable to determine session exit status")
+	}
+	le.WithField("exit-code", code).Debug("Session exited")
+
+	// write the exit status before disconnecting the client.
+	exitPath := s.sessionPath(name, sessionExitExt)
+	if err := os.WriteFile(exitPath, []byte(strconv.Itoa(code)+"\n"), 0600); err != nil {
+		le.WithError(err).Warn("Unable to write session exit status")
+	}
+	listener.Close()
+	srv.closeClient()
+	s.removeSessionFiles(name, sessionSpecExt, sessionSockExt)
+	if code != 0 {
+		// the session server itself succeeded.
+		audit.End(&ExitError{Code: code})
+		audit = nil
+	}
+	return nil
+}
+
+// checkSessionSpec checks the spec of a session against the user config.
+//
+// The spec is in the home dir and may have been changed by the user. It must
+// match the login shell which Run starts for the container.
+func (s *Shell) checkSessionSpec(userConfig *config.ConfigUserShell, spec *sessionSpec) error {
+	allowed := spec.ContainerId != "" && spec.ContainerId == userConfig.ContainerId
+	for _, ctr := range userConfig.Containers {
+		if ctr != nil && ctr.Id != "" && ctr.Id == spec.ContainerId {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return errors.Errorf("session %s: container %s is not allowed for this user", spec.Name, spec.ContainerId)
+	}
+
+	restricted, err := restrictCmd(userConfig.Restrict, "", true)
+	if err != nil {
+		return err
+	}
+	routed, err := routeCmd(userConfig, spec.ContainerId, restricted.Command)
+	if err != nil {
+		return err
+	}
+	if restricted.Command != "" || routed.Host || routed.Command != "" || routed.ContainerId != spec.ContainerId {
+		return errors.Errorf("session %s: persistent sessions are only available for the login shell", spec.Name)
+	}
+	cmd, err := s.buildTargetCmd(userConfig, "", false)
+	if err != nil {
+		return err
+	}
+	if spec.User != routed.User || !slices.Equal(spec.Cmd, cmd) {
+		return errors.Errorf("session %s: the session does not match the user config", spec.Name)
+	}
+	return nil
+}
+
+// handleConn handles a connection from a client.
+func (srv *sessionServer) handleConn(
+	clientConn net.Conn,
+	execConn net.Conn,
+	resize func(height, width uint),
+) {
+	var connType [1]byte
+	if _, err := io.ReadFull(clientConn, connType[:]); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	switch connType[0] {
+	case sessionConnResize:
+		defer clientConn.Close()
+		var buf [4]byte
+		if _, err := io.ReadFull(clientConn, buf[:]); err != nil {
+			return
+		}
+		resize(uint(binary.BigEndian.Uint16(buf[:2])), uint(binary.BigEndian.Uint16(buf[2:])))
+	case sessionConnAgent:
+		defer clientConn.Close()
+		var buf [2]byte
+		if _, err := io.ReadFull(clientConn, buf[:]); err != nil {
+			return
+		}
+		agentSocket := make([]byte, binary.BigEndian.Uint16(buf[:]))
+		if _, err := io.ReadFull(clientConn, agentSocket); err != nil {
+			return
+		}
+		if srv.agent != nil {
+			srv.agent.SetAgentPath(string(agentSocket))
+		}
+	case sessionConnAttach:
+		srv.attach(clientConn)
+		// copy input until the client disconnects.
+		var input io.Reader = clientConn
+		if srv.rec != nil && srv.recordInput {
+			input = io.TeeReader(clientConn, srv.rec.InputWriter())
+		}
+		_, err := io.Copy(execConn, input)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.WithError(err).Debug("Session client disconnected")
+		}
+		srv.detach(clientConn)
+	default:
+		clientConn.Close()
+	}
+}
+
+// attach sets the attached client, replacing any existing client.
+func (srv *sessionServer) attach(clientConn net.Conn) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	if srv.client != nil {
+		srv.client.Close()
+	}
+	srv.client = clientConn
+	if len(srv.scrollback) != 0 {
+		_ = clientConn.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+		_, _ = clientConn.Write(srv.scrollback)
+	}
+}
+
+// detach removes the client if it is still attached.
+func (srv *sessionServer) detach(clientConn net.Conn) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	if srv.client == clientConn {
+		srv.client = nil
+	}
+	clientConn.Close()
+}
+
+// closeClient disconnects the attached client.
+func (srv *sessionServer) closeClient() {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+	if srv.client != nil {
+		srv.client.Close()
+		srv.client = nil
+	}
+}
+
+// writeOutput writes output to the scrollback and the attached client.
+func (srv *sessionServer) writeOutput(p []byte) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	if srv.rec != nil {
+		srv.rec.WriteOutput(p)
+	}
+	srv.scrollback = append(srv.scrollback, p...)
+	if over := len(srv.scrollback) - sessionScrollback; over > 0 {
+		srv.scrollback = append(srv.scrollback[:0], srv.scrollback[over:]...)
+	}
+	if srv.client != nil {
+		_ = srv.client.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+		if _, err := srv.client.Write(p); err != nil {
+			// the client is gone: keep running.
+			srv.client.Close()
+			srv.client = nil
+		}
+	}
+}
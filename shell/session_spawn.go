@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// spawnSessionServer starts the session server in a new detached process.
+//
+// The process is started in a new session so it survives the login session.
+func spawnSessionServer(name string, logFile *os.File) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, SessionServerCommand, name)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
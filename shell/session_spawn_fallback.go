@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"errors"
+	"os"
+)
+
+// spawnSessionServer is not supported on this platform.
+func spawnSessionServer(name string, logFile *os.File) error {
+	return errors.New("persistent sessions are not supported on this platform")
+}
@@ -0,0 +1,344 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// setupSessionTest runs the session servers in the test process with a fake client.
+//
+// Returns the connection of the fake process in the container and a channel
+// with the result of the session server.
+func setupSessionTest(t *testing.T, exitCode int) (*Shell, *fakeDockerClient, net.Conn, chan error) {
+	procConn, execConn := net.Pipe()
+	dc := &fakeDockerClient{
+		execConn:     execConn,
+		execInspects: []types.ContainerExecInspect{{ExitCode: exitCode}},
+	}
+	s := NewShell(t.TempDir())
+	served := make(chan error, 1)
+	writeSessionTestConfig(t, &config.ConfigUserShell{ContainerId: "core-id"})
+
+	prevClient, prevStart := newDockerClient, startSessionServer
+	newDockerClient = func() (client.APIClient, error) {
+		return dc, nil
+	}
+	startSessionServer = func(name string, logFile *os.File) error {
+		go func() { served <- s.ServeSession(name) }()
+		return nil
+	}
+	t.Cleanup(func() {
+		newDockerClient, startSessionServer = prevClient, prevStart
+		procConn.Close()
+	})
+	return s, dc, procConn, served
+}
+
+// writeSessionTestConfig writes the user config read by the session server.
+func writeSessionTestConfig(t *testing.T, conf *config.ConfigUserShell) {
+	prevDir := config.UserAdminConfigDir
+	config.UserAdminConfigDir = t.TempDir()
+	t.Cleanup(func() { config.UserAdminConfigDir = prevDir })
+
+	data, err := conf.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(adminUserConfigPath(), data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// readUntil reads from the connection until the output contains expected.
+func readUntil(t *testing.T, conn net.Conn, expected string) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var out bytes.Buffer
+	buf := make([]byte, 256)
+	for !strings.Contains(out.String(), expected) {
+		n, err := conn.Read(buf)
+		out.Write(buf[:n])
+		if err != nil {
+			t.Fatalf("expected %q in output, got %q: %v", expected, out.String(), err)
+		}
+	}
+}
+
+func TestSessionCreateAttachDetachList(t *testing.T) {
+	s, dc, procConn, served := setupSessionTest(t, 3)
+
+	err := s.startSession(&sessionSpec{
+		Name:        "work",
+		ContainerId: "core-id",
+		Cmd:         []string{"/bin/sh"},
+		Height:      24,
+		Width:       80,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	sessions, err := s.ListSessions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sessions) != 1 || sessions[0].Name != "work" || sessions[0].ContainerId != "core-id" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+
+	// output written without a client is replayed when attaching.
+	if _, err := procConn.Write([]byte("hello\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := s.dialSession("work", sessionConnAttach)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	readUntil(t, conn, "hello\r\n")
+
+	// input is relayed to the process.
+	if _, err := conn.Write([]byte("ls\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	input := make([]byte, 3)
+	if _, err := io.ReadFull(procConn, input); err != nil || string(input) != "ls\n" {
+		t.Fatalf("expected input to be relayed, got %q: %v", string(input), err)
+	}
+
+	// detach: the session keeps running.
+	conn.Close()
+	if !s.isSessionRunning("work") {
+		t.Fatal("expected session to keep running after detaching")
+	}
+
+	// attaching again replays the scrollback.
+	conn, err = s.dialSession("work", sessionConnAttach)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	readUntil(t, conn, "hello\r\n")
+
+	if err := s.resizeSession("work", 30, 100); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the resize is applied asynchronously.
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		dc.mtx.Lock()
+		resized := len(dc.execResizes) == 2
+		dc.mtx.Unlock()
+		if resized || time.Now().After(deadline) {
+			break
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+
+	// the process exits: the client is disconnected and the status is reported.
+	procConn.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("expected client to be disconnected: %v", err)
+	}
+	var exitErr *ExitError
+	if err := s.readSessionExit("work"); !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+
+	sessions, err = s.ListSessions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("expected no sessions after exit, got %+v", sessions)
+	}
+
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	expectedResizes := []types.ResizeOptions{{Height: 24, Width: 80}, {Height: 30, Width: 100}}
+	if len(dc.execResizes) != 2 || dc.execResizes[0] != expectedResizes[0] || dc.execResizes[1] != expectedResizes[1] {
+		t.Fatalf("expected resizes %v, got %v", expectedResizes, dc.execResizes)
+	}
+}
+
+func TestSessionAttachReplacesClient(t *testing.T) {
+	s, _, procConn, served := setupSessionTest(t, 0)
+	if err := s.startSession(&sessionSpec{Name: "work", ContainerId: "core-id", Cmd: []string{"/bin/sh"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	first, err := s.dialSession("work", sessionConnAttach)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer first.Close()
+	if _, err := procConn.Write([]byte("first\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	readUntil(t, first, "first\n")
+
+	second, err := s.dialSession("work", sessionConnAttach)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer second.Close()
+	readUntil(t, second, "first\n")
+
+	// the first client is disconnected.
+	_ = first.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.Copy(io.Discard, first); err != nil {
+		t.Fatalf("expected first client to be disconnected: %v", err)
+	}
+
+	procConn.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRunRestrictsBeforeAttachingSession(t *testing.T) {
+	s, _, _, _ := setupSessionTest(t, 0)
+	s.SetSession("work")
+
+	err := s.Run(context.Background(), &config.ConfigUserShell{
+		ContainerId: "core-id",
+		Restrict:    &config.ConfigUserRestrict{AllowCommands: []string{"true"}},
+	}, &Request{Tty: true})
+	var rejectErr *RejectError
+	if !errors.As(err, &rejectErr) {
+		t.Fatalf("expected the session to be rejected, got %v", err)
+	}
+}
+
+func TestServeSessionChecksSpec(t *testing.T) {
+	s, _, _, _ := setupSessionTest(t, 0)
+	writeSessionTestConfig(t, &config.ConfigUserShell{
+		ContainerId: "core-id",
+		Containers:  map[string]*config.ConfigUserShellContainer{"other": {Id: "other-id"}},
+		User:        "core",
+	})
+	if err := os.MkdirAll(s.sessionsDir(), 0700); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the spec is in the home dir and can be changed by the user.
+	cases := []struct {
+		name string
+		spec sessionSpec
+		ok   bool
+	}{
+		{"login shell", sessionSpec{ContainerId: "core-id", User: "core", Cmd: []string{"/bin/sh"}}, true},
+		{"other allowed container", sessionSpec{ContainerId: "other-id", User: "core", Cmd: []string{"/bin/sh"}}, true},
+		{"another container", sessionSpec{ContainerId: "host-id", User: "core", Cmd: []string{"/bin/sh"}}, false},
+		{"another user", sessionSpec{ContainerId: "core-id", User: "root", Cmd: []string{"/bin/sh"}}, false},
+		{"another command", sessionSpec{ContainerId: "core-id", User: "core", Cmd: []string{"/bin/sh", "-c", "id"}}, false},
+	}
+	for _, c := range cases {
+		spec := c.spec
+		spec.Name = "work"
+		if err := s.writeSessionSpec(&spec); err != nil {
+			t.Fatal(err.Error())
+		}
+		userConfig, err := s.loadUserConfig(adminUserConfigPath())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := s.checkSessionSpec(userConfig, &spec); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok %v, got %v", c.name, c.ok, err)
+		}
+		if !c.ok {
+			if err := s.ServeSession("work"); err == nil {
+				t.Errorf("%s: expected the session server to reject the spec", c.name)
+			}
+		}
+	}
+}
+
+func TestSessionServerAuditsAndRecords(t *testing.T) {
+	s, _, procConn, served := setupSessionTest(t, 3)
+	logDir := t.TempDir()
+	writeSessionTestConfig(t, &config.ConfigUserShell{
+		ContainerId:    "core-id",
+		AuditLog:       &config.ConfigUserShellAuditLog{Path: path.Join(logDir, "audit.log")},
+		RecordSessions: &config.ConfigUserRecordSessions{Dir: path.Join(logDir, "recordings")},
+	})
+	err := s.startSession(&sessionSpec{
+		Name:        "work",
+		ContainerId: "core-id",
+		Cmd:         []string{"/bin/sh"},
+		Source:      "192.0.2.1 1234 192.0.2.2 22",
+		Height:      24,
+		Width:       80,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// attaching and detaching does not end the session.
+	conn, err := s.dialSession("work", sessionConnAttach)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := procConn.Write([]byte("hello\r\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	readUntil(t, conn, "hello\r\n")
+	conn.Close()
+
+	procConn.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	data, err := os.ReadFile(path.Join(logDir, "audit.log"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err.Error())
+		}
+		if rec.PersistentSession != "work" || rec.Source != "192.0.2.1 1234 192.0.2.2 22" {
+			t.Errorf("unexpected audit record: %s", line)
+		}
+		if rec.Event == auditEventSessionEnd && (rec.ExitCode == nil || *rec.ExitCode != 3) {
+			t.Errorf("expected exit code 3 at the session end: %s", line)
+		}
+		events = append(events, rec.Event)
+	}
+	if strings.Join(events, ",") != auditEventSessionStart+","+auditEventSessionEnd {
+		t.Fatalf("expected the session start and end, got %v", events)
+	}
+
+	recordings, err := filepath.Glob(path.Join(logDir, "recordings", "*"+recordingExt))
+	if err != nil || len(recordings) != 1 {
+		t.Fatalf("expected one recording, got %v: %v", recordings, err)
+	}
+	data, err = os.ReadFile(recordings[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(data), `hello\r\n`) {
+		t.Fatalf("expected the output in the recording, got %q", string(data))
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api"
@@ -23,6 +25,13 @@ import (
 // Shell holds an instance of a user's interaction with a Docker container.
 type Shell struct {
 	homeDir string
+
+	// sessionName is the name of the persistent session, if any.
+	sessionName string
+	// detachKeys is the key sequence to detach from a persistent session.
+	detachKeys string
+	// setupTimeout is the max time to wait for setup, zero to wait forever.
+	setupTimeout time.Duration
 }
 
 // NewShell builds a new shell instance.
@@ -30,9 +39,30 @@ func NewShell(homeDir string) *Shell {
 	return &Shell{homeDir: homeDir}
 }
 
+// SetSetupTimeout sets the max time to wait for setup to complete.
+//
+// Zero waits forever.
+func (s *Shell) SetSetupTimeout(timeout time.Duration) {
+	s.setupTimeout = timeout
+}
+
+// newDockerClient builds the docker client of the shell.
+var newDockerClient = func() (client.APIClient, error) {
+	return client.NewClient(client.DefaultDockerHost, api.DefaultVersion, nil, nil)
+}
+
 // buildDockerClient builds the docker client.
 func (s *Shell) buildDockerClient() (client.APIClient, error) {
-	return client.NewClient(client.DefaultDockerHost, api.DefaultVersion, nil, nil)
+	return newDockerClient()
+}
+
+// adminUserConfigPath returns the path to the copy of the user config written
+// by setup to UserAdminConfigDir.
+//
+// The copy is owned by root: the shell reads the user config from it, as the
+// user can change the copy in the home directory.
+func adminUserConfigPath() string {
+	return path.Join(config.UserAdminConfigDir, currentUserName()+".yaml")
 }
 
 // loadUserConfig loads the information for this user.
@@ -114,50 +144,43 @@ func (s *Shell) buildTargetCmd(
 	return targetCmd, nil
 }
 
-// Execute executes the shell, redirecting stdin.
-func (s *Shell) Execute(
-	inputCmd string,
-	execWithShell bool,
-) error {
-	dockerClient, err := s.buildDockerClient()
-	if err != nil {
-		return err
-	}
+// setupFailedPattern matches the line written to the setup log when a setup job fails.
+var setupFailedPattern = regexp.MustCompile(`^(Image|Container|User) setup failed for (\S+)`)
 
-	in := execcmd.NewInStream(os.Stdin, true)
-	out := execcmd.NewOutStream(os.Stdout)
-	errOut := execcmd.NewOutStream(os.Stderr)
-	inStrm, _ := in.(*execcmd.InStream)
-	useTty := inStrm != nil && inStrm.IsTty()
-	outStrm, _ := out.(*execcmd.OutStream)
-	// errStrm, _ := errOut.(*execcmd.OutStream)
+// setupFailedGrace is the time to continue printing the setup log after a failure.
+var setupFailedGrace = time.Second
 
-	configPath := path.Join(s.homeDir, config.UserConfigFile)
+// waitUserConfig waits for setup to write the user config.
+//
+// Writes the setup logs to errOut while waiting. Returns an error if the setup
+// log reports a failure or if the setup timeout expires.
+func (s *Shell) waitUserConfig(ctx context.Context, errOut io.Writer) (*config.ConfigUserShell, error) {
+	configPath := adminUserConfigPath()
 	logPath := path.Join(s.homeDir, config.UserLogFile)
 	completeCh := make(chan *config.ConfigUserShell, 1)
+	// pendingConfig is the config written by setup before the containers are ready.
+	var pendingConfig *config.ConfigUserShell
 	checkFiles := func() {
 		var err error
 		userConfig, err := s.loadUserConfig(configPath)
-		if err != nil || userConfig == nil || userConfig.ContainerId == "" {
-			userConfig = nil
+		if err != nil || userConfig == nil {
+			return
 		}
-		if userConfig != nil {
-			select {
-			case completeCh <- userConfig:
-			default:
-			}
+		if userConfig.ContainerId == "" {
+			pendingConfig = userConfig
 			return
 		}
+		select {
+		case completeCh <- userConfig:
+		default:
+		}
 	}
 
-	ctx, ctxCancel := context.WithCancel(context.Background())
-	defer ctxCancel()
-
 	var userConfig *config.ConfigUserShell
 	checkFiles()
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	case userConfig = <-completeCh:
 	default:
 	}
@@ -170,44 +193,88 @@ func (s *Shell) Execute(
 			Follow: true,
 		})
 		if err != nil {
-			return errors.Wrap(err, "tail setup logs")
+			return nil, errors.Wrap(err, "tail setup logs")
 		}
 		defer logTail.Cleanup()
 
+		var timeoutCh <-chan time.Time
+		if s.setupTimeout > 0 {
+			timeoutTimer := time.NewTimer(s.setupTimeout)
+			defer timeoutTimer.Stop()
+			timeoutCh = timeoutTimer.C
+		}
+
+		var failedJob string
+		var failedCh <-chan time.Time
 		pollTimer := time.NewTicker(time.Millisecond * 500)
+		defer pollTimer.Stop()
 		for userConfig == nil {
 			select {
 			case <-ctx.Done():
-				pollTimer.Stop()
-				return ctx.Err()
+				return nil, ctx.Err()
 			case <-pollTimer.C:
 				checkFiles()
 			case line := <-logTail.Lines:
 				errOut.Write([]byte(line.Text + "\n"))
+				if m := setupFailedPattern.FindStringSubmatch(line.Text); m != nil && failedJob == "" {
+					// continue printing the error details briefly.
+					failedJob = strings.ToLower(m[1]) + " " + m[2]
+					failedCh = time.After(setupFailedGrace)
+				}
+			case <-failedCh:
+				if pendingConfig != nil && pendingConfig.Admin {
+					fmt.Fprintf(errOut, setupFailedAdminHelp, failedJob, logPath)
+				}
+				return nil, errors.Errorf("Container setup failed in job: %s", failedJob)
+			case <-timeoutCh:
+				if pendingConfig != nil && pendingConfig.Admin {
+					fmt.Fprintf(errOut, setupTimeoutAdminHelp, logPath)
+				}
+				return nil, errors.Errorf("Timed out waiting for container setup after %s", s.setupTimeout.String())
 			case userConfig = <-completeCh:
 			}
 		}
-		pollTimer.Stop()
 	}
 
-	cmd, err := s.buildTargetCmd(userConfig, inputCmd, execWithShell)
-	if err != nil {
-		return err
-	}
+	return userConfig, nil
+}
 
+// setupFailedAdminHelp is printed to admin users when setup fails.
+const setupFailedAdminHelp = `
+Setup failed in job: %s
+The full setup log for this user is at %s.
+Fix the skiff-core configuration and re-run "skiff-core setup" as root.
+`
+
+// setupTimeoutAdminHelp is printed to admin users when setup does not complete.
+const setupTimeoutAdminHelp = `
+Setup did not complete in time. It may still be running, or it may not have run at all.
+The setup log for this user is at %s.
+Check the status of the skiff-core setup service, or run "skiff-core setup" as root.
+`
+
+// ensureContainerRunning starts the container if it is not running.
+//
+// Writes the container logs to errOut if the container fails to start.
+func ensureContainerRunning(
+	ctx context.Context,
+	dockerClient client.APIClient,
+	containerId string,
+	errOut io.Writer,
+) error {
 	// Probe the state of the container.
-	ins, err := dockerClient.ContainerInspect(ctx, userConfig.ContainerId)
+	ins, err := dockerClient.ContainerInspect(ctx, containerId)
 	if err != nil {
 		return err
 	}
 
 	if ins.State == nil || !ins.State.Running {
-		errOut.Write([]byte("Starting container " + userConfig.ContainerId + "...\n"))
-		if err := execcmd.StartContainer(ctx, dockerClient, userConfig.ContainerId, 0); err != nil {
+		errOut.Write([]byte("Starting container " + containerId + "...\n"))
+		if err := execcmd.StartContainer(ctx, dockerClient, containerId, 0); err != nil {
 			if err == context.Canceled {
 				return err
 			}
-			logsCloser, lerr := dockerClient.ContainerLogs(ctx, userConfig.ContainerId, types.ContainerLogsOptions{
+			logsCloser, lerr := dockerClient.ContainerLogs(ctx, containerId, types.ContainerLogsOptions{
 				ShowStderr: true,
 				ShowStdout: true,
 			})
@@ -218,52 +285,87 @@ func (s *Shell) Execute(
 			return fmt.Errorf("Unable to start container: %s", err.Error())
 		}
 	}
+	return nil
+}
 
-	execCreate, err := dockerClient.ContainerExecCreate(ctx, userConfig.ContainerId, types.ExecConfig{
-		Tty:  useTty,
-		User: userConfig.User,
-		Cmd:  cmd,
-		Env:  buildShellEnv(),
+// Execute executes the shell, redirecting stdin.
+func (s *Shell) Execute(
+	inputCmd string,
+	execWithShell bool,
+) error {
+	in := execcmd.NewInStream(os.Stdin, true)
+	out := execcmd.NewOutStream(os.Stdout)
+	errOut := execcmd.NewOutStream(os.Stderr)
+	inStrm, _ := in.(*execcmd.InStream)
+	useTty := inStrm != nil && inStrm.IsTty()
+	outStrm, _ := out.(*execcmd.OutStream)
+	// errStrm, _ := errOut.(*execcmd.OutStream)
 
-		AttachStdin:  true,
-		AttachStdout: true,
-		AttachStderr: true,
-	})
-	if err != nil {
-		return err
+	// persistent sessions are only used for interactive logins, so an
+	// exported SKIFF_CORE_SESSION does not break scp, sftp or git.
+	if s.sessionName != "" {
+		if !useTty || inputCmd != "" {
+			log.WithField("session", s.sessionName).Debug("Ignoring persistent session for non-interactive login")
+			s.sessionName = ""
+		} else if err := validateSessionName(s.sessionName); err != nil {
+			return err
+		}
+	}
+
+	// the client requested the rescue shell on the host.
+	if rescueRequested() {
+		userConfig := s.loadRescueConfig()
+		if userConfig == nil {
+			return errors.New("rescue shell is not permitted for this user")
+		}
+		return s.rescue(userConfig, inputCmd, RescueEnv+" was set", errOut)
 	}
 
-	conn, err := dockerClient.ContainerExecAttach(ctx, execCreate.ID, types.ExecStartCheck{
-		Tty: useTty,
-	})
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	userConfig, err := s.waitUserConfig(ctx, errOut)
 	if err != nil {
-		return err
+		return s.tryRescue(inputCmd, err, errOut)
 	}
-	defer conn.Close()
-
-	// pipe os.stdin to the connection
-	errCh := make(chan error, 1)
-	go func() {
-		streamer := execcmd.HijackedIOStreamer{
-			InputStream:  in,
-			OutputStream: out,
-			ErrorStream:  errOut,
-			Resp:         conn,
-			Tty:          useTty,
+
+	req := &Request{
+		Command:       inputCmd,
+		ExecWithShell: execWithShell,
+		Stdin:         in,
+		Stdout:        out,
+		Stderr:        errOut,
+		Tty:           useTty,
+		Environ:       os.Environ(),
+		AllowHost:     true,
+		// set by the OpenSSH server for ssh -A.
+		AgentSocket: os.Getenv(agentSockEnv),
+	}
+	if useTty && outStrm != nil {
+		height, width := outStrm.GetTtySize()
+		req.Size = TtySize{Height: height, Width: width}
+		if inStrm.IsTerminal() {
+			resize, stopWatching := watchTtySize(outStrm)
+			defer stopWatching()
+			req.Resize = resize
 		}
-		if useTty {
+		req.RawMode = func() func() {
 			inStrm.SetRawMode()
-			defer inStrm.RestoreTerminal()
-		}
-
-		errCh <- streamer.Stream(ctx)
-	}()
-
-	if useTty && inStrm != nil && inStrm.IsTerminal() && outStrm != nil {
-		if err := MonitorTtySize(ctx, dockerClient, outStrm, execCreate.ID, true); err != nil {
-			log.WithError(err).Error("Error monitoring TTY size")
+			return func() {
+				inStrm.RestoreTerminal()
+			}
 		}
 	}
+	if !useTty {
+		sigs, stopNotify := notifySignals()
+		defer stopNotify()
+		req.Signals = sigs
+	}
 
-	return <-errCh
+	err = s.Run(ctx, userConfig, req)
+	var startErr *containerStartError
+	if errors.As(err, &startErr) {
+		return s.tryRescue(inputCmd, startErr.err, errOut)
+	}
+	return err
 }
@@ -1,9 +1,16 @@
 package shell
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/skiffos/skiff-core/config"
 )
@@ -62,3 +69,241 @@ func TestBuildTargetCmdRoutesInternalSFTPToContainerServer(t *testing.T) {
 		t.Fatalf("expected subsystem args %q, got %q", expectedArgs, cmd[3:])
 	}
 }
+
+func TestSelectContainerDefaultsToUserContainer(t *testing.T) {
+	conf := &config.ConfigUserShell{ContainerId: "default-id"}
+	id, cmd, err := selectContainer(conf, "ls -la", func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != "default-id" || cmd != "ls -la" {
+		t.Fatalf("expected default container and unchanged command, got %q %q", id, cmd)
+	}
+}
+
+func TestSelectContainerPrefixOverridesEnv(t *testing.T) {
+	conf := &config.ConfigUserShell{
+		ContainerId: "default-id",
+		Containers: map[string]*config.ConfigUserShellContainer{
+			"core":  {Id: "default-id"},
+			"build": {Id: "build-id"},
+			"dev":   {Id: "dev-id"},
+		},
+	}
+	getEnv := func(key string) string {
+		if key == ContainerSelectEnv {
+			return "dev"
+		}
+		return ""
+	}
+
+	id, cmd, err := selectContainer(conf, "@build make -j4", getEnv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != "build-id" || cmd != "make -j4" {
+		t.Fatalf("expected build container with stripped command, got %q %q", id, cmd)
+	}
+
+	id, cmd, err = selectContainer(conf, "", getEnv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != "dev-id" || cmd != "" {
+		t.Fatalf("expected dev container from env, got %q %q", id, cmd)
+	}
+}
+
+func TestSelectContainerEnforcesAllowlist(t *testing.T) {
+	conf := &config.ConfigUserShell{
+		ContainerId: "default-id",
+		Containers: map[string]*config.ConfigUserShellContainer{
+			"core": {Id: "default-id"},
+		},
+	}
+	if _, _, err := selectContainer(conf, "@other", nil); err == nil {
+		t.Fatal("expected error selecting container outside the allowlist")
+	}
+}
+
+// writeRescueTestConfigs writes the user config to the home dir and the admin config dir.
+func writeRescueTestConfigs(t *testing.T, homeConf, adminConf *config.ConfigUserShell) string {
+	prevDir := config.UserAdminConfigDir
+	config.UserAdminConfigDir = t.TempDir()
+	t.Cleanup(func() { config.UserAdminConfigDir = prevDir })
+
+	homeDir := t.TempDir()
+	for confPath, conf := range map[string]*config.ConfigUserShell{
+		path.Join(homeDir, config.UserConfigFile): homeConf,
+		adminUserConfigPath():                     adminConf,
+	} {
+		data, err := conf.Marshal()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(confPath, data, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return homeDir
+}
+
+func TestTryRescueRequiresPermission(t *testing.T) {
+	cause := errors.New("container unavailable")
+	rescueConf := &config.ConfigUserShell{Rescue: true, RescueShell: []string{"/bin/sh"}}
+	cases := []struct {
+		name                string
+		homeConf, adminConf *config.ConfigUserShell
+	}{
+		// the user config in the home dir is owned by the user.
+		{"home config", rescueConf, &config.ConfigUserShell{}},
+		{"restricted", rescueConf, &config.ConfigUserShell{
+			Rescue:   true,
+			Restrict: &config.ConfigUserRestrict{AllowCommands: []string{"true"}},
+		}},
+	}
+	for _, c := range cases {
+		homeDir := writeRescueTestConfigs(t, c.homeConf, c.adminConf)
+		err := NewShell(homeDir).tryRescue("true", cause, io.Discard)
+		if err != cause {
+			t.Fatalf("%s: expected %v, got %v", c.name, cause, err)
+		}
+	}
+}
+
+func TestTryRescueRunsHostShell(t *testing.T) {
+	homeDir := writeRescueTestConfigs(t, &config.ConfigUserShell{}, &config.ConfigUserShell{
+		Rescue:      true,
+		RescueShell: []string{"/bin/sh"},
+	})
+
+	var banner strings.Builder
+	err := NewShell(homeDir).tryRescue("exit 3", errors.New("container unavailable"), &banner)
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+	if !strings.Contains(banner.String(), "RESCUE MODE") {
+		t.Fatalf("expected rescue banner, got %q", banner.String())
+	}
+}
+
+// writeSetupTestFiles writes the admin user config and the setup log to a home dir.
+func writeSetupTestFiles(t *testing.T, conf *config.ConfigUserShell, setupLog string) string {
+	prevDir := config.UserAdminConfigDir
+	config.UserAdminConfigDir = t.TempDir()
+	t.Cleanup(func() { config.UserAdminConfigDir = prevDir })
+
+	homeDir := t.TempDir()
+	data, err := conf.Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(adminUserConfigPath(), data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(path.Join(homeDir, config.UserLogFile), []byte(setupLog), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return homeDir
+}
+
+func TestWaitUserConfigDetectsSetupFailure(t *testing.T) {
+	prevGrace := setupFailedGrace
+	setupFailedGrace = time.Millisecond * 10
+	defer func() { setupFailedGrace = prevGrace }()
+
+	homeDir := writeSetupTestFiles(
+		t,
+		&config.ConfigUserShell{Admin: true},
+		"Pulling image\nContainer setup failed for core with error:\nno such image\n",
+	)
+	s := NewShell(homeDir)
+	s.SetSetupTimeout(time.Second * 10)
+
+	var errOut bytes.Buffer
+	_, err := s.waitUserConfig(context.Background(), &errOut)
+	if err == nil || !strings.Contains(err.Error(), "failed in job: container core") {
+		t.Fatalf("expected the setup failure, got %v", err)
+	}
+	for _, expected := range []string{"Pulling image\n", "no such image\n", path.Join(homeDir, config.UserLogFile)} {
+		if !strings.Contains(errOut.String(), expected) {
+			t.Fatalf("expected %q in the output, got %q", expected, errOut.String())
+		}
+	}
+}
+
+func TestWaitUserConfigTimesOut(t *testing.T) {
+	homeDir := writeSetupTestFiles(t, &config.ConfigUserShell{}, "Pulling image\n")
+	s := NewShell(homeDir)
+	s.SetSetupTimeout(time.Millisecond * 100)
+
+	var errOut bytes.Buffer
+	_, err := s.waitUserConfig(context.Background(), &errOut)
+	if err == nil || !strings.Contains(err.Error(), "Timed out waiting for container setup") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	// the admin help is only printed to admins.
+	if strings.Contains(errOut.String(), "Setup did not complete in time") {
+		t.Fatalf("unexpected admin help: %q", errOut.String())
+	}
+}
+
+func TestWaitUserConfigZeroTimeoutWaitsForever(t *testing.T) {
+	homeDir := writeSetupTestFiles(t, &config.ConfigUserShell{}, "Pulling image\n")
+	s := NewShell(homeDir)
+	s.SetSetupTimeout(0)
+
+	type result struct {
+		conf *config.ConfigUserShell
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		conf, err := s.waitUserConfig(context.Background(), io.Discard)
+		resultCh <- result{conf, err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		t.Fatalf("expected to keep waiting for setup, got %v", res.err)
+	case <-time.After(time.Second):
+	}
+
+	// setup completes.
+	data, err := (&config.ConfigUserShell{ContainerId: "core-id"}).Marshal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(adminUserConfigPath(), data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case res := <-resultCh:
+		if res.err != nil || res.conf.ContainerId != "core-id" {
+			t.Fatalf("expected the complete config, got %+v: %v", res.conf, res.err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected to return once setup completes")
+	}
+}
+
+func TestWaitUserConfigReadsAdminCopy(t *testing.T) {
+	// the user removed the restrictions from the copy in the home dir.
+	restrict := &config.ConfigUserRestrict{AllowCommands: []string{"rsync"}}
+	homeDir := writeRescueTestConfigs(
+		t,
+		&config.ConfigUserShell{ContainerId: "other-id"},
+		&config.ConfigUserShell{ContainerId: "core-id", Restrict: restrict},
+	)
+	s := NewShell(homeDir)
+
+	userConfig, err := s.waitUserConfig(context.Background(), io.Discard)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if userConfig.ContainerId != "core-id" || userConfig.Restrict == nil ||
+		!slices.Equal(userConfig.Restrict.AllowCommands, restrict.AllowCommands) {
+		t.Fatalf("expected the config written by setup, got %+v", userConfig)
+	}
+}
@@ -0,0 +1,147 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"os"
+	gosignal "os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// forwardedSignals are forwarded to the process in non-tty sessions.
+//
+// In tty sessions the terminal delivers the signals inside the container.
+var forwardedSignals = map[os.Signal]string{
+	syscall.SIGINT:  "INT",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGHUP:  "HUP",
+}
+
+// signalCancelCount is the number of signals after which the stream is
+// cancelled even if the process in the container is still running.
+const signalCancelCount = 3
+
+// resolveContainerPid maps a pid on the host to the pid in the container.
+var resolveContainerPid = containerPid
+
+// signalExec sends a signal to the process of an exec.
+//
+// The Docker API cannot signal an exec, so the pid is looked up with
+// ContainerExecInspect and signalled with kill in a helper exec.
+func signalExec(
+	ctx context.Context,
+	dockerClient client.ContainerAPIClient,
+	containerId, execID string,
+	sigName string,
+) error {
+	ins, err := dockerClient.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return err
+	}
+	if !ins.Running || ins.Pid == 0 {
+		return fmt.Errorf("exec %s is not running", execID)
+	}
+	pid := resolveContainerPid(ins.Pid)
+
+	killCreate, err := dockerClient.ContainerExecCreate(ctx, containerId, types.ExecConfig{
+		User: "root",
+		Cmd:  []string{"kill", "-s", sigName, strconv.Itoa(pid)},
+	})
+	if err != nil {
+		return err
+	}
+	if err := dockerClient.ContainerExecStart(ctx, killCreate.ID, types.ExecStartCheck{}); err != nil {
+		return err
+	}
+	code, err := waitExecExitCode(ctx, dockerClient, killCreate.ID)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("kill -s %s %d exited with status %d", sigName, pid, code)
+	}
+	return nil
+}
+
+// notifySignals relays the forwarded signals received by this process.
+//
+// Returns the names of the signals and a function to stop relaying.
+func notifySignals() (<-chan string, func()) {
+	names := make(chan string, 1)
+	sigchan := make(chan os.Signal, 1)
+	sigs := make([]os.Signal, 0, len(forwardedSignals))
+	for sig := range forwardedSignals {
+		sigs = append(sigs, sig)
+	}
+	gosignal.Notify(sigchan, sigs...)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigchan:
+				select {
+				case names <- forwardedSignals[sig]:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return names, func() {
+		gosignal.Stop(sigchan)
+		close(done)
+	}
+}
+
+// forwardSignals forwards signals from sigs to the exec.
+//
+// Calls cancel if forwarding fails, or after signalCancelCount signals.
+// Returns a function to stop forwarding.
+func forwardSignals(
+	ctx context.Context,
+	dockerClient client.ContainerAPIClient,
+	containerId, execID string,
+	sigs <-chan string,
+	cancel func(),
+) func() {
+	done := make(chan struct{})
+	go func() {
+		var count int
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case sigName, ok := <-sigs:
+				if !ok {
+					return
+				}
+				count++
+				le := log.WithField("signal", sigName)
+				if count >= signalCancelCount {
+					le.Warn("Received repeated signals, disconnecting")
+					cancel()
+					return
+				}
+				if err := signalExec(ctx, dockerClient, containerId, execID, sigName); err != nil {
+					le.WithError(err).Warn("Unable to forward signal, disconnecting")
+					cancel()
+					return
+				}
+				le.Debug("Forwarded signal to container")
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+// containerPid returns pid unchanged on this platform.
+func containerPid(pid int) int {
+	return pid
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package shell
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// containerPid maps a pid on the host to the pid in the innermost pid namespace.
+//
+// Reads the NSpid line of /proc/<pid>/status. Returns pid unchanged if the
+// mapping is unavailable, for example if the container shares the host pid namespace.
+func containerPid(pid int) int {
+	f, err := os.Open(path.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return pid
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "NSpid:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "NSpid:"))
+		if len(fields) == 0 {
+			return pid
+		}
+		nsPid, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return pid
+		}
+		return nsPid
+	}
+	return pid
+}
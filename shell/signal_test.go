@@ -0,0 +1,58 @@
+package shell
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestSignalExecKillsContainerPid(t *testing.T) {
+	prevResolve := resolveContainerPid
+	resolveContainerPid = func(pid int) int { return pid - 1000 }
+	defer func() { resolveContainerPid = prevResolve }()
+
+	dc := &fakeDockerClient{execInspects: []types.ContainerExecInspect{
+		{Running: true, Pid: 1042},
+		{ExitCode: 0},
+	}}
+	if err := signalExec(context.Background(), dc, "container-1", "exec-1", "TERM"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(dc.execCreates) != 1 {
+		t.Fatalf("expected 1 helper exec, got %d", len(dc.execCreates))
+	}
+	helper := dc.execCreates[0]
+	expected := []string{"kill", "-s", "TERM", "42"}
+	if !slices.Equal(helper.Cmd, expected) {
+		t.Fatalf("expected %q, got %q", expected, helper.Cmd)
+	}
+	if helper.User != "root" {
+		t.Fatalf("expected helper to run as root, got %q", helper.User)
+	}
+	if !slices.Equal(dc.execStarts, []string{"exec-helper-1"}) {
+		t.Fatalf("expected helper exec to be started, got %q", dc.execStarts)
+	}
+}
+
+func TestSignalExecReportsKillFailure(t *testing.T) {
+	dc := &fakeDockerClient{execInspects: []types.ContainerExecInspect{
+		{Running: true, Pid: 42},
+		{ExitCode: 1},
+	}}
+	if err := signalExec(context.Background(), dc, "container-1", "exec-1", "INT"); err == nil {
+		t.Fatal("expected error when kill fails")
+	}
+}
+
+func TestSignalExecSkipsExitedExec(t *testing.T) {
+	dc := &fakeDockerClient{execInspects: []types.ContainerExecInspect{{ExitCode: 0}}}
+	if err := signalExec(context.Background(), dc, "container-1", "exec-1", "HUP"); err == nil {
+		t.Fatal("expected error for exited exec")
+	}
+	if len(dc.execCreates) != 0 {
+		t.Fatalf("expected no helper exec, got %d", len(dc.execCreates))
+	}
+}
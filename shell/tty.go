@@ -37,22 +37,57 @@ func resizeTtyTo(ctx context.Context, client client.ContainerAPIClient, id strin
 	*/
 }
 
-// MonitorTtySize updates the container tty size when the terminal tty changes size
-func MonitorTtySize(ctx context.Context, client client.APIClient, out *execcmd.OutStream, id string, isExec bool) error {
-	resizeTty := func() {
-		height, width := out.GetTtySize()
-		resizeTtyTo(ctx, client, id, height, width, isExec)
-	}
-
-	resizeTty()
-
+// watchTtySize sends the size of the terminal when it changes.
+//
+// Returns a function to stop watching.
+func watchTtySize(out *execcmd.OutStream) (<-chan TtySize, func()) {
+	sizes := make(chan TtySize, 1)
 	sigchan := make(chan os.Signal, 1)
 	gosignal.Notify(sigchan, signal.SIGWINCH)
 	go func() {
 		for range sigchan {
-			resizeTty()
+			height, width := out.GetTtySize()
+			// replace any pending size with the latest.
+			select {
+			case <-sizes:
+			default:
+			}
+			sizes <- TtySize{Height: height, Width: width}
 		}
 	}()
+	return sizes, func() {
+		gosignal.Stop(sigchan)
+		close(sigchan)
+	}
+}
 
-	return nil
+// relayTtySize resizes the exec tty with each size received from sizes.
+//
+// onResize is called with each new size, if set.
+func relayTtySize(
+	ctx context.Context,
+	client client.ContainerAPIClient,
+	execID string,
+	last TtySize,
+	sizes <-chan TtySize,
+	onResize func(size TtySize),
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case size, ok := <-sizes:
+			if !ok {
+				return
+			}
+			if size == last {
+				continue
+			}
+			last = size
+			resizeTtyTo(ctx, client, execID, size.Height, size.Width, true)
+			if onResize != nil {
+				onResize(size)
+			}
+		}
+	}
 }
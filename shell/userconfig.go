@@ -0,0 +1,66 @@
+package shell
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/skiffos/skiff-core/config"
+)
+
+// BuildUserConfig builds the shell config for a user from the global config.
+//
+// Used by the built-in servers in place of the config file written by setup.
+// Resolves the IDs of the containers the user is allowed to use.
+func BuildUserConfig(ctx context.Context, conf *config.Config, userName string) (*config.ConfigUserShell, error) {
+	user, ok := conf.Users[userName]
+	if !ok || user == nil {
+		return nil, errors.Errorf("unknown user: %s", userName)
+	}
+	// the routes are checked against the slash-prefixed names, like setup.
+	var allowedContainers []string
+	for _, name := range user.AllowedContainers() {
+		allowedContainers = append(allowedContainers, "/"+strings.TrimPrefix(name, "/"))
+	}
+	for i, route := range user.Routes {
+		if route == nil {
+			continue
+		}
+		if err := route.Validate(allowedContainers); err != nil {
+			return nil, errors.Errorf("routes[%d]: %s", i, err.Error())
+		}
+	}
+	if user.Restrict != nil {
+		if err := user.Restrict.Validate(); err != nil {
+			return nil, errors.Wrap(err, "restrict")
+		}
+	}
+
+	dockerClient, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dockerClient.Close()
+
+	containerIds := make(map[string]string)
+	for _, name := range user.AllowedContainers() {
+		ins, err := dockerClient.ContainerInspect(ctx, name)
+		if err != nil {
+			if name == user.Container {
+				return nil, errors.Wrapf(err, "container %s is not ready", name)
+			}
+			continue
+		}
+		containerIds[name] = ins.ID
+	}
+
+	userConf := user.ToConfigUserShell(containerIds)
+	userConf.FillContainerConfigs(func(name string) *config.ConfigContainer {
+		return conf.Containers[name]
+	})
+	if conf.Audit != nil {
+		userConf.AuditLog = conf.Audit.ToConfigUserShellAuditLog(userName)
+	}
+	return userConf, nil
+}
@@ -0,0 +1,102 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/skiffos/skiff-core/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// rootAuthorizedKeysPath is the path to the root user's authorized keys.
+// Used by the CopyRootKeys option.
+var rootAuthorizedKeysPath = "/root/.ssh/authorized_keys"
+
+// permUserExt is the permissions extension holding the name of the user.
+const permUserExt = "skiff-core-user"
+
+// errAuthFailed is returned when authentication fails.
+var errAuthFailed = errors.New("authentication failed")
+
+// lookupUser returns the auth config of an unlocked user.
+func (s *Server) lookupUser(name string) (*config.ConfigUser, *config.ConfigUserAuth) {
+	user, ok := s.conf.Users[name]
+	if !ok || user == nil {
+		return nil, nil
+	}
+	auth := user.Auth
+	if auth == nil {
+		auth = &config.ConfigUserAuth{}
+	}
+	if auth.Locked {
+		return nil, nil
+	}
+	return user, auth
+}
+
+// userPermissions returns the permissions of an authenticated user.
+func userPermissions(name string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{permUserExt: name}}
+}
+
+// checkPassword authenticates a user with a password.
+func (s *Server) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	_, auth := s.lookupUser(meta.User())
+	if auth == nil || !auth.CheckPassword(string(password)) {
+		return nil, errAuthFailed
+	}
+	return userPermissions(meta.User()), nil
+}
+
+// checkPublicKey authenticates a user with a public key.
+func (s *Server) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	_, auth := s.lookupUser(meta.User())
+	if auth == nil {
+		return nil, errAuthFailed
+	}
+	keyData := key.Marshal()
+	for _, authKey := range authorizedKeys(auth) {
+		if bytes.Equal(authKey.Marshal(), keyData) {
+			return userPermissions(meta.User()), nil
+		}
+	}
+	return nil, errAuthFailed
+}
+
+// authorizedKeys returns the public keys the user can authenticate with.
+//
+// Keys with options are skipped: use the restrict config instead.
+func authorizedKeys(auth *config.ConfigUserAuth) []ssh.PublicKey {
+	var lines [][]byte
+	if auth.CopyRootKeys {
+		if data, err := os.ReadFile(rootAuthorizedKeysPath); err == nil {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+			}
+		}
+	}
+	for _, key := range auth.SSHKeys {
+		lines = append(lines, []byte(key))
+	}
+
+	var keys []ssh.PublicKey
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			continue
+		}
+		// options such as command= are not supported: skip rather than ignore them.
+		if len(options) != 0 {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,56 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadHostKeys loads the host keys from the paths.
+//
+// Generates an ed25519 key at the default path if it does not exist.
+func loadHostKeys(paths []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, keyPath := range paths {
+		data, err := os.ReadFile(keyPath)
+		if os.IsNotExist(err) && keyPath == config.DefaultSshdHostKey {
+			data, err = generateHostKey(keyPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// generateHostKey generates an ed25519 host key and writes it to keyPath.
+func generateHostKey(keyPath string) ([]byte, error) {
+	log.WithField("path", keyPath).Info("Generating SSH host key")
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(block)
+	if err := os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, data, 0600); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
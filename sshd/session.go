@@ -0,0 +1,255 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpSubsystem is the name of the sftp subsystem.
+const sftpSubsystem = "sftp"
+
+// signalNamePattern matches the signal names sent by clients, for example: INT.
+var signalNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9]*$`)
+
+// session is a session channel of a connection.
+type session struct {
+	srv      *Server
+	conn     *ssh.ServerConn
+	userName string
+	ch       ssh.Channel
+	le       *logrus.Entry
+
+	mtx     sync.Mutex
+	env     []string
+	tty     bool
+	size    shell.TtySize
+	started bool
+	resize  chan shell.TtySize
+	signals chan string
+}
+
+// ptyRequest is the payload of a pty-req request.
+type ptyRequest struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+	Modes    string
+}
+
+// windowChangeRequest is the payload of a window-change request.
+type windowChangeRequest struct {
+	Columns  uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+}
+
+// envRequest is the payload of an env request.
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+// execRequest is the payload of an exec request.
+type execRequest struct {
+	Command string
+}
+
+// subsystemRequest is the payload of a subsystem request.
+type subsystemRequest struct {
+	Name string
+}
+
+// signalRequest is the payload of a signal request.
+type signalRequest struct {
+	Signal string
+}
+
+// exitStatusRequest is the payload of an exit-status request.
+type exitStatusRequest struct {
+	Status uint32
+}
+
+// clientEnvAllowed checks if a variable sent by the client can be set.
+//
+// The agent socket and the skiff-core variables control the shell on the
+// host and are never taken from the client, except for selecting the container.
+func clientEnvAllowed(name string) bool {
+	if name == shell.ContainerSelectEnv {
+		return true
+	}
+	return name != "SSH_AUTH_SOCK" && !strings.HasPrefix(name, "SKIFF_")
+}
+
+// handleRequests handles the requests on the session channel.
+func (s *session) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok := s.handleRequest(req)
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+	}
+}
+
+// handleRequest handles a request and returns if it succeeded.
+func (s *session) handleRequest(req *ssh.Request) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch req.Type {
+	case "env":
+		var msg envRequest
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil || s.started {
+			return false
+		}
+		if !clientEnvAllowed(msg.Name) {
+			return false
+		}
+		s.env = append(s.env, msg.Name+"="+msg.Value)
+		return true
+	case "pty-req":
+		var msg ptyRequest
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil || s.started {
+			return false
+		}
+		s.tty = true
+		s.size = shell.TtySize{Height: uint(msg.Rows), Width: uint(msg.Columns)}
+		s.env = append(s.env, "TERM="+msg.Term)
+		return true
+	case "window-change":
+		var msg windowChangeRequest
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			return false
+		}
+		size := shell.TtySize{Height: uint(msg.Rows), Width: uint(msg.Columns)}
+		// replace any pending size with the latest.
+		select {
+		case <-s.resize:
+		default:
+		}
+		s.resize <- size
+		return true
+	case "signal":
+		var msg signalRequest
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil || !signalNamePattern.MatchString(msg.Signal) {
+			return false
+		}
+		select {
+		case s.signals <- msg.Signal:
+		default:
+		}
+		return true
+	case "shell":
+		return s.start("")
+	case "exec":
+		var msg execRequest
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			return false
+		}
+		return s.start(msg.Command)
+	case "subsystem":
+		var msg subsystemRequest
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil || msg.Name != sftpSubsystem {
+			return false
+		}
+		// routed to the sftp-server in the container by the shell.
+		return s.start("internal-sftp")
+	default:
+		return false
+	}
+}
+
+// start starts running the command in the container.
+//
+// Must be called with mtx locked.
+func (s *session) start(command string) bool {
+	if s.started {
+		return false
+	}
+	s.started = true
+	go s.run(command)
+	return true
+}
+
+// run runs the command and closes the channel with the exit status.
+func (s *session) run(command string) {
+	defer s.ch.Close()
+
+	s.mtx.Lock()
+	req := &shell.Request{
+		Command:       command,
+		ExecWithShell: true,
+		Stdin:         io.NopCloser(s.ch),
+		Stdout:        s.ch,
+		Stderr:        s.ch.Stderr(),
+		Tty:           s.tty,
+		Size:          s.size,
+		Resize:        s.resize,
+		Environ:       append(s.env, "SSH_CONNECTION="+s.sshConnection()),
+		Signals:       s.signals,
+		UserName:      s.userName,
+	}
+	s.mtx.Unlock()
+	if req.Tty {
+		// the client terminal is in raw mode, translate newlines.
+		req.Stderr = s.ch
+	}
+
+	le := s.le.WithField("command", command)
+	le.Debug("Starting session")
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	defer ctxCancel()
+
+	userConfig, err := shell.BuildUserConfig(ctx, s.srv.conf, s.userName)
+	if err == nil {
+		err = s.srv.sh.Run(ctx, userConfig, req)
+	}
+
+	status := exitStatus(err)
+	if err != nil {
+		var exitErr *shell.ExitError
+		if !errors.As(err, &exitErr) {
+			le.WithError(err).Warn("Session failed")
+			fmt.Fprintf(s.ch.Stderr(), "skiff-core: %s\r\n", err.Error())
+		}
+	}
+	le.WithField("exit-code", status).Debug("Session exited")
+	_, _ = s.ch.SendRequest("exit-status", false, ssh.Marshal(&exitStatusRequest{Status: status}))
+}
+
+// exitStatus returns the exit status to send to the client for an error.
+func exitStatus(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	var exitErr *shell.ExitError
+	if errors.As(err, &exitErr) {
+		return uint32(exitErr.Code)
+	}
+	return 1
+}
+
+// sshConnection formats the SSH_CONNECTION variable for the session.
+func (s *session) sshConnection() string {
+	fields := make([]string, 0, 4)
+	for _, addr := range []net.Addr{s.conn.RemoteAddr(), s.conn.LocalAddr()} {
+		host, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host, port = addr.String(), "0"
+		}
+		fields = append(fields, host, port)
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,122 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is the built-in SSH server.
+//
+// Authenticates users against the config and maps sessions directly onto
+// execs in their containers, without host accounts.
+type Server struct {
+	conf      *config.Config
+	sshConf   *ssh.ServerConfig
+	sh        *shell.Shell
+	listener  net.Listener
+	listenMtx sync.Mutex
+}
+
+// NewServer builds a new SSH server from the config.
+func NewServer(conf *config.Config) (*Server, error) {
+	sshdConf := conf.Sshd
+	if sshdConf == nil {
+		sshdConf = &config.ConfigSshd{}
+		sshdConf.FillDefaults()
+	}
+
+	s := &Server{conf: conf, sh: shell.NewShell("")}
+	s.sshConf = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+		ServerVersion:     "SSH-2.0-skiff-core",
+	}
+	hostKeys, err := loadHostKeys(sshdConf.HostKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "load host keys")
+	}
+	for _, key := range hostKeys {
+		s.sshConf.AddHostKey(key)
+	}
+	return s, nil
+}
+
+// ListenAndServe listens on the address and serves connections.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves connections from the listener until it is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.listenMtx.Lock()
+	s.listener = listener
+	s.listenMtx.Unlock()
+
+	log.WithField("addr", listener.Addr().String()).Info("SSH server listening")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops the listener.
+func (s *Server) Close() error {
+	s.listenMtx.Lock()
+	defer s.listenMtx.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// handleConn performs the handshake and handles the channels of a connection.
+func (s *Server) handleConn(conn net.Conn) {
+	le := log.WithField("remote", conn.RemoteAddr().String())
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConf)
+	if err != nil {
+		le.WithError(err).Debug("SSH handshake failed")
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+
+	userName := sconn.Permissions.Extensions[permUserExt]
+	le = le.WithField("user", userName)
+	le.Info("SSH user authenticated")
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			le.WithError(err).Warn("Unable to accept channel")
+			continue
+		}
+		sess := &session{
+			srv:      s,
+			conn:     sconn,
+			userName: userName,
+			ch:       ch,
+			resize:   make(chan shell.TtySize, 1),
+			signals:  make(chan string, 4),
+			le:       le,
+		}
+		go sess.handleRequests(chReqs)
+	}
+}
@@ -0,0 +1,190 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMeta implements ssh.ConnMetadata for the auth callbacks.
+type testConnMeta struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (m *testConnMeta) User() string {
+	return m.user
+}
+
+func newTestKey(t *testing.T) (ssh.Signer, string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return signer, string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+func newTestServer(t *testing.T, users map[string]*config.ConfigUser) *Server {
+	keyPath := path.Join(t.TempDir(), "host_key")
+	if _, err := generateHostKey(keyPath); err != nil {
+		t.Fatal(err.Error())
+	}
+	conf := &config.Config{
+		Users: users,
+		Sshd:  &config.ConfigSshd{HostKeys: []string{keyPath}},
+	}
+	conf.FillPrivateFields()
+	conf.FillDefaults()
+	srv, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return srv
+}
+
+func TestCheckPassword(t *testing.T) {
+	srv := newTestServer(t, map[string]*config.ConfigUser{
+		"core":   {Container: "core", Auth: &config.ConfigUserAuth{Password: "hunter2"}},
+		"empty":  {Container: "core", Auth: &config.ConfigUserAuth{AllowEmptyPassword: true}},
+		"nopass": {Container: "core"},
+		"locked": {Container: "core", Auth: &config.ConfigUserAuth{Password: "hunter2", Locked: true}},
+	})
+
+	cases := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"core", "hunter2", true},
+		{"core", "hunter3", false},
+		{"core", "", false},
+		{"empty", "", true},
+		{"empty", "x", false},
+		{"nopass", "", false},
+		{"locked", "hunter2", false},
+		{"unknown", "hunter2", false},
+	}
+	for _, c := range cases {
+		perms, err := srv.checkPassword(&testConnMeta{user: c.user}, []byte(c.password))
+		if (err == nil) != c.ok {
+			t.Fatalf("%s/%q: expected ok=%v, got %v", c.user, c.password, c.ok, err)
+		}
+		if c.ok && perms.Extensions[permUserExt] != c.user {
+			t.Fatalf("%s: unexpected permissions: %v", c.user, perms.Extensions)
+		}
+	}
+}
+
+func TestCheckPublicKey(t *testing.T) {
+	signer, authKey := newTestKey(t)
+	otherSigner, otherKey := newTestKey(t)
+	rootSigner, rootKey := newTestKey(t)
+
+	rootKeysPath := path.Join(t.TempDir(), "authorized_keys")
+	rootKeys := rootKey + "command=\"/bin/false\" " + otherKey
+	if err := os.WriteFile(rootKeysPath, []byte(rootKeys), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	prevRootKeys := rootAuthorizedKeysPath
+	rootAuthorizedKeysPath = rootKeysPath
+	defer func() { rootAuthorizedKeysPath = prevRootKeys }()
+
+	srv := newTestServer(t, map[string]*config.ConfigUser{
+		"core": {Container: "core", Auth: &config.ConfigUserAuth{
+			SSHKeys:      []string{strings.TrimSpace(authKey)},
+			CopyRootKeys: true,
+		}},
+	})
+
+	meta := &testConnMeta{user: "core"}
+	if _, err := srv.checkPublicKey(meta, signer.PublicKey()); err != nil {
+		t.Fatalf("expected configured key to be accepted: %v", err)
+	}
+	if _, err := srv.checkPublicKey(meta, rootSigner.PublicKey()); err != nil {
+		t.Fatalf("expected root key to be accepted: %v", err)
+	}
+	if _, err := srv.checkPublicKey(meta, otherSigner.PublicKey()); err == nil {
+		t.Fatal("expected key with options to be rejected")
+	}
+}
+
+func TestSessionReportsExitStatus(t *testing.T) {
+	// point docker at a socket that does not exist so the container lookup fails.
+	t.Setenv("DOCKER_HOST", "unix://"+path.Join(t.TempDir(), "docker.sock"))
+
+	srv := newTestServer(t, map[string]*config.ConfigUser{
+		"core": {Container: "core", Auth: &config.ConfigUserAuth{Password: "hunter2"}},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() { _ = srv.Serve(listener) }()
+	defer srv.Close()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "core",
+		Auth:            []ssh.AuthMethod{ssh.Password("hunter2")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sess.Close()
+
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	err = sess.Run("true")
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Fatalf("expected exit status 1, got %v", err)
+	}
+	if !strings.Contains(stderr.String(), "container core is not ready") {
+		t.Fatalf("unexpected stderr: %q", stderr.String())
+	}
+}
+
+func TestSessionFiltersClientEnv(t *testing.T) {
+	s := &session{}
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"LANG", true},
+		{"SKIFF_CORE_CONTAINER", true},
+		{"SSH_AUTH_SOCK", false},
+		{"SKIFF_CORE_RESCUE", false},
+		{"SKIFF_CORE_SESSION", false},
+	}
+	for _, c := range cases {
+		ok := s.handleRequest(&ssh.Request{
+			Type:    "env",
+			Payload: ssh.Marshal(&envRequest{Name: c.name, Value: "/var/run/docker.sock"}),
+		})
+		if ok != c.ok {
+			t.Fatalf("%s: expected ok=%v", c.name, c.ok)
+		}
+	}
+	expected := []string{"LANG=/var/run/docker.sock", "SKIFF_CORE_CONTAINER=/var/run/docker.sock"}
+	if strings.Join(s.env, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected env: %v", s.env)
+	}
+}
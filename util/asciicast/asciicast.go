@@ -0,0 +1,247 @@
+package asciicast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types in the asciicast v2 format.
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+	EventMarker = "m"
+)
+
+// Header is the first line of an asciicast v2 recording.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     uint              `json:"width"`
+	Height    uint              `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Writer writes an asciicast v2 recording.
+//
+// Writer is safe to use concurrently.
+type Writer struct {
+	mtx     sync.Mutex
+	w       io.WriteCloser
+	header  Header
+	start   time.Time
+	maxSize int64
+	written int64
+	limited bool
+	rotate  func() (io.WriteCloser, error)
+
+	// pending contains incomplete utf-8 sequences by event type.
+	pending map[string][]byte
+}
+
+// NewWriter writes the header and returns a new Writer.
+//
+// maxSize is the max size of the recording in bytes, zero to disable the limit.
+// Once the limit is reached a marker event is written and the recording
+// continues in the next file, see SetRotate.
+func NewWriter(w io.WriteCloser, header Header, maxSize int64) (*Writer, error) {
+	header.Version = 2
+	rw := &Writer{
+		maxSize: maxSize,
+		pending: make(map[string][]byte),
+	}
+	if err := rw.writeHeader(w, header, time.Now()); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// SetRotate sets the function to open the next file once the size limit is reached.
+//
+// The next file starts with a new header with the current terminal size.
+// If unset, or if opening the next file fails, the recording ends with a
+// marker event and a message in the output once the limit is reached.
+func (w *Writer) SetRotate(open func() (io.WriteCloser, error)) {
+	w.mtx.Lock()
+	w.rotate = open
+	w.mtx.Unlock()
+}
+
+// Limited checks if the recording stopped at the size limit.
+func (w *Writer) Limited() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.limited
+}
+
+// WriteOutput records data written to the terminal.
+func (w *Writer) WriteOutput(p []byte) {
+	w.writeData(EventOutput, p)
+}
+
+// WriteInput records data read from the terminal.
+func (w *Writer) WriteInput(p []byte) {
+	w.writeData(EventInput, p)
+}
+
+// WriteResize records a change in the terminal size.
+func (w *Writer) WriteResize(width, height uint) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.header.Width, w.header.Height = width, height
+	w.writeEvent(EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// OutputWriter returns an io.Writer which records output.
+//
+// The writer never returns an error.
+func (w *Writer) OutputWriter() io.Writer {
+	return eventWriter{w: w, typ: EventOutput}
+}
+
+// InputWriter returns an io.Writer which records input.
+//
+// The writer never returns an error.
+func (w *Writer) InputWriter() io.Writer {
+	return eventWriter{w: w, typ: EventInput}
+}
+
+// Close closes the underlying writer.
+func (w *Writer) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.w.Close()
+}
+
+// writeData writes a data event, holding back incomplete utf-8 sequences.
+func (w *Writer) writeData(typ string, p []byte) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	data := append(w.pending[typ], p...)
+	cut := incompleteSuffixLen(data)
+	w.pending[typ] = append([]byte(nil), data[len(data)-cut:]...)
+	data = data[:len(data)-cut]
+	if len(data) != 0 {
+		w.writeEvent(typ, string(data))
+	}
+}
+
+// writeHeader writes the header to w and starts a new file.
+// Expects mtx to be locked or the Writer not to be shared yet.
+func (w *Writer) writeHeader(wc io.WriteCloser, header Header, start time.Time) error {
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+	data, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := wc.Write(data); err != nil {
+		return err
+	}
+	w.w, w.header, w.start = wc, header, start
+	w.written = int64(len(data))
+	return nil
+}
+
+// writeEvent writes an event line. Expects mtx to be locked.
+func (w *Writer) writeEvent(typ, data string) {
+	if w.limited {
+		return
+	}
+
+	line, err := w.encodeEvent(typ, data)
+	if err != nil {
+		return
+	}
+	if w.maxSize != 0 && w.written+int64(len(line)) > w.maxSize {
+		if !w.rotateFile() {
+			w.limited = true
+			w.writeLine(EventMarker, "recording size limit reached")
+			w.writeLine(EventOutput, "\r\n[recording size limit reached]\r\n")
+			return
+		}
+		if line, err = w.encodeEvent(typ, data); err != nil {
+			return
+		}
+	}
+
+	n, _ := w.w.Write(line)
+	w.written += int64(n)
+}
+
+// rotateFile ends the current file with a marker and continues in the next file.
+// Returns false if there is no next file. Expects mtx to be locked.
+func (w *Writer) rotateFile() bool {
+	if w.rotate == nil {
+		return false
+	}
+	next, err := w.rotate()
+	if err != nil {
+		return false
+	}
+	w.writeLine(EventMarker, "recording continues in the next file")
+	prev := w.w
+	header := w.header
+	header.Timestamp = 0
+	if err := w.writeHeader(next, header, time.Now()); err != nil {
+		next.Close()
+		return false
+	}
+	_ = prev.Close()
+	return true
+}
+
+// writeLine writes an event line ignoring the size limit. Expects mtx to be locked.
+func (w *Writer) writeLine(typ, data string) {
+	line, err := w.encodeEvent(typ, data)
+	if err != nil {
+		return
+	}
+	n, _ := w.w.Write(line)
+	w.written += int64(n)
+}
+
+// encodeEvent encodes an event line with the time since the start of the file.
+func (w *Writer) encodeEvent(typ, data string) ([]byte, error) {
+	elapsed := time.Since(w.start).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, typ, data})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// incompleteSuffixLen returns the length of an incomplete utf-8 sequence at
+// the end of p, or zero if there is none.
+func incompleteSuffixLen(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		c := p[len(p)-i]
+		if utf8.RuneStart(c) {
+			if !utf8.FullRune(p[len(p)-i:]) {
+				return i
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// eventWriter writes events of a type to a Writer.
+type eventWriter struct {
+	w   *Writer
+	typ string
+}
+
+// Write writes the data as an event.
+func (e eventWriter) Write(p []byte) (int, error) {
+	e.w.writeData(e.typ, p)
+	return len(p), nil
+}
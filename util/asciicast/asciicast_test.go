@@ -0,0 +1,153 @@
+package asciicast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+// closeBuffer is a buffer implementing io.WriteCloser.
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// readEvents parses a recording and returns the header and the events as [type, data].
+func readEvents(t *testing.T, data []byte) (Header, [][2]string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		t.Fatal("expected a header")
+	}
+	var header Header
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err.Error())
+	}
+	var events [][2]string
+	for scanner.Scan() {
+		var ev []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, [2]string{ev[1].(string), ev[2].(string)})
+	}
+	return header, events
+}
+
+func TestWriterHoldsBackIncompleteUTF8(t *testing.T) {
+	var buf closeBuffer
+	w, err := NewWriter(&buf, Header{Width: 80, Height: 24}, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// "é" is split across writes, "€" across the output and input streams.
+	euro := []byte("€")
+	w.WriteOutput([]byte("caf\xc3"))
+	w.WriteInput(euro[:1])
+	w.WriteOutput([]byte("\xa9!"))
+	w.WriteInput(euro[1:])
+	w.WriteOutput([]byte("x"))
+	w.WriteInput(nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	header, events := readEvents(t, buf.Bytes())
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Timestamp == 0 {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	expected := [][2]string{{"o", "caf"}, {"o", "é!"}, {"i", "€"}, {"o", "x"}}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, events)
+		}
+	}
+	if !buf.closed {
+		t.Fatal("expected the writer to be closed")
+	}
+}
+
+func TestWriterMarksSizeLimit(t *testing.T) {
+	var buf closeBuffer
+	w, err := NewWriter(&buf, Header{Width: 80, Height: 24}, 200)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 20; i++ {
+		_, _ = w.OutputWriter().Write([]byte("0123456789"))
+	}
+	if !w.Limited() {
+		t.Fatal("expected the recording to be limited")
+	}
+
+	_, events := readEvents(t, buf.Bytes())
+	if len(events) < 3 {
+		t.Fatalf("expected events before the limit, got %v", events)
+	}
+	marker, msg := events[len(events)-2], events[len(events)-1]
+	if marker != [2]string{EventMarker, "recording size limit reached"} || msg[0] != EventOutput {
+		t.Fatalf("expected a marker at the end, got %v", events)
+	}
+}
+
+func TestWriterRotates(t *testing.T) {
+	var files []*closeBuffer
+	open := func() (io.WriteCloser, error) {
+		f := &closeBuffer{}
+		files = append(files, f)
+		return f, nil
+	}
+	first, _ := open()
+	w, err := NewWriter(first, Header{Width: 80, Height: 24, Env: map[string]string{"TERM": "xterm"}}, 200)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.SetRotate(open)
+	w.WriteResize(100, 30)
+	for i := 0; i < 20; i++ {
+		w.WriteOutput([]byte("0123456789"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if w.Limited() {
+		t.Fatal("expected the recording to continue in the next file")
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected the recording to rotate, got %d files", len(files))
+	}
+
+	var total int
+	for i, f := range files {
+		if !f.closed {
+			t.Fatalf("file %d: expected to be closed", i)
+		}
+		header, events := readEvents(t, f.Bytes())
+		if i != 0 && (header.Width != 100 || header.Height != 30 || header.Env["TERM"] != "xterm") {
+			t.Fatalf("file %d: expected the header with the current size, got %+v", i, header)
+		}
+		for j, ev := range events {
+			switch {
+			case ev[0] == EventOutput:
+				total += len(ev[1])
+			case ev[0] == EventMarker && i != len(files)-1 && j == len(events)-1:
+			case ev[0] == EventResize && i == 0:
+			default:
+				t.Fatalf("file %d: unexpected event %v", i, ev)
+			}
+		}
+	}
+	if total != 200 {
+		t.Fatalf("expected all output to be recorded, got %d bytes", total)
+	}
+}
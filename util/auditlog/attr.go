@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package auditlog
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsAppendFl is the append-only attribute, FS_APPEND_FL in linux/fs.h.
+const fsAppendFl = 0x00000020
+
+// fileOwner returns the owner of the file.
+func fileOwner(st os.FileInfo) (uid, gid int, ok bool) {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(sys.Uid), int(sys.Gid), true
+}
+
+// setAppendOnly sets or clears the append-only attribute of the file.
+//
+// Returns if the attribute was previously set.
+// Requires CAP_LINUX_IMMUTABLE and a filesystem which supports it.
+func setAppendOnly(path string, appendOnly bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, err
+	}
+	wasAppendOnly := flags&fsAppendFl != 0
+	if appendOnly == wasAppendOnly {
+		return wasAppendOnly, nil
+	}
+	flags ^= fsAppendFl
+	return wasAppendOnly, unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags))
+}
+
+// dirWritable checks if the process can create and rename files in the dir.
+func dirWritable(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package auditlog
+
+import (
+	"errors"
+	"os"
+)
+
+// fileOwner returns the owner of the file.
+//
+// File owners are not supported on this platform.
+func fileOwner(st os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// setAppendOnly sets or clears the append-only attribute of the file.
+//
+// Not supported on this platform.
+func setAppendOnly(path string, appendOnly bool) (bool, error) {
+	return false, errors.New("append-only files are not supported on this platform")
+}
+
+// dirWritable checks if the process can create and rename files in the dir.
+//
+// Permissions are not checked on this platform.
+func dirWritable(dir string) bool {
+	return true
+}
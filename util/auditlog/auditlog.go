@@ -0,0 +1,156 @@
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// canRotate checks if the process can rotate the logs in the dir.
+//
+// Users append to a log in a root-owned dir, which only root can rotate.
+var canRotate = dirWritable
+
+// Logger appends JSON records to a log file, one per line.
+//
+// Writes are serialized across processes with a lock file, so multiple
+// concurrent sessions can share the same log.
+type Logger struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+}
+
+// NewLogger constructs a new Logger.
+//
+// When the log would exceed maxSize bytes it is rotated to path.1, path.2, etc.
+// maxFiles is the number of rotated files to keep. maxSize of zero disables rotation.
+func NewLogger(path string, maxSize int64, maxFiles int) *Logger {
+	return &Logger{path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+// Path returns the path to the log file.
+func (l *Logger) Path() string {
+	return l.path
+}
+
+// Write encodes the record as JSON and appends it to the log.
+func (l *Logger) Write(record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	unlock, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// users keep appending to a log in a root-owned dir until root rotates it.
+	if l.maxSize != 0 && canRotate(filepath.Dir(l.path)) {
+		if st, err := os.Stat(l.path); err == nil && st.Size()+int64(len(line)) > l.maxSize {
+			if err := l.rotate(st); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Prepare creates the log for writing by the members of a group.
+//
+// The log is owned by root and writable but not readable by the group. If
+// the filesystem supports it, the log is append-only so it can't be truncated.
+// Expects the dir to be owned by root, so the group can't remove the log.
+//
+// The group can't rotate the log: rotates it if it exceeds the max size.
+func (l *Logger) Prepare(gid int) error {
+	unlock, err := lockFile(l.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Chmod(l.path+".lock", 0644); err != nil {
+		return err
+	}
+	if err := createLog(l.path, 0, gid, 0620, true); err != nil {
+		return err
+	}
+	st, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if l.maxSize != 0 && st.Size() > l.maxSize {
+		return l.rotate(st)
+	}
+	return nil
+}
+
+// createLog creates the log if it doesn't exist and sets the owner and mode.
+func createLog(p string, uid, gid int, mode os.FileMode, appendOnly bool) error {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Chown(p, uid, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		return err
+	}
+	if appendOnly {
+		// best-effort: not all filesystems support the attribute.
+		_, _ = setAppendOnly(p, true)
+	}
+	return nil
+}
+
+// rotate shifts the rotated logs and moves the current log to path.1.
+//
+// The new log has the owner and mode of the current log. Rotated logs are
+// only writable by the owner. Expects the lock to be held.
+func (l *Logger) rotate(st os.FileInfo) error {
+	// the attribute prevents renaming the log.
+	appendOnly, _ := setAppendOnly(l.path, false)
+	if l.maxFiles <= 0 {
+		if err := os.Remove(l.path); err != nil {
+			return err
+		}
+	} else {
+		_ = os.Remove(l.rotatedPath(l.maxFiles))
+		for i := l.maxFiles - 1; i > 0; i-- {
+			if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(l.path, l.rotatedPath(1)); err != nil {
+			return err
+		}
+		_ = os.Chmod(l.rotatedPath(1), st.Mode().Perm()&0600)
+	}
+
+	uid, gid, ok := fileOwner(st)
+	if !ok {
+		return nil
+	}
+	return createLog(l.path, uid, gid, st.Mode().Perm(), appendOnly)
+}
+
+// rotatedPath returns the path to the i-th rotated log.
+func (l *Logger) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
@@ -0,0 +1,148 @@
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func countLines(t *testing.T, p string) int {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	var n int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		n++
+	}
+	return n
+}
+
+func TestLoggerConcurrentWrites(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "audit.jsonl")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// separate loggers as if from separate sessions
+			l := NewLogger(logPath, 0, 0)
+			for j := 0; j < 50; j++ {
+				if err := l.Write(map[string]int{"session": i, "seq": j}); err != nil {
+					t.Error(err.Error())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := countLines(t, logPath); n != 400 {
+		t.Fatalf("expected 400 lines, got %d", n)
+	}
+}
+
+func TestLoggerRotates(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "audit.jsonl")
+	l := NewLogger(logPath, 64, 2)
+	for i := 0; i < 20; i++ {
+		if err := l.Write(map[string]int{"seq": i}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	st, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if st.Size() > 64 {
+		t.Fatalf("expected log to be rotated at 64 bytes, got %d", st.Size())
+	}
+	for _, p := range []string{logPath + ".1", logPath + ".2"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("expected rotated log %s: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most 2 rotated logs, got %v", err)
+	}
+}
+
+func TestLoggerPrepareForGroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to set the owner of the log")
+	}
+
+	logPath := path.Join(t.TempDir(), "audit.jsonl")
+	l := NewLogger(logPath, 64, 2)
+	if err := l.Prepare(1234); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _, _ = setAppendOnly(logPath, false) })
+	for i := 0; i < 10; i++ {
+		if err := l.Write(map[string]int{"seq": i}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// the current log stays writable by the group, rotated logs are not.
+	for p, mode := range map[string]os.FileMode{logPath: 0620, logPath + ".1": 0600} {
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		uid, gid, ok := fileOwner(st)
+		if st.Mode().Perm() != mode || (ok && (uid != 0 || gid != 1234)) {
+			t.Fatalf("%s: unexpected mode %v or owner %d:%d", p, st.Mode(), uid, gid)
+		}
+	}
+	// the attribute is kept after rotating, if the filesystem supports it.
+	if wasAppendOnly, err := setAppendOnly(logPath, true); err == nil && !wasAppendOnly {
+		t.Fatal("expected the rotated log to be append-only")
+	}
+}
+
+func TestLoggerRotatedByRoot(t *testing.T) {
+	// users can't rotate the log in the root-owned dir.
+	prevCanRotate := canRotate
+	canRotate = func(dir string) bool { return false }
+	t.Cleanup(func() { canRotate = prevCanRotate })
+
+	logPath := path.Join(t.TempDir(), "audit.jsonl")
+	l := NewLogger(logPath, 64, 2)
+	for i := 0; i < 10; i++ {
+		if err := l.Write(map[string]int{"seq": i}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if n := countLines(t, logPath); n != 10 {
+		t.Fatalf("expected the user to keep appending 10 lines, got %d", n)
+	}
+	if _, err := os.Stat(logPath + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("expected no rotated log, got %v", err)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to prepare the log")
+	}
+	// setup rotates the log as root.
+	if err := l.Prepare(1234); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { _, _ = setAppendOnly(logPath, false) })
+	if n := countLines(t, logPath+".1"); n != 10 {
+		t.Fatalf("expected 10 lines in the rotated log, got %d", n)
+	}
+	if n := countLines(t, logPath); n != 0 {
+		t.Fatalf("expected an empty log after rotating, got %d lines", n)
+	}
+}
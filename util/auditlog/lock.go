@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package auditlog
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive lock on the file at path.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package auditlog
+
+import (
+	"sync"
+)
+
+// lockMtx serializes writes within the process.
+var lockMtx sync.Mutex
+
+// lockFile acquires a process-local lock.
+//
+// Writes from other processes are not serialized on this platform.
+func lockFile(path string) (func(), error) {
+	lockMtx.Lock()
+	return lockMtx.Unlock, nil
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// authRealm is the realm of the basic auth challenge.
+const authRealm = "skiff-core"
+
+// authHandlerFunc is a handler for an authenticated user.
+type authHandlerFunc func(rw http.ResponseWriter, req *http.Request, userName string)
+
+// checkAuth checks the credentials of a request.
+//
+// Accepts the user's password or one of the user's tokens.
+func (s *Server) checkAuth(req *http.Request) (string, bool) {
+	userName, secret, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	user := s.conf.Users[userName]
+	if user == nil || user.Auth == nil {
+		return "", false
+	}
+	if user.Auth.CheckToken(secret) || user.Auth.CheckPassword(secret) {
+		return userName, true
+	}
+	return "", false
+}
+
+// requireAuth wraps a handler with basic auth.
+func (s *Server) requireAuth(handler authHandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		userName, ok := s.checkAuth(req)
+		if !ok {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`", charset="UTF-8"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(rw, req, userName)
+	}
+}
+
+// checkOrigin rejects WebSockets opened by other sites.
+//
+// Browsers send cached basic auth credentials with cross-site WebSockets.
+func checkOrigin(conf *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(conf, req)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != req.Host {
+		return websocket.ErrBadWebSocketOrigin
+	}
+	return nil
+}
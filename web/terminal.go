@@ -0,0 +1,132 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/shell"
+	"golang.org/x/net/websocket"
+)
+
+// termMessage is a message from the browser.
+type termMessage struct {
+	// Type is input or resize.
+	Type string `json:"type"`
+	// Data is the input for input messages.
+	Data string `json:"data,omitempty"`
+	// Cols is the width for resize messages.
+	Cols uint `json:"cols,omitempty"`
+	// Rows is the height for resize messages.
+	Rows uint `json:"rows,omitempty"`
+}
+
+// wsWriter writes output to the WebSocket as binary messages.
+type wsWriter struct {
+	mtx sync.Mutex
+	ws  *websocket.Conn
+}
+
+// Write writes a binary message.
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := websocket.Message.Send(w.ws, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serveTerminal bridges the WebSocket to a shell in the user's container.
+func (s *Server) serveTerminal(ws *websocket.Conn, req *http.Request, userName string) {
+	defer ws.Close()
+
+	query := req.URL.Query()
+	cols, _ := strconv.ParseUint(query.Get("cols"), 10, 16)
+	rows, _ := strconv.ParseUint(query.Get("rows"), 10, 16)
+	container := query.Get("container")
+
+	le := log.
+		WithField("user", userName).
+		WithField("remote", req.RemoteAddr).
+		WithField("container", container)
+	le.Info("Web terminal session started")
+
+	ctx, ctxCancel := context.WithCancel(req.Context())
+	defer ctxCancel()
+
+	inRead, inWrite := io.Pipe()
+	resize := make(chan shell.TtySize, 1)
+	out := &wsWriter{ws: ws}
+
+	// relay input and resize messages until the browser disconnects.
+	go func() {
+		defer ctxCancel()
+		defer inWrite.Close()
+		for {
+			var data string
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				return
+			}
+			var msg termMessage
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				if _, err := io.WriteString(inWrite, msg.Data); err != nil {
+					return
+				}
+			case "resize":
+				// replace any pending size with the latest.
+				select {
+				case <-resize:
+				default:
+				}
+				resize <- shell.TtySize{Height: msg.Rows, Width: msg.Cols}
+			}
+		}
+	}()
+
+	environ := []string{"TERM=xterm-256color"}
+	if container != "" {
+		environ = append(environ, shell.ContainerSelectEnv+"="+container)
+	}
+	shellReq := &shell.Request{
+		ExecWithShell: true,
+		Stdin:         inRead,
+		Stdout:        out,
+		Stderr:        out,
+		Tty:           true,
+		Size:          shell.TtySize{Height: uint(rows), Width: uint(cols)},
+		Resize:        resize,
+		Environ:       environ,
+		Source:        "web " + req.RemoteAddr,
+		UserName:      userName,
+	}
+
+	userConfig, err := shell.BuildUserConfig(ctx, s.conf, userName)
+	if err == nil {
+		err = s.sh.Run(ctx, userConfig, shellReq)
+	}
+
+	var exitErr *shell.ExitError
+	switch {
+	case err == nil:
+		fmt.Fprint(out, "\r\n[exited]\r\n")
+	case errors.As(err, &exitErr):
+		fmt.Fprintf(out, "\r\n[exited with status %d]\r\n", exitErr.Code)
+	case ctx.Err() != nil:
+		// the browser disconnected.
+	default:
+		le.WithError(err).Warn("Web terminal session failed")
+		fmt.Fprintf(out, "\r\nskiff-core: %s\r\n", err.Error())
+	}
+	le.Info("Web terminal session ended")
+}
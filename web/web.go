@@ -0,0 +1,141 @@
+package web
+
+import (
+	_ "embed"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skiffos/skiff-core/config"
+	"github.com/skiffos/skiff-core/shell"
+	"golang.org/x/net/websocket"
+)
+
+// Paths served by the web terminal.
+const (
+	webSocketPath = "/ws"
+	assetsPath    = "/assets/"
+)
+
+//go:embed index.html
+var indexHTML string
+
+// indexTemplate is the page containing the terminal.
+var indexTemplate = template.Must(template.New("index").Parse(indexHTML))
+
+// indexData is the data for indexTemplate.
+type indexData struct {
+	User          string
+	Containers    []string
+	ScriptURL     string
+	CSSURL        string
+	WebSocketPath string
+}
+
+// Server is the web terminal server.
+//
+// Serves an xterm.js page and bridges a WebSocket to an exec in the user's
+// container. Users authenticate with HTTP basic auth using their password or
+// one of their tokens.
+type Server struct {
+	conf    *config.Config
+	webConf *config.ConfigWeb
+	sh      *shell.Shell
+	mux     *http.ServeMux
+
+	listenMtx sync.Mutex
+	listener  net.Listener
+}
+
+// NewServer builds a new web terminal server from the config.
+func NewServer(conf *config.Config) *Server {
+	webConf := conf.Web
+	if webConf == nil {
+		webConf = &config.ConfigWeb{}
+		webConf.FillDefaults()
+	}
+
+	s := &Server{conf: conf, webConf: webConf, sh: shell.NewShell(""), mux: http.NewServeMux()}
+	s.mux.HandleFunc("/", s.requireAuth(s.serveIndex))
+	s.mux.Handle(webSocketPath, s.requireAuth(func(rw http.ResponseWriter, req *http.Request, userName string) {
+		srv := websocket.Server{
+			Handshake: checkOrigin,
+			Handler: func(ws *websocket.Conn) {
+				s.serveTerminal(ws, req, userName)
+			},
+		}
+		srv.ServeHTTP(rw, req)
+	}))
+	if webConf.AssetsDir != "" {
+		assets := http.StripPrefix(assetsPath, http.FileServer(http.Dir(webConf.AssetsDir)))
+		s.mux.Handle(assetsPath, s.requireAuth(func(rw http.ResponseWriter, req *http.Request, _ string) {
+			assets.ServeHTTP(rw, req)
+		}))
+	}
+	return s
+}
+
+// ServeHTTP serves a HTTP request.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(rw, req)
+}
+
+// ListenAndServe listens on the address and serves requests.
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listenMtx.Lock()
+	s.listener = listener
+	s.listenMtx.Unlock()
+
+	log.WithField("addr", listener.Addr().String()).Info("Web terminal listening")
+	return http.Serve(listener, s)
+}
+
+// Close stops the listener.
+func (s *Server) Close() error {
+	s.listenMtx.Lock()
+	defer s.listenMtx.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// serveIndex serves the terminal page.
+func (s *Server) serveIndex(rw http.ResponseWriter, req *http.Request, userName string) {
+	if req.URL.Path != "/" {
+		http.NotFound(rw, req)
+		return
+	}
+
+	data := &indexData{
+		User:          userName,
+		WebSocketPath: webSocketPath,
+	}
+	if user := s.conf.Users[userName]; user != nil {
+		for _, name := range user.AllowedContainers() {
+			data.Containers = append(data.Containers, strings.TrimPrefix(name, "/"))
+		}
+	}
+	// xterm.js is only loaded from the same origin: never from a CDN.
+	if s.webConf.AssetsDir != "" {
+		data.ScriptURL = assetsPath + "xterm.js"
+		data.CSSURL = assetsPath + "xterm.css"
+	} else {
+		base := strings.TrimSuffix(s.webConf.XtermURL, "/")
+		data.ScriptURL = base + "/lib/xterm.js"
+		data.CSSURL = base + "/css/xterm.css"
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := indexTemplate.Execute(rw, data); err != nil {
+		log.WithError(err).Warn("Unable to render web terminal page")
+	}
+}
@@ -0,0 +1,143 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skiffos/skiff-core/config"
+	"golang.org/x/net/websocket"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	conf := &config.Config{
+		Containers: map[string]*config.ConfigContainer{
+			"core": {Image: "test"},
+		},
+		Users: map[string]*config.ConfigUser{
+			"core": {
+				Container: "core",
+				Auth: &config.ConfigUserAuth{
+					Password: "hunter2",
+					Tokens:   []string{"tok-1234"},
+				},
+			},
+			"locked": {
+				Container: "core",
+				Auth: &config.ConfigUserAuth{
+					Password: "hunter2",
+					Tokens:   []string{"tok-5678"},
+					Locked:   true,
+				},
+			},
+		},
+	}
+	conf.FillPrivateFields()
+	conf.FillDefaults()
+	srv := httptest.NewServer(NewServer(conf))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIndexRequiresAuth(t *testing.T) {
+	srv := newTestServer(t)
+	cases := []struct {
+		user, secret string
+		status       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"core", "hunter3", http.StatusUnauthorized},
+		{"core", "hunter2", http.StatusOK},
+		{"core", "tok-1234", http.StatusOK},
+		{"locked", "hunter2", http.StatusUnauthorized},
+		{"unknown", "hunter2", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s/%s: expected status %d, got %d", c.user, c.secret, c.status, resp.StatusCode)
+		}
+		if c.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s/%s: expected basic auth challenge", c.user, c.secret)
+		}
+	}
+}
+
+func TestIndexLoadsLocalAssets(t *testing.T) {
+	srv := newTestServer(t)
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.SetBasicAuth("core", "hunter2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(body), `src="/assets/xterm.js"`) || strings.Contains(string(body), "https://") {
+		t.Fatalf("expected xterm.js to be loaded from the server, got %s", string(body))
+	}
+
+	cases := []struct {
+		url string
+		ok  bool
+	}{
+		{"/xterm", true},
+		{"https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0", false},
+		{"//cdn.jsdelivr.net/npm/@xterm/xterm", false},
+		{"xterm", false},
+	}
+	for _, c := range cases {
+		webConf := &config.ConfigWeb{XtermURL: c.url}
+		if err := webConf.Validate(); (err == nil) != c.ok {
+			t.Errorf("%s: expected ok=%v, got %v", c.url, c.ok, err)
+		}
+	}
+}
+
+func TestWebSocketChecksOrigin(t *testing.T) {
+	srv := newTestServer(t)
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + webSocketPath
+
+	wsConf, err := websocket.NewConfig(wsURL, "https://evil.example.com")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	wsConf.Header.Set("Authorization", "Basic Y29yZTpodW50ZXIy") // core:hunter2
+	if ws, err := websocket.DialConfig(wsConf); err == nil {
+		ws.Close()
+		t.Fatal("expected cross-origin websocket to be rejected")
+	}
+
+	wsConf, err = websocket.NewConfig(wsURL, srv.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	wsConf.Header.Set("Authorization", "Basic Y29yZTpodW50ZXIy")
+	ws, err := websocket.DialConfig(wsConf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ws.Close()
+
+	// without docker the session ends with an error message.
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(msg), "skiff-core:") {
+		t.Fatalf("unexpected output: %q", string(msg))
+	}
+}